@@ -2,12 +2,17 @@
 package benchmark
 
 import (
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
 	"testing"
 
 	"google.golang.org/protobuf/proto"
 
 	"github.com/LyrinoxTechnologies/ridged-proto/benchmark/protobuff"
 	"github.com/LyrinoxTechnologies/ridged-proto/benchmark/rdg"
+	"github.com/LyrinoxTechnologies/ridged-proto/rdgproto"
 )
 
 // --------------------
@@ -114,3 +119,102 @@ func BenchmarkRdgproto_LargeTransport_Chunked(b *testing.B) {
 		}
 	}
 }
+
+// --------------------
+// Loopback socket transport
+// --------------------
+
+// loopbackConn dials a real socket ("tcp" or "unix") whose far end is drained,
+// so the benchmarks measure the send path including system calls
+func loopbackConn(b *testing.B, network string) net.Conn {
+	b.Helper()
+	address := "127.0.0.1:0"
+	if network == "unix" {
+		address = filepath.Join(b.TempDir(), "bench.sock")
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		b.Skipf("%s sockets unavailable: %v", network, err)
+	}
+	go func() {
+		conn, err := ln.Accept()
+		ln.Close()
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	}()
+
+	conn, err := net.Dial(network, ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// sendTwoWrites is the classic send path: marshal the whole message, then write
+// the length prefix and the message with two separate Write calls
+func sendTwoWrites(conn net.Conn, msgType byte, id uint32, payload interface{}) error {
+	data, err := rdgproto.MarshalMessage(msgType, id, payload, nil)
+	if err != nil {
+		return err
+	}
+	lenBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(lenBuf, uint32(len(data)))
+	if _, err := conn.Write(lenBuf); err != nil {
+		return err
+	}
+	_, err = conn.Write(data)
+	return err
+}
+
+// benchmarkLoopbackSend compares the two-write path against Protocol.SendMessage,
+// which writes each message with a single (vectored on TCP/Unix) write from pooled buffers
+func benchmarkLoopbackSend(b *testing.B, network string, payload interface{}, size int) {
+	b.Run("TwoWrites", func(b *testing.B) {
+		conn := loopbackConn(b, network)
+		b.SetBytes(int64(size))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := sendTwoWrites(conn, 1, uint32(i), payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Protocol", func(b *testing.B) {
+		p := rdgproto.NewProtocol(loopbackConn(b, network), nil)
+		b.SetBytes(int64(size))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := p.SendMessage(1, uint32(i), payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkRdgproto_TCPLoopback_SmallBlob(b *testing.B) {
+	benchmarkLoopbackSend(b, "tcp", &rdg.Blob{Data: smallPayload}, len(smallPayload))
+}
+
+func BenchmarkRdgproto_TCPLoopback_MediumBytes(b *testing.B) {
+	benchmarkLoopbackSend(b, "tcp", mediumPayload, len(mediumPayload))
+}
+
+func BenchmarkRdgproto_TCPLoopback_LargeBytes(b *testing.B) {
+	// Above the default 1MB threshold: sent as a stream of chunks
+	benchmarkLoopbackSend(b, "tcp", largePayload, len(largePayload))
+}
+
+func BenchmarkRdgproto_UnixLoopback_SmallBlob(b *testing.B) {
+	benchmarkLoopbackSend(b, "unix", &rdg.Blob{Data: smallPayload}, len(smallPayload))
+}
+
+func BenchmarkRdgproto_UnixLoopback_MediumBytes(b *testing.B) {
+	benchmarkLoopbackSend(b, "unix", mediumPayload, len(mediumPayload))
+}
@@ -0,0 +1,698 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const rdgprotoPath = "github.com/LyrinoxTechnologies/ridged-proto/rdgproto"
+
+// Directives recognized in type doc comments
+const (
+	directivePayload = "//rdg:payload"
+	directiveMessage = "//rdg:message"
+)
+
+var errUnsupported = errors.New("unsupported field type")
+
+// payloadSpec describes a struct to generate methods for
+type payloadSpec struct {
+	name    string
+	msgType string // Registration expression, empty for rdg:payload
+	fields  []fieldSpec
+}
+
+// fieldSpec describes a single encoded field
+type fieldSpec struct {
+	name  string
+	typ   types.Type
+	fixed bool
+}
+
+// generator emits Go source for a set of payload specs
+type generator struct {
+	pkg     *types.Package
+	specs   map[string]*payloadSpec
+	imports map[string]string
+	buf     bytes.Buffer
+	tmp     int
+}
+
+// Generate parses the package in dir and returns the generated source.
+// outName is excluded from parsing so a stale generated file never affects the result.
+func Generate(dir, outName string, extraTypes []string) ([]byte, error) {
+	bp, err := build.ImportDir(dir, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, name := range bp.GoFiles {
+		if name == outName {
+			continue
+		}
+		f, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no Go files in %s", dir)
+	}
+
+	// Type errors are tolerated: only the field types of selected structs matter
+	conf := types.Config{
+		Importer: importer.ForCompiler(fset, "source", nil),
+		Error:    func(error) {},
+	}
+	pkg, _ := conf.Check(files[0].Name.Name, fset, files, nil)
+
+	order, msgTypes := collectDirectives(files)
+	for _, name := range extraTypes {
+		name = strings.TrimSpace(name)
+		if _, ok := msgTypes[name]; !ok && name != "" {
+			order = append(order, name)
+			msgTypes[name] = ""
+		}
+	}
+	if len(order) == 0 {
+		return nil, fmt.Errorf("no types annotated with %s or %s in %s", directivePayload, directiveMessage, dir)
+	}
+
+	g := &generator{
+		pkg:     pkg,
+		specs:   make(map[string]*payloadSpec),
+		imports: map[string]string{"bytes": "bytes", rdgprotoPath: "rdgproto"},
+	}
+	specs := make([]*payloadSpec, 0, len(order))
+	for _, name := range order {
+		spec, err := g.buildSpec(name, msgTypes[name])
+		if err != nil {
+			return nil, err
+		}
+		g.specs[name] = spec
+		specs = append(specs, spec)
+	}
+
+	var body bytes.Buffer
+	for _, spec := range specs {
+		if err := g.emitPayload(spec); err != nil {
+			return nil, err
+		}
+		body.Write(g.buf.Bytes())
+		g.buf.Reset()
+	}
+	g.emitInit(specs)
+	body.Write(g.buf.Bytes())
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by rdggen. DO NOT EDIT.\n\npackage %s\n\n", pkg.Name())
+	g.writeImports(&out)
+	out.Write(body.Bytes())
+
+	src, err := format.Source(out.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting generated code: %v", err)
+	}
+	return src, nil
+}
+
+// collectDirectives returns annotated type names in source order with their registration expressions
+func collectDirectives(files []*ast.File) ([]string, map[string]string) {
+	var order []string
+	msgTypes := make(map[string]string)
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			gd, ok := decl.(*ast.GenDecl)
+			if !ok || gd.Tok != token.TYPE {
+				continue
+			}
+			for _, s := range gd.Specs {
+				ts := s.(*ast.TypeSpec)
+				doc := ts.Doc
+				if doc == nil && len(gd.Specs) == 1 {
+					doc = gd.Doc
+				}
+				if doc == nil {
+					continue
+				}
+				for _, c := range doc.List {
+					switch {
+					case c.Text == directivePayload:
+						order = append(order, ts.Name.Name)
+						msgTypes[ts.Name.Name] = ""
+					case strings.HasPrefix(c.Text, directiveMessage+" "):
+						order = append(order, ts.Name.Name)
+						msgTypes[ts.Name.Name] = strings.TrimSpace(strings.TrimPrefix(c.Text, directiveMessage))
+					}
+				}
+			}
+		}
+	}
+	return order, msgTypes
+}
+
+// buildSpec resolves the encoded fields of a struct type
+func (g *generator) buildSpec(name, msgType string) (*payloadSpec, error) {
+	obj, ok := g.pkg.Scope().Lookup(name).(*types.TypeName)
+	if !ok {
+		return nil, fmt.Errorf("type %s not found", name)
+	}
+	st, ok := obj.Type().Underlying().(*types.Struct)
+	if !ok {
+		return nil, fmt.Errorf("type %s is not a struct", name)
+	}
+
+	spec := &payloadSpec{name: name, msgType: msgType}
+
+	// Structs with rdg tags use tag order, otherwise exported declaration order
+	tagged := false
+	for i := 0; i < st.NumFields(); i++ {
+		if _, ok := reflect.StructTag(st.Tag(i)).Lookup("rdg"); ok {
+			tagged = true
+			break
+		}
+	}
+
+	nums := make(map[int]string)
+	numbered := make(map[string]int)
+	for i := 0; i < st.NumFields(); i++ {
+		f := st.Field(i)
+		tag, hasTag := reflect.StructTag(st.Tag(i)).Lookup("rdg")
+		if tag == "-" || (tagged && !hasTag) || (!tagged && !f.Exported()) {
+			continue
+		}
+		if !f.Exported() {
+			return nil, fmt.Errorf("%s.%s: tagged field is unexported", name, f.Name())
+		}
+		field := fieldSpec{name: f.Name(), typ: f.Type()}
+		if tagged {
+			num, fixed, err := parseTag(tag)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %v", name, f.Name(), err)
+			}
+			if prev, dup := nums[num]; dup {
+				return nil, fmt.Errorf("%s.%s reuses number %d of %s", name, f.Name(), num, prev)
+			}
+			nums[num] = f.Name()
+			numbered[f.Name()] = num
+			field.fixed = fixed
+		}
+		spec.fields = append(spec.fields, field)
+	}
+	if tagged {
+		sort.SliceStable(spec.fields, func(i, j int) bool {
+			return numbered[spec.fields[i].name] < numbered[spec.fields[j].name]
+		})
+	}
+	return spec, nil
+}
+
+// parseTag parses `N[,fixed|,varint]`, mirroring the rdgproto struct codec
+func parseTag(tag string) (int, bool, error) {
+	parts := strings.Split(tag, ",")
+	num, err := strconv.Atoi(parts[0])
+	if err != nil || num <= 0 {
+		return 0, false, fmt.Errorf("field number must be a positive integer, got %q", parts[0])
+	}
+	fixed := false
+	for _, opt := range parts[1:] {
+		switch opt {
+		case "fixed":
+			fixed = true
+		case "varint":
+			fixed = false
+		default:
+			return 0, false, fmt.Errorf("unknown option %q", opt)
+		}
+	}
+	return num, fixed, nil
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+	g.buf.WriteByte('\n')
+}
+
+// check emits a call whose error result must be propagated
+func (g *generator) check(format string, args ...interface{}) {
+	g.printf("if err := "+format+"; err != nil {\nreturn err\n}", args...)
+}
+
+// checkAssign emits an assignment from a (value, error) call, reusing the outer err
+func (g *generator) checkAssign(target, format string, args ...interface{}) {
+	g.printf("if "+target+", err = "+format+"; err != nil {\nreturn err\n}", args...)
+}
+
+// temp returns a fresh local variable name
+func (g *generator) temp(prefix string) string {
+	g.tmp++
+	return prefix + strconv.Itoa(g.tmp)
+}
+
+// typeString renders t relative to the generated package, recording imports
+func (g *generator) typeString(t types.Type) string {
+	return types.TypeString(t, func(p *types.Package) string {
+		if p == g.pkg {
+			return ""
+		}
+		g.imports[p.Path()] = p.Name()
+		return p.Name()
+	})
+}
+
+func (g *generator) receiver(name string) string {
+	r := strings.ToLower(name[:1])
+	if r == "r" {
+		return "p" // r is the reader in generated decoders
+	}
+	return r
+}
+
+// emitPayload writes the Marshal/Unmarshal methods of a single type
+func (g *generator) emitPayload(spec *payloadSpec) error {
+	recv := g.receiver(spec.name)
+	g.tmp = 0
+
+	g.printf("// Marshal implements rdgproto.PayloadMarshaler")
+	g.printf("func (%s *%s) Marshal() ([]byte, error) {", recv, spec.name)
+	g.printf("buf := rdgproto.GetBuffer()\ndefer rdgproto.PutBuffer(buf)\n")
+	g.printf("if err := %s.rdgEncode(buf); err != nil {\nreturn nil, err\n}\n", recv)
+	g.printf("out := make([]byte, buf.Len())\ncopy(out, buf.Bytes())\nreturn out, nil\n}\n")
+
+	g.printf("// Unmarshal implements rdgproto.PayloadUnmarshaler")
+	g.printf("func (%s *%s) Unmarshal(data []byte) error {", recv, spec.name)
+	g.printf("return %s.rdgDecode(bytes.NewReader(data))\n}\n", recv)
+
+	g.printf("func (%s *%s) rdgEncode(buf *bytes.Buffer) error {", recv, spec.name)
+	for _, f := range spec.fields {
+		if err := g.encode(recv+"."+f.name, f.typ, f.fixed); err != nil {
+			return fmt.Errorf("%s.%s: %w", spec.name, f.name, err)
+		}
+	}
+	g.printf("return nil\n}\n")
+
+	g.printf("func (%s *%s) rdgDecode(r *bytes.Reader) error {", recv, spec.name)
+	if len(spec.fields) > 0 {
+		g.printf("var err error")
+	}
+	for _, f := range spec.fields {
+		if err := g.decode(recv+"."+f.name, f.typ, f.fixed); err != nil {
+			return fmt.Errorf("%s.%s: %w", spec.name, f.name, err)
+		}
+	}
+	g.printf("return nil\n}\n")
+	return nil
+}
+
+// emitInit registers types annotated with rdg:message
+func (g *generator) emitInit(specs []*payloadSpec) {
+	var registered []*payloadSpec
+	for _, spec := range specs {
+		if spec.msgType != "" {
+			registered = append(registered, spec)
+		}
+	}
+	if len(registered) == 0 {
+		return
+	}
+	g.printf("func init() {")
+	for _, spec := range registered {
+		g.printf("rdgproto.RegisterPayloadType(%s, func() rdgproto.PayloadUnmarshaler { return &%s{} })", spec.msgType, spec.name)
+	}
+	g.printf("}")
+}
+
+func (g *generator) writeImports(out *bytes.Buffer) {
+	var std, other []string
+	for path := range g.imports {
+		if strings.Contains(path, ".") {
+			other = append(other, path)
+		} else {
+			std = append(std, path)
+		}
+	}
+	sort.Strings(std)
+	sort.Strings(other)
+
+	out.WriteString("import (\n")
+	for _, p := range std {
+		fmt.Fprintf(out, "%q\n", p)
+	}
+	if len(std) > 0 && len(other) > 0 {
+		out.WriteString("\n")
+	}
+	for _, p := range other {
+		fmt.Fprintf(out, "%q\n", p)
+	}
+	out.WriteString(")\n\n")
+}
+
+// isBasic reports whether t is exactly the unnamed basic type of the given kind
+func isBasic(t types.Type, kind types.BasicKind) bool {
+	b, ok := t.(*types.Basic)
+	return ok && b.Kind() == kind
+}
+
+// isByte reports whether t has an underlying type of byte
+func isByte(t types.Type) bool {
+	b, ok := t.Underlying().(*types.Basic)
+	return ok && b.Kind() == types.Uint8
+}
+
+// exportedName upper-cases the first letter of a basic type name (int8 -> Int8)
+func exportedName(name string) string {
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// conv wraps x in a conversion to the named basic type unless t already is that type
+func conv(t types.Type, kind types.BasicKind, x string) string {
+	if isBasic(t, kind) {
+		return x
+	}
+	return types.Typ[kind].Name() + "(" + x + ")"
+}
+
+// isTime reports whether t is time.Time
+func isTime(t types.Type) bool {
+	named, ok := t.(*types.Named)
+	return ok && named.Obj().Pkg() != nil && named.Obj().Pkg().Path() == "time" && named.Obj().Name() == "Time"
+}
+
+// encode emits code writing expression x of type t
+func (g *generator) encode(x string, t types.Type, fixed bool) error {
+	if isTime(t) {
+		g.check("rdgproto.WriteTime(buf, %s)", x)
+		return nil
+	}
+	if named, ok := t.(*types.Named); ok {
+		if _, gen := g.specs[named.Obj().Name()]; gen && named.Obj().Pkg() == g.pkg {
+			g.check("%s.rdgEncode(buf)", x)
+			return nil
+		}
+	}
+
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		return g.encodeBasic(x, t, u, fixed)
+
+	case *types.Slice:
+		if isByte(u.Elem()) {
+			g.check("rdgproto.WriteBytes(buf, %s)", x)
+			return nil
+		}
+		v := g.temp("v")
+		g.check("rdgproto.WriteUint32(buf, uint32(len(%s)))", x)
+		g.printf("for _, %s := range %s {", v, x)
+		if err := g.encode(v, u.Elem(), false); err != nil {
+			return err
+		}
+		g.printf("}")
+		return nil
+
+	case *types.Array:
+		if isByte(u.Elem()) {
+			g.printf("if _, err := buf.Write(%s[:]); err != nil {\nreturn err\n}", x)
+			return nil
+		}
+		i := g.temp("i")
+		g.printf("for %s := range %s {", i, x)
+		if err := g.encode(x+"["+i+"]", u.Elem(), false); err != nil {
+			return err
+		}
+		g.printf("}")
+		return nil
+
+	case *types.Map:
+		less, err := g.keyLess(u.Key())
+		if err != nil {
+			return err
+		}
+		keys, k, v := g.temp("keys"), g.temp("k"), g.temp("v")
+		g.imports["sort"] = "sort"
+		g.check("rdgproto.WriteUint32(buf, uint32(len(%s)))", x)
+		g.printf("%s := make([]%s, 0, len(%s))", keys, g.typeString(u.Key()), x)
+		g.printf("for %s := range %s {\n%s = append(%s, %s)\n}", k, x, keys, keys, k)
+		g.printf("sort.Slice(%s, func(i, j int) bool { return %s })", keys, fmt.Sprintf(less, keys+"[i]", keys+"[j]"))
+		g.printf("for _, %s := range %s {", k, keys)
+		g.printf("%s := %s[%s]", v, x, k)
+		if err := g.encode(k, u.Key(), false); err != nil {
+			return err
+		}
+		if err := g.encode(v, u.Elem(), false); err != nil {
+			return err
+		}
+		g.printf("}")
+		return nil
+
+	case *types.Pointer:
+		e := g.temp("e")
+		g.check("rdgproto.WriteBool(buf, %s != nil)", x)
+		g.printf("if %s != nil {", x)
+		g.printf("%s := *%s", e, x)
+		if err := g.encode(e, u.Elem(), false); err != nil {
+			return err
+		}
+		g.printf("}")
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", errUnsupported, g.typeString(t))
+}
+
+func (g *generator) encodeBasic(x string, t types.Type, b *types.Basic, fixed bool) error {
+	kind := b.Kind()
+	if fixed && kind != types.Uint32 && kind != types.Uint64 && kind != types.Int32 && kind != types.Int64 {
+		return fmt.Errorf("fixed encoding requires a 32 or 64-bit integer, got %s", g.typeString(t))
+	}
+
+	switch kind {
+	case types.String:
+		g.check("rdgproto.WriteString(buf, %s)", conv(t, types.String, x))
+	case types.Bool:
+		g.check("rdgproto.WriteBool(buf, %s)", conv(t, types.Bool, x))
+	case types.Uint8, types.Uint16, types.Uint32:
+		if fixed {
+			g.check("rdgproto.WriteUint32Fixed(buf, %s)", conv(t, types.Uint32, x))
+		} else {
+			g.check("rdgproto.WriteUint32(buf, %s)", conv(t, types.Uint32, x))
+		}
+	case types.Uint64, types.Uint, types.Uintptr:
+		if fixed {
+			g.check("rdgproto.WriteUint64Fixed(buf, %s)", conv(t, types.Uint64, x))
+		} else {
+			g.check("rdgproto.WriteUint64(buf, %s)", conv(t, types.Uint64, x))
+		}
+	case types.Int8, types.Int16, types.Int32:
+		if fixed {
+			g.check("rdgproto.WriteInt32Fixed(buf, %s)", conv(t, types.Int32, x))
+		} else {
+			g.check("rdgproto.WriteInt32(buf, %s)", conv(t, types.Int32, x))
+		}
+	case types.Int64, types.Int:
+		if fixed {
+			g.check("rdgproto.WriteInt64Fixed(buf, %s)", conv(t, types.Int64, x))
+		} else {
+			g.check("rdgproto.WriteInt64(buf, %s)", conv(t, types.Int64, x))
+		}
+	case types.Float32:
+		g.check("rdgproto.WriteFloat32(buf, %s)", conv(t, types.Float32, x))
+	case types.Float64:
+		g.check("rdgproto.WriteFloat64(buf, %s)", conv(t, types.Float64, x))
+	default:
+		return fmt.Errorf("%w: %s", errUnsupported, g.typeString(t))
+	}
+	return nil
+}
+
+// keyLess returns a format string comparing two map keys
+func (g *generator) keyLess(t types.Type) (string, error) {
+	b, ok := t.Underlying().(*types.Basic)
+	if !ok {
+		return "", fmt.Errorf("%w: map key %s", errUnsupported, g.typeString(t))
+	}
+	switch {
+	case b.Kind() == types.Bool:
+		return "!%s && %s", nil
+	case b.Info()&(types.IsInteger|types.IsFloat|types.IsString) != 0:
+		return "%s < %s", nil
+	}
+	return "", fmt.Errorf("%w: map key %s", errUnsupported, g.typeString(t))
+}
+
+// decode emits code reading into the assignable expression x of type t
+func (g *generator) decode(x string, t types.Type, fixed bool) error {
+	if isTime(t) {
+		g.checkAssign(x, "rdgproto.ReadTime(r)")
+		return nil
+	}
+	if named, ok := t.(*types.Named); ok {
+		if _, gen := g.specs[named.Obj().Name()]; gen && named.Obj().Pkg() == g.pkg {
+			g.printf("if err = %s.rdgDecode(r); err != nil {\nreturn err\n}", x)
+			return nil
+		}
+	}
+
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		return g.decodeBasic(x, t, u, fixed)
+
+	case *types.Slice:
+		if isByte(u.Elem()) {
+			g.readInto(x, t, types.NewSlice(types.Typ[types.Byte]), "rdgproto.ReadBytes(r)")
+			return nil
+		}
+		n, i := g.temp("n"), g.temp("i")
+		g.readCount(n)
+		g.printf("%s = make(%s, %s)", x, g.typeString(t), n)
+		g.printf("for %s := range %s {", i, x)
+		if err := g.decode(x+"["+i+"]", u.Elem(), false); err != nil {
+			return err
+		}
+		g.printf("}")
+		return nil
+
+	case *types.Array:
+		if isByte(u.Elem()) {
+			g.imports["io"] = "io"
+			g.printf("if _, err = io.ReadFull(r, %s[:]); err != nil {\nreturn err\n}", x)
+			return nil
+		}
+		i := g.temp("i")
+		g.printf("for %s := range %s {", i, x)
+		if err := g.decode(x+"["+i+"]", u.Elem(), false); err != nil {
+			return err
+		}
+		g.printf("}")
+		return nil
+
+	case *types.Map:
+		if _, err := g.keyLess(u.Key()); err != nil {
+			return err
+		}
+		n, i, k, v := g.temp("n"), g.temp("i"), g.temp("k"), g.temp("v")
+		g.readCount(n)
+		g.printf("%s = make(%s, %s)", x, g.typeString(t), n)
+		g.printf("for %s := uint32(0); %s < %s; %s++ {", i, i, n, i)
+		g.printf("var %s %s", k, g.typeString(u.Key()))
+		g.printf("var %s %s", v, g.typeString(u.Elem()))
+		if err := g.decode(k, u.Key(), false); err != nil {
+			return err
+		}
+		if err := g.decode(v, u.Elem(), false); err != nil {
+			return err
+		}
+		g.printf("%s[%s] = %s", x, k, v)
+		g.printf("}")
+		return nil
+
+	case *types.Pointer:
+		present, e := g.temp("present"), g.temp("e")
+		g.printf("var %s bool", present)
+		g.checkAssign(present, "rdgproto.ReadBool(r)")
+		g.printf("if %s {", present)
+		g.printf("var %s %s", e, g.typeString(u.Elem()))
+		if err := g.decode(e, u.Elem(), false); err != nil {
+			return err
+		}
+		g.printf("%s = &%s", x, e)
+		g.printf("} else {\n%s = nil\n}", x)
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", errUnsupported, g.typeString(t))
+}
+
+// readCount emits a length prefix read bounded by the remaining input
+func (g *generator) readCount(n string) {
+	g.printf("var %s uint32", n)
+	g.checkAssign(n, "rdgproto.ReadUint32(r)")
+	g.printf("if int(%s) > r.Len() {\nreturn rdgproto.ErrInvalidCount\n}", n)
+}
+
+// readInto assigns the result of call (of type read) to x, converting when x has a different type
+func (g *generator) readInto(x string, t, read types.Type, call string) {
+	if types.Identical(t, read) {
+		g.checkAssign(x, call)
+		return
+	}
+	v := g.temp("v")
+	g.printf("var %s %s", v, g.typeString(read))
+	g.checkAssign(v, call)
+	g.printf("%s = %s(%s)", x, g.typeString(t), v)
+}
+
+func (g *generator) decodeBasic(x string, t types.Type, b *types.Basic, fixed bool) error {
+	kind := b.Kind()
+	if fixed && kind != types.Uint32 && kind != types.Uint64 && kind != types.Int32 && kind != types.Int64 {
+		return fmt.Errorf("fixed encoding requires a 32 or 64-bit integer, got %s", g.typeString(t))
+	}
+
+	switch kind {
+	case types.String:
+		g.readInto(x, t, types.Typ[types.String], "rdgproto.ReadString(r)")
+	case types.Bool:
+		g.readInto(x, t, types.Typ[types.Bool], "rdgproto.ReadBool(r)")
+	case types.Uint8, types.Uint16:
+		g.imports["math"] = "math"
+		v := g.temp("v")
+		g.printf("var %s uint32", v)
+		g.checkAssign(v, "rdgproto.ReadUint32(r)")
+		g.printf("if %s > math.Max%s {\nreturn rdgproto.ErrVarintOverflow\n}", v, exportedName(b.Name()))
+		g.printf("%s = %s(%s)", x, g.typeString(t), v)
+	case types.Uint32:
+		if fixed {
+			g.readInto(x, t, types.Typ[types.Uint32], "rdgproto.ReadUint32Fixed(r)")
+		} else {
+			g.readInto(x, t, types.Typ[types.Uint32], "rdgproto.ReadUint32(r)")
+		}
+	case types.Uint64, types.Uint, types.Uintptr:
+		if fixed {
+			g.readInto(x, t, types.Typ[types.Uint64], "rdgproto.ReadUint64Fixed(r)")
+		} else {
+			g.readInto(x, t, types.Typ[types.Uint64], "rdgproto.ReadUint64(r)")
+		}
+	case types.Int8, types.Int16:
+		g.imports["math"] = "math"
+		v := g.temp("v")
+		name := exportedName(b.Name())
+		g.printf("var %s int32", v)
+		g.checkAssign(v, "rdgproto.ReadInt32(r)")
+		g.printf("if %s < math.Min%s || %s > math.Max%s {\nreturn rdgproto.ErrVarintOverflow\n}", v, name, v, name)
+		g.printf("%s = %s(%s)", x, g.typeString(t), v)
+	case types.Int32:
+		if fixed {
+			g.readInto(x, t, types.Typ[types.Int32], "rdgproto.ReadInt32Fixed(r)")
+		} else {
+			g.readInto(x, t, types.Typ[types.Int32], "rdgproto.ReadInt32(r)")
+		}
+	case types.Int64, types.Int:
+		if fixed {
+			g.readInto(x, t, types.Typ[types.Int64], "rdgproto.ReadInt64Fixed(r)")
+		} else {
+			g.readInto(x, t, types.Typ[types.Int64], "rdgproto.ReadInt64(r)")
+		}
+	case types.Float32:
+		g.readInto(x, t, types.Typ[types.Float32], "rdgproto.ReadFloat32(r)")
+	case types.Float64:
+		g.readInto(x, t, types.Typ[types.Float64], "rdgproto.ReadFloat64(r)")
+	default:
+		return fmt.Errorf("%w: %s", errUnsupported, g.typeString(t))
+	}
+	return nil
+}
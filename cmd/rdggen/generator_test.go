@@ -0,0 +1,217 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testTypes = `package gentest
+
+import "time"
+
+const MsgTypeLogin byte = 1
+
+type Level int8
+
+//rdg:message MsgTypeLogin
+type LoginRequest struct {
+	Username string
+	Password string
+	ClientId string
+}
+
+//rdg:payload
+type Inner struct {
+	Label string ` + "`rdg:\"1\"`" + `
+	Score int32  ` + "`rdg:\"2\"`" + `
+}
+
+//rdg:payload
+type Record struct {
+	Name     string            ` + "`rdg:\"2\"`" + `
+	ID       uint64            ` + "`rdg:\"1\"`" + `
+	Offset   int64             ` + "`rdg:\"3\"`" + `
+	Counter  uint32            ` + "`rdg:\"4,fixed\"`" + `
+	Ratio    float64           ` + "`rdg:\"5\"`" + `
+	Raw      []byte            ` + "`rdg:\"6\"`" + `
+	Tags     []string          ` + "`rdg:\"7\"`" + `
+	Inner    Inner             ` + "`rdg:\"8\"`" + `
+	Children []Inner           ` + "`rdg:\"9\"`" + `
+	Attrs    map[string]uint32 ` + "`rdg:\"10\"`" + `
+	Parent   *Inner            ` + "`rdg:\"11\"`" + `
+	Hash     [4]byte           ` + "`rdg:\"12\"`" + `
+	Lvl      Level             ` + "`rdg:\"13\"`" + `
+	Ratio32  float32           ` + "`rdg:\"14\"`" + `
+	Delta    int32             ` + "`rdg:\"15,fixed\"`" + `
+	At       time.Time         ` + "`rdg:\"16\"`" + `
+	Timeout  time.Duration     ` + "`rdg:\"17\"`" + `
+	Ignored  string
+}
+`
+
+const testRoundTrip = `package gentest
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/LyrinoxTechnologies/ridged-proto/rdgproto"
+)
+
+func TestGeneratedRoundTrip(t *testing.T) {
+	original := &Record{
+		Name:     "device",
+		ID:       1 << 40,
+		Offset:   -12345,
+		Counter:  0xDEADBEEF,
+		Ratio:    3.25,
+		Raw:      []byte{1, 2, 3},
+		Tags:     []string{"a", "bc"},
+		Inner:    Inner{Label: "inner", Score: -7},
+		Children: []Inner{{Label: "x", Score: 1}},
+		Attrs:    map[string]uint32{"b": 2, "a": 1},
+		Parent:   &Inner{Label: "parent"},
+		Hash:     [4]byte{9, 8, 7, 6},
+		Lvl:      -3,
+		Ratio32:  -1.5,
+		Delta:    -42,
+		At:       time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC),
+		Timeout:  -3 * time.Second,
+	}
+
+	data, err := original.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	// Generated code must produce the same bytes as the reflection codec
+	reflected, err := rdgproto.MarshalStruct(original)
+	if err != nil {
+		t.Fatalf("MarshalStruct failed: %v", err)
+	}
+	if !bytes.Equal(data, reflected) {
+		t.Fatalf("Generated encoding differs from struct codec:\n%v\n%v", data, reflected)
+	}
+	// The struct codec decodes it too, nested structs included
+	viaReflection := &Record{}
+	if err := rdgproto.UnmarshalStruct(data, viaReflection); err != nil {
+		t.Fatalf("UnmarshalStruct failed: %v", err)
+	}
+	if !reflect.DeepEqual(viaReflection, original) {
+		t.Errorf("Struct codec round trip mismatch:\ngot  %+v\nwant %+v", viaReflection, original)
+	}
+
+	decoded := &Record{}
+	if err := decoded.Unmarshal(data); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, original) {
+		t.Errorf("Round trip mismatch:\ngot  %+v\nwant %+v", decoded, original)
+	}
+}
+
+func TestGeneratedRegistration(t *testing.T) {
+	if !rdgproto.HasPayloadType(MsgTypeLogin) {
+		t.Fatal("Expected MsgTypeLogin to be registered by generated init")
+	}
+	data, err := rdgproto.Marshal(MsgTypeLogin, &LoginRequest{Username: "u"})
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	_, payload, err := rdgproto.Unmarshal(data)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if login, ok := payload.(*LoginRequest); !ok || login.Username != "u" {
+		t.Errorf("Unexpected payload: %#v", payload)
+	}
+}
+`
+
+func TestGenerateDirectives(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "types.go"), testTypes)
+
+	src, err := Generate(dir, "rdg_gen.go", nil)
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	out := string(src)
+
+	for _, want := range []string{
+		"// Code generated by rdggen. DO NOT EDIT.",
+		"func (l *LoginRequest) Marshal() ([]byte, error) {",
+		"func (p *Record) Unmarshal(data []byte) error {",
+		"rdgproto.RegisterPayloadType(MsgTypeLogin, func() rdgproto.PayloadUnmarshaler { return &LoginRequest{} })",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Generated code missing %q", want)
+		}
+	}
+	if strings.Contains(out, "Ignored") {
+		t.Error("Untagged field in tagged struct should not be encoded")
+	}
+	if strings.Contains(out, "return &Inner{}") {
+		t.Error("rdg:payload types should not be registered")
+	}
+}
+
+func TestGenerateUnsupportedField(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "types.go"), `package gentest
+
+//rdg:payload
+type Bad struct {
+	C chan int
+}
+`)
+	if _, err := Generate(dir, "rdg_gen.go", nil); err == nil {
+		t.Fatal("Expected error for unsupported field type")
+	}
+}
+
+func TestGeneratedCodeCompiles(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds a temporary module")
+	}
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go toolchain not available")
+	}
+	root, err := filepath.Abs("../..")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "go.mod"), "module example.com/gentest\n\ngo 1.25\n\n"+
+		"require github.com/LyrinoxTechnologies/ridged-proto v0.0.0\n\n"+
+		"replace github.com/LyrinoxTechnologies/ridged-proto => "+root+"\n")
+	writeFile(t, filepath.Join(dir, "types.go"), testTypes)
+	writeFile(t, filepath.Join(dir, "types_test.go"), testRoundTrip)
+
+	src, err := Generate(dir, "rdg_gen.go", nil)
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	writeFile(t, filepath.Join(dir, "rdg_gen.go"), string(src))
+
+	cmd := exec.Command(goBin, "test", "./...")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go test on generated code failed: %v\n%s", err, out)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,101 @@
+package rdgproto
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// Append helpers encode the same bytes as the matching Write* functions, but append
+// to a byte slice. Use them to implement PayloadAppender:
+//
+//	func (p *LoginPayload) AppendMarshal(dst []byte) ([]byte, error) {
+//	    dst = rdgproto.AppendString(dst, p.Username)
+//	    dst = rdgproto.AppendString(dst, p.Password)
+//	    return rdgproto.AppendUint32(dst, p.Attempts), nil
+//	}
+//
+//	func (p *LoginPayload) Size() int {
+//	    return rdgproto.SizeString(p.Username) + rdgproto.SizeString(p.Password) +
+//	        rdgproto.SizeVarint(uint64(p.Attempts))
+//	}
+
+// AppendVarint appends an unsigned varint
+func AppendVarint(dst []byte, v uint64) []byte {
+	return binary.AppendUvarint(dst, v)
+}
+
+// AppendString appends a length-prefixed string
+func AppendString(dst []byte, s string) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// AppendBytes appends a length-prefixed byte slice
+func AppendBytes(dst []byte, b []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(b)))
+	return append(dst, b...)
+}
+
+// AppendUint32 appends a varint-encoded uint32
+func AppendUint32(dst []byte, v uint32) []byte {
+	return binary.AppendUvarint(dst, uint64(v))
+}
+
+// AppendUint64 appends a varint-encoded uint64
+func AppendUint64(dst []byte, v uint64) []byte {
+	return binary.AppendUvarint(dst, v)
+}
+
+// AppendUint32Fixed appends a big-endian uint32 (always 4 bytes)
+func AppendUint32Fixed(dst []byte, v uint32) []byte {
+	return binary.BigEndian.AppendUint32(dst, v)
+}
+
+// AppendUint64Fixed appends a big-endian uint64 (always 8 bytes)
+func AppendUint64Fixed(dst []byte, v uint64) []byte {
+	return binary.BigEndian.AppendUint64(dst, v)
+}
+
+// AppendBool appends a boolean as a single byte (0 or 1)
+func AppendBool(dst []byte, v bool) []byte {
+	if v {
+		return append(dst, 1)
+	}
+	return append(dst, 0)
+}
+
+// AppendInt32 appends a zigzag varint-encoded int32
+func AppendInt32(dst []byte, v int32) []byte {
+	return binary.AppendUvarint(dst, zigzag(int64(v)))
+}
+
+// AppendInt64 appends a zigzag varint-encoded int64
+func AppendInt64(dst []byte, v int64) []byte {
+	return binary.AppendUvarint(dst, zigzag(v))
+}
+
+// AppendFloat32 appends an IEEE 754 float32 (always 4 bytes)
+func AppendFloat32(dst []byte, v float32) []byte {
+	return binary.BigEndian.AppendUint32(dst, math.Float32bits(v))
+}
+
+// AppendFloat64 appends an IEEE 754 float64 (always 8 bytes)
+func AppendFloat64(dst []byte, v float64) []byte {
+	return binary.BigEndian.AppendUint64(dst, math.Float64bits(v))
+}
+
+// SizeVarint returns the number of bytes WriteVarint uses for v
+func SizeVarint(v uint64) int {
+	return (bits.Len64(v|1) + 6) / 7
+}
+
+// SizeString returns the number of bytes WriteString uses for s
+func SizeString(s string) int {
+	return SizeVarint(uint64(len(s))) + len(s)
+}
+
+// SizeBytes returns the number of bytes WriteBytes uses for b
+func SizeBytes(b []byte) int {
+	return SizeVarint(uint64(len(b))) + len(b)
+}
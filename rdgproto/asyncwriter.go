@@ -0,0 +1,263 @@
+package rdgproto
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrWriterClosed = errors.New("async writer closed")
+)
+
+// Async writer defaults
+const (
+	DefaultAsyncQueueSize     = 1024
+	DefaultAsyncMaxBatchBytes = 64 * 1024
+)
+
+// AsyncWriteConfig enables an asynchronous writer goroutine per Protocol.
+// Send encodes the frame and queues it; the writer coalesces queued frames into
+// one Write call, trading a little latency for far fewer system calls when many
+// small messages are sent.
+//
+// Write errors are sticky: once a write fails every later Send and Flush returns
+// the error. Use Flush or SendMessageSync when a caller needs to know a message
+// was written.
+type AsyncWriteConfig struct {
+	// QueueSize is the maximum number of frames waiting to be written (default 1024).
+	// Send blocks while the queue is full.
+	QueueSize int
+
+	// MaxBatchBytes flushes a batch once it holds at least this many bytes (default 64KB)
+	MaxBatchBytes int
+
+	// MaxDelay is how long the writer waits for more frames before flushing a batch.
+	// Zero flushes as soon as no more frames are immediately queued.
+	MaxDelay time.Duration
+}
+
+// DefaultAsyncWriteConfig returns the default async writer configuration
+func DefaultAsyncWriteConfig() *AsyncWriteConfig {
+	return &AsyncWriteConfig{
+		QueueSize:     DefaultAsyncQueueSize,
+		MaxBatchBytes: DefaultAsyncMaxBatchBytes,
+	}
+}
+
+// asyncFrame is a queued frame, or a flush request when buf is nil
+type asyncFrame struct {
+	buf  *[]byte
+	done chan error
+}
+
+// asyncWriter owns all writes to a connection when AsyncWriteConfig is set
+type asyncWriter struct {
+	conn     Connection
+	maxBatch int
+	maxDelay time.Duration
+
+	queue     chan asyncFrame
+	closing   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	errMu sync.Mutex
+	err   error
+
+	// Used only by the writer goroutine
+	batch   []byte
+	waiters []chan error
+}
+
+// newAsyncWriter starts the writer goroutine for conn
+func newAsyncWriter(conn Connection, cfg *AsyncWriteConfig) *asyncWriter {
+	w := &asyncWriter{
+		conn:     conn,
+		maxBatch: cfg.MaxBatchBytes,
+		maxDelay: cfg.MaxDelay,
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultAsyncQueueSize
+	}
+	if w.maxBatch <= 0 {
+		w.maxBatch = DefaultAsyncMaxBatchBytes
+	}
+	w.queue = make(chan asyncFrame, queueSize)
+
+	go w.run()
+	return w
+}
+
+// getErr returns the sticky write error
+func (w *asyncWriter) getErr() error {
+	w.errMu.Lock()
+	defer w.errMu.Unlock()
+	return w.err
+}
+
+// setErr records the first write error
+func (w *asyncWriter) setErr(err error) {
+	w.errMu.Lock()
+	defer w.errMu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// enqueue hands a frame buffer to the writer, which returns it to the pool once written.
+// It blocks while the queue is full.
+func (w *asyncWriter) enqueue(buf *[]byte, done chan error) error {
+	if err := w.getErr(); err != nil {
+		if buf != nil {
+			putFrameBuffer(buf)
+		}
+		return err
+	}
+	select {
+	case w.queue <- asyncFrame{buf: buf, done: done}:
+		return nil
+	case <-w.closing:
+		if buf != nil {
+			putFrameBuffer(buf)
+		}
+		return ErrWriterClosed
+	}
+}
+
+// flush waits until every frame queued before the call has been written
+func (w *asyncWriter) flush() error {
+	done := make(chan error, 1)
+	if err := w.enqueue(nil, done); err != nil {
+		return err
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-w.done:
+		// The writer may have answered just before exiting
+		select {
+		case err := <-done:
+			return err
+		default:
+		}
+		if err := w.getErr(); err != nil {
+			return err
+		}
+		return ErrWriterClosed
+	}
+}
+
+// close stops accepting frames. The caller closes the connection to unblock a
+// pending write and then waits on w.done.
+func (w *asyncWriter) close() {
+	w.closeOnce.Do(func() {
+		close(w.closing)
+	})
+}
+
+// run is the writer goroutine
+func (w *asyncWriter) run() {
+	defer close(w.done)
+
+	var timer *time.Timer
+	for {
+		var f asyncFrame
+		select {
+		case f = <-w.queue:
+		case <-w.closing:
+			w.drain()
+			return
+		}
+
+		// Collect more frames until the batch is full, a flush is requested
+		// or the delay expires
+		urgent := w.add(f)
+		if w.maxDelay > 0 && !urgent && len(w.batch) < w.maxBatch {
+			if timer == nil {
+				timer = time.NewTimer(w.maxDelay)
+			} else {
+				timer.Reset(w.maxDelay)
+			}
+		collect:
+			for !urgent && len(w.batch) < w.maxBatch {
+				select {
+				case f = <-w.queue:
+					urgent = w.add(f)
+				case <-timer.C:
+					break collect
+				case <-w.closing:
+					break collect
+				}
+			}
+			timer.Stop()
+		}
+	drain:
+		for !urgent && len(w.batch) < w.maxBatch {
+			select {
+			case f = <-w.queue:
+				urgent = w.add(f)
+			default:
+				break drain
+			}
+		}
+
+		w.write()
+	}
+}
+
+// add appends a frame to the batch and reports whether it requests a flush
+func (w *asyncWriter) add(f asyncFrame) bool {
+	if f.buf != nil {
+		if w.getErr() == nil {
+			w.batch = append(w.batch, *f.buf...)
+		}
+		putFrameBuffer(f.buf)
+	}
+	if f.done != nil {
+		w.waiters = append(w.waiters, f.done)
+		return true
+	}
+	return false
+}
+
+// write flushes the batch with a single Write call and answers flush requests
+func (w *asyncWriter) write() {
+	if len(w.batch) > 0 && w.getErr() == nil {
+		if _, err := w.conn.Write(w.batch); err != nil {
+			w.setErr(err)
+		}
+	}
+
+	// Don't hold on to the memory of an unusually large batch
+	if cap(w.batch) > 4*w.maxBatch {
+		w.batch = nil
+	} else {
+		w.batch = w.batch[:0]
+	}
+
+	err := w.getErr()
+	for _, done := range w.waiters {
+		done <- err
+	}
+	clear(w.waiters)
+	w.waiters = w.waiters[:0]
+}
+
+// drain discards frames still queued after close
+func (w *asyncWriter) drain() {
+	w.setErr(ErrWriterClosed)
+	for {
+		select {
+		case f := <-w.queue:
+			w.add(f)
+		default:
+			w.batch = w.batch[:0]
+			w.write()
+			return
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package rdgproto
+
+import (
+	"encoding/binary"
+)
+
+// Outgoing is one message of a batch sent with SendBatch
+type Outgoing struct {
+	Type byte
+
+	// ID is the message ID. Zero assigns the next ID from the protocol's counter.
+	ID uint32
+
+	Payload interface{}
+}
+
+// SendBatch encodes several messages and writes them with a single Write call, so no
+// message sent by another goroutine can land between them. Every message is an ordinary
+// frame and the receiver reads them one by one with ReceiveMessage as usual.
+//
+// The batch is all or nothing on the sending side: if any message fails to encode,
+// nothing is written. Batched messages are never streamed, whatever their size; each
+// payload must still fit in MaxPayloadSize.
+//
+// Returns the message ID of each message, in order.
+//
+// Example:
+//
+//	ids, err := proto.SendBatch([]rdgproto.Outgoing{
+//		{Type: MsgTypeSnapshotBegin, Payload: &SnapshotBegin{...}},
+//		{Type: MsgTypeEntity, Payload: &Entity{...}},
+//		{Type: MsgTypeSnapshotEnd, Payload: &SnapshotEnd{...}},
+//	})
+func (p *Protocol) SendBatch(msgs []Outgoing) ([]uint32, error) {
+	ids := make([]uint32, len(msgs))
+	if len(msgs) == 0 {
+		return ids, nil
+	}
+
+	bufp := getFrameBuffer()
+	defer putFrameBuffer(bufp)
+
+	frames := *bufp
+	for i, m := range msgs {
+		id := m.ID
+		if id == 0 {
+			id = p.NextMessageID()
+		}
+		ids[i] = id
+
+		start := len(frames)
+		out, err := appendHeaderAndPayload(append(frames, 0, 0, 0, 0), m.Type, id, m.Payload)
+		if err != nil {
+			return nil, err
+		}
+		out, err = appendSignature(out, start+frameLengthSize, p.opts)
+		if err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint32(out[start:], uint32(len(out)-start-frameLengthSize))
+		frames = out
+	}
+	*bufp = frames[:0]
+
+	if err := p.writeFrames(bufp, frames); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
@@ -0,0 +1,514 @@
+package rdgproto
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	ErrCallClosed = errors.New("call closed")
+)
+
+// Operations of call frames, the byte after the extension kind
+const (
+	callOpOpen      byte = 1 // [method]
+	callOpMessage   byte = 2 // [message type][payload]
+	callOpHalfClose byte = 3
+	callOpCredit    byte = 4 // [messages]
+	callOpStatus    byte = 5 // [status], like an error frame
+
+	// callFromCallee marks frames sent by the side that accepted the call, so calls
+	// opened by either side can use the same ID
+	callFromCallee byte = 0x80
+)
+
+const (
+	// callWindow is how many messages each side of a call may send before the other
+	// grants more
+	callWindow = 64
+
+	// maxPeerCalls bounds the calls the peer may have open at once
+	maxPeerCalls = 256
+)
+
+// CallHandler serves a call opened by the peer. It runs in its own goroutine, and
+// the call ends once it returns: with StatusOK for nil, otherwise with the status of
+// the error (see StatusError). Errors that aren't a *StatusError end it with StatusUnknown.
+type CallHandler func(call *Call) error
+
+// Call is one side of a streaming call: both sides send sequences of typed messages,
+// either side can half-close with CloseSend, and the call ends with a status set by
+// the side that accepted it. The call is identified by the message ID of its opening
+// frame, which all its frames carry.
+//
+// Each side may have callWindow messages in flight before the other grants more by
+// receiving them, so a slow receiver holds back its own call only.
+//
+// Recv may be called concurrently with Send and CloseSend, but Send and CloseSend
+// must not be called concurrently with each other.
+type Call struct {
+	p      *Protocol
+	id     uint32
+	method byte
+	callee bool // the peer opened the call
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	credit     int           // messages the peer accepts before granting more
+	credited   chan struct{} // signaled when credit arrives
+	allowance  int           // messages the peer may still send
+	received   int           // messages taken by Recv and not yet credited
+	queue      []callMessage
+	arrived    chan struct{} // signaled when a message or the peer's half-close arrives
+	sendClosed bool
+	peerClosed bool
+	ended      bool
+	err        error // why the call ended, nil for StatusOK
+	done       chan struct{}
+}
+
+// callMessage is a received message waiting for Recv
+type callMessage struct {
+	msg     *Message
+	payload interface{}
+}
+
+// callFrame is the payload of a call frame
+type callFrame struct {
+	op          byte
+	messageType byte        // callOpOpen and callOpMessage
+	payload     interface{} // callOpMessage
+	count       uint32      // callOpCredit
+	status      *StatusError
+}
+
+func (f *callFrame) AppendMarshal(dst []byte) ([]byte, error) {
+	dst = append(dst, extensionCall, f.op)
+	switch f.op &^ callFromCallee {
+	case callOpOpen:
+		dst = append(dst, f.messageType)
+	case callOpMessage:
+		dst = append(dst, f.messageType)
+		return AppendPayload(dst, f.payload)
+	case callOpCredit:
+		dst = AppendUint32(dst, f.count)
+	case callOpStatus:
+		return appendStatus(dst, f.status)
+	}
+	return dst, nil
+}
+
+func newCall(p *Protocol, id uint32, method byte, callee bool) *Call {
+	return &Call{
+		p:         p,
+		id:        id,
+		method:    method,
+		callee:    callee,
+		credit:    callWindow,
+		credited:  make(chan struct{}, 1),
+		allowance: callWindow,
+		arrived:   make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+}
+
+// SetCallHandler sets the handler for calls opened by the peer. Without a handler,
+// calls are ended with StatusUnimplemented.
+func (p *Protocol) SetCallHandler(handler CallHandler) {
+	p.callsMu.Lock()
+	defer p.callsMu.Unlock()
+	p.callHandler = handler
+}
+
+// OpenCall opens a call to the peer's CallHandler. method tells the handler what
+// the call is for, like the message type of a request. Canceling ctx ends the call
+// and tells the peer.
+//
+// Example:
+//
+//	call, err := proto.OpenCall(ctx, MsgTypeWatch)
+//	call.Send(MsgTypeFilter, &Filter{...})
+//	call.CloseSend()
+//	for {
+//	    msg, payload, err := call.Recv()
+//	    if err == io.EOF {
+//	        break // the call ended with StatusOK
+//	    }
+//	    ...
+//	}
+func (p *Protocol) OpenCall(ctx context.Context, method byte) (*Call, error) {
+	if IsReservedType(method) {
+		return nil, ErrInvalidMessage
+	}
+	c := newCall(p, p.NextMessageID(), method, false)
+	c.ctx, c.cancel = context.WithCancel(ctx)
+
+	p.callsMu.Lock()
+	p.calls[c.id] = c
+	p.callsMu.Unlock()
+
+	if err := c.send(&callFrame{op: callOpOpen, messageType: method}); err != nil {
+		c.end(err)
+		return nil, err
+	}
+	// Ends the call when ctx is done; after the call has ended this does nothing
+	context.AfterFunc(c.ctx, func() {
+		c.finish(c.ctx.Err())
+	})
+	return c, nil
+}
+
+// ID returns the call ID, the message ID of the frame that opened it
+func (c *Call) ID() uint32 {
+	return c.id
+}
+
+// Method returns the method the call was opened with
+func (c *Call) Method() byte {
+	return c.method
+}
+
+// Context returns the call's context, which is done once the call has ended.
+// For calls accepted through a Client it carries the Client (see ClientFromContext).
+func (c *Call) Context() context.Context {
+	return c.ctx
+}
+
+// Send sends a message on the call. It waits while the peer's window is used up.
+// After CloseSend, or once the call ended with StatusOK, it returns ErrCallClosed;
+// once the call ended otherwise, it returns the error that ended it.
+func (c *Call) Send(messageType byte, payload interface{}) error {
+	if IsReservedType(messageType) {
+		return ErrInvalidMessage
+	}
+	if err := c.acquire(); err != nil {
+		return err
+	}
+	return c.send(&callFrame{op: callOpMessage, messageType: messageType, payload: payload})
+}
+
+// acquire waits until the peer has credit left and takes one message of it
+func (c *Call) acquire() error {
+	for {
+		c.mu.Lock()
+		switch {
+		case c.ended:
+			err := c.err
+			c.mu.Unlock()
+			if err == nil {
+				err = ErrCallClosed
+			}
+			return err
+		case c.sendClosed:
+			c.mu.Unlock()
+			return ErrCallClosed
+		case c.credit > 0:
+			c.credit--
+			c.mu.Unlock()
+			return nil
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-c.credited:
+		case <-c.done:
+		}
+	}
+}
+
+// CloseSend tells the peer this side sends no more messages. The caller can go on
+// receiving until the call ends.
+func (c *Call) CloseSend() error {
+	c.mu.Lock()
+	if c.ended || c.sendClosed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.sendClosed = true
+	c.mu.Unlock()
+	return c.send(&callFrame{op: callOpHalfClose})
+}
+
+// Recv returns the next message of the call, waiting for it if needed. On the side
+// that opened the call, it returns io.EOF once the call ended with StatusOK and the
+// error ending it otherwise, such as a *StatusError from the peer. On the side that
+// accepted the call, it returns io.EOF once the peer has half-closed. Messages
+// received before the end are returned first.
+func (c *Call) Recv() (*Message, interface{}, error) {
+	for {
+		c.mu.Lock()
+		if len(c.queue) > 0 {
+			item := c.queue[0]
+			c.queue[0] = callMessage{}
+			c.queue = c.queue[1:]
+
+			// Grant credit in batches of half the window
+			var grant int
+			c.received++
+			if !c.ended && c.received >= callWindow/2 {
+				grant = c.received
+				c.received = 0
+				c.allowance += grant
+			}
+			c.mu.Unlock()
+
+			if grant > 0 {
+				// A failed write means the connection is gone, which ends the call
+				_ = c.send(&callFrame{op: callOpCredit, count: uint32(grant)})
+			}
+			return item.msg, item.payload, nil
+		}
+		if c.ended {
+			err := c.err
+			c.mu.Unlock()
+			if err == nil {
+				err = io.EOF
+			}
+			return nil, nil, err
+		}
+		if c.peerClosed && c.callee {
+			c.mu.Unlock()
+			return nil, nil, io.EOF
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-c.arrived:
+		case <-c.done:
+		}
+	}
+}
+
+// Done returns a channel that is closed once the call has ended
+func (c *Call) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the error that ended the call, or nil while it runs and after it
+// ended with StatusOK
+func (c *Call) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// send writes a frame of the call
+func (c *Call) send(f *callFrame) error {
+	if c.callee {
+		f.op |= callFromCallee
+	}
+	return c.p.sendDirect(MessageTypeExtension, c.id, f)
+}
+
+// end ends the call with err, nil for StatusOK, reporting whether it was still running
+func (c *Call) end(err error) bool {
+	c.mu.Lock()
+	if c.ended {
+		c.mu.Unlock()
+		return false
+	}
+	c.ended = true
+	c.err = err
+	close(c.done)
+	c.mu.Unlock()
+
+	c.p.untrackCall(c)
+	c.cancel()
+	return true
+}
+
+// finish ends the call with err and sends the peer its status
+func (c *Call) finish(err error) {
+	if c.end(err) {
+		// A failed write means the connection is gone
+		_ = c.send(&callFrame{op: callOpStatus, status: StatusFromError(err)})
+	}
+}
+
+// fail ends the call from the receive loop, which must not wait for the write
+// telling the peer
+func (c *Call) fail(status *StatusError) {
+	if c.end(status) {
+		go func() {
+			_ = c.send(&callFrame{op: callOpStatus, status: status})
+		}()
+	}
+}
+
+// signal wakes a goroutine waiting on ch
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// untrackCall forgets an ended call
+func (p *Protocol) untrackCall(c *Call) {
+	calls := p.calls
+	if c.callee {
+		calls = p.peerCalls
+	}
+	p.callsMu.Lock()
+	if calls[c.id] == c {
+		delete(calls, c.id)
+	}
+	p.callsMu.Unlock()
+}
+
+// endCalls ends all running calls after the connection failed with err
+func (p *Protocol) endCalls(err error) {
+	p.callsMu.Lock()
+	calls := make([]*Call, 0, len(p.calls)+len(p.peerCalls))
+	for _, c := range p.calls {
+		calls = append(calls, c)
+	}
+	for _, c := range p.peerCalls {
+		calls = append(calls, c)
+	}
+	p.callsMu.Unlock()
+
+	status := &StatusError{Code: StatusUnavailable, Message: err.Error()}
+	for _, c := range calls {
+		c.end(status)
+	}
+}
+
+// receiveCall handles a call frame. Frames of calls that have ended are dropped.
+func (p *Protocol) receiveCall(msg *Message) {
+	d := NewZeroCopyDecoder(msg.Payload[1:])
+	op := d.ReadUint8()
+	fromCallee := op&callFromCallee != 0
+	op &^= callFromCallee
+
+	if op == callOpOpen {
+		method := d.ReadUint8()
+		if d.Err() == nil && !fromCallee {
+			p.acceptCall(msg.ID, method)
+		}
+		msg.Release()
+		return
+	}
+
+	// Frames from the callee belong to calls opened here
+	p.callsMu.Lock()
+	c := p.peerCalls[msg.ID]
+	if fromCallee {
+		c = p.calls[msg.ID]
+	}
+	p.callsMu.Unlock()
+	if c == nil {
+		msg.Release()
+		return
+	}
+
+	switch op {
+	case callOpMessage:
+		c.receiveMessage(msg, d)
+		return
+	case callOpHalfClose:
+		c.mu.Lock()
+		c.peerClosed = true
+		c.mu.Unlock()
+		signal(c.arrived)
+	case callOpCredit:
+		n := d.ReadUint32()
+		if d.Err() == nil {
+			c.mu.Lock()
+			c.credit += int(min(n, callWindow))
+			c.mu.Unlock()
+			signal(c.credited)
+		}
+	case callOpStatus:
+		status, err := readStatus(d, p.opts)
+		switch {
+		case err != nil:
+			c.fail(&StatusError{Code: StatusInternal, Message: "invalid call status: " + err.Error()})
+		case status.Code == StatusOK:
+			c.end(nil)
+		default:
+			c.end(status)
+		}
+	}
+	msg.Release()
+}
+
+// acceptCall starts the handler for a call opened by the peer
+func (p *Protocol) acceptCall(id uint32, method byte) {
+	c := newCall(p, id, method, true)
+	c.ctx, c.cancel = context.WithCancel(p.callContext)
+
+	p.callsMu.Lock()
+	if _, exists := p.peerCalls[id]; exists {
+		p.callsMu.Unlock()
+		return
+	}
+	handler := p.callHandler
+	if len(p.peerCalls) >= maxPeerCalls {
+		p.callsMu.Unlock()
+		c.fail(&StatusError{Code: StatusResourceExhausted, Message: "too many calls"})
+		return
+	}
+	p.peerCalls[id] = c
+	p.callsMu.Unlock()
+
+	go func() {
+		if handler == nil {
+			c.finish(&StatusError{Code: StatusUnimplemented, Message: "no call handler"})
+			return
+		}
+		c.finish(handler(c))
+	}()
+}
+
+// receiveMessage queues a message of the call for Recv
+func (c *Call) receiveMessage(msg *Message, d *Decoder) {
+	messageType := d.ReadUint8()
+	payload := d.ReadRaw(d.Remaining())
+	if d.Err() != nil || IsReservedType(messageType) {
+		msg.Release()
+		c.fail(&StatusError{Code: StatusInternal, Message: "invalid call message"})
+		return
+	}
+	decoded, err := decodePayload(messageType, payload, c.p.opts)
+	if err != nil {
+		msg.Release()
+		c.fail(&StatusError{Code: StatusInternal, Message: err.Error()})
+		return
+	}
+
+	c.mu.Lock()
+	var violation string
+	switch {
+	case c.ended:
+		c.mu.Unlock()
+		msg.Release()
+		return
+	case c.peerClosed:
+		violation = "message after half-close"
+	case c.allowance <= 0:
+		violation = "call flow control window exceeded"
+	}
+	if violation != "" {
+		c.mu.Unlock()
+		msg.Release()
+		c.fail(&StatusError{Code: StatusInternal, Message: violation})
+		return
+	}
+	c.allowance--
+	c.queue = append(c.queue, callMessage{
+		msg: &Message{
+			Type:      messageType,
+			ID:        msg.ID,
+			Payload:   payload,
+			Signature: msg.Signature,
+			pooled:    msg.pooled,
+		},
+		payload: decoded,
+	})
+	c.mu.Unlock()
+	signal(c.arrived)
+}
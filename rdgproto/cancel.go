@@ -0,0 +1,234 @@
+package rdgproto
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrStreamCanceled  = errors.New("stream canceled")
+	ErrStreamNotActive = errors.New("stream not active")
+)
+
+// maxPendingRejects bounds the cancel frames rejecting failed streams that are
+// waiting to be written
+const maxPendingRejects = 16
+
+// StreamCancelReason says why a stream was canceled or rejected
+type StreamCancelReason uint32
+
+const (
+	CancelUnspecified  StreamCancelReason = iota
+	CancelAborted                         // the sender gave up, e.g. its context is done
+	CancelRejected                        // the receiver doesn't accept the stream
+	CancelTooLarge                        // the stream exceeds a size limit
+	CancelUnauthorized                    // the stream's message type is not accepted
+	CancelLimit                           // the receiver has too many streams or bytes buffered
+	CancelInvalid                         // the stream contradicts its header
+
+	// CancelApplication is the first reason free for applications to define
+	CancelApplication StreamCancelReason = 1000
+)
+
+var cancelReasonNames = map[StreamCancelReason]string{
+	CancelUnspecified:  "unspecified",
+	CancelAborted:      "aborted",
+	CancelRejected:     "rejected",
+	CancelTooLarge:     "too large",
+	CancelUnauthorized: "unauthorized",
+	CancelLimit:        "limit exceeded",
+	CancelInvalid:      "invalid",
+}
+
+func (r StreamCancelReason) String() string {
+	if name, ok := cancelReasonNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("reason %d", uint32(r))
+}
+
+// CancelError reports a canceled stream. Remote is set when the peer canceled it:
+// the sender of an incoming stream, or the receiver rejecting an outgoing one.
+// It matches ErrStreamCanceled with errors.Is.
+type CancelError struct {
+	Reason StreamCancelReason
+	Remote bool
+}
+
+func (e *CancelError) Error() string {
+	if e.Remote {
+		return "stream canceled by peer: " + e.Reason.String()
+	}
+	return "stream canceled: " + e.Reason.String()
+}
+
+func (e *CancelError) Is(target error) bool {
+	return target == ErrStreamCanceled
+}
+
+// streamCanceler lets an outgoing stream be canceled while it is being sent.
+// The sending goroutine checks it before each chunk, so a cancel frame of its
+// own is always written after the stream's last frame.
+type streamCanceler struct {
+	mu     sync.Mutex
+	err    *CancelError
+	notify bool          // the peer must be told
+	done   chan struct{} // closed once canceled
+}
+
+// cancel marks the stream canceled; only the first call has an effect
+func (c *streamCanceler) cancel(err *CancelError, notify bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err, c.notify = err, notify
+		close(c.done)
+	}
+}
+
+// canceled returns the cancel error, or nil while the stream may continue
+func (c *streamCanceler) canceled() *CancelError {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// trackSending registers an outgoing stream so it can be canceled
+func (p *Protocol) trackSending(msgID uint32) *streamCanceler {
+	c := &streamCanceler{done: make(chan struct{})}
+	p.sendingMu.Lock()
+	p.sending[msgID] = c
+	p.sendingMu.Unlock()
+	return c
+}
+
+// untrackSending removes an outgoing stream registered by trackSending
+func (p *Protocol) untrackSending(msgID uint32, c *streamCanceler) {
+	p.sendingMu.Lock()
+	if p.sending[msgID] == c {
+		delete(p.sending, msgID)
+	}
+	p.sendingMu.Unlock()
+}
+
+// stopSending ends a canceled outgoing stream, telling the peer unless the peer
+// rejected it, and returns the cancel error
+func (p *Protocol) stopSending(msgID uint32, c *streamCanceler) error {
+	cerr := c.canceled()
+	c.mu.Lock()
+	notify := c.notify
+	c.notify = false
+	c.mu.Unlock()
+	if notify {
+		if err := p.sendDirect(MessageTypeStreamCancel, msgID, &StreamCancel{Reason: cerr.Reason}); err != nil {
+			return err
+		}
+	}
+	return cerr
+}
+
+// abortSending cancels an outgoing stream whose sender gave up, telling the peer so it
+// frees the stream at once, and returns err
+func (p *Protocol) abortSending(msgID uint32, c *streamCanceler, err error) error {
+	c.cancel(&CancelError{Reason: CancelAborted}, true)
+	if cerr := p.stopSending(msgID, c); !errors.Is(cerr, ErrStreamCanceled) {
+		return cerr
+	}
+	return err
+}
+
+// CancelStream cancels a stream this side is sending. The call sending it stops
+// before its next chunk, tells the receiver, which discards the stream at once,
+// and returns a *CancelError. Returns ErrStreamNotActive if no such stream is
+// being sent.
+func (p *Protocol) CancelStream(msgID uint32, reason StreamCancelReason) error {
+	p.sendingMu.Lock()
+	c, ok := p.sending[msgID]
+	p.sendingMu.Unlock()
+	if !ok {
+		return ErrStreamNotActive
+	}
+	c.cancel(&CancelError{Reason: reason}, true)
+	return nil
+}
+
+// RejectStream discards a stream being received and tells the sender to stop
+// sending it. It can be called from a StreamHandler or OnReceiveProgress.
+// Returns ErrStreamNotActive if no such stream is being received.
+func (p *Protocol) RejectStream(msgID uint32, reason StreamCancelReason) error {
+	p.streamMu.Lock()
+	assembler, ok := p.activeStreams[msgID]
+	if ok {
+		p.cancelStream(msgID, assembler, &CancelError{Reason: reason})
+	}
+	p.streamMu.Unlock()
+	if !ok {
+		return ErrStreamNotActive
+	}
+	return p.sendDirect(MessageTypeStreamCancel, msgID, &StreamCancel{Reason: reason, Reject: true})
+}
+
+// cancelStream discards an incoming stream, failing its reader with cerr.
+// The caller holds streamMu.
+func (p *Protocol) cancelStream(msgID uint32, assembler *streamAssembler, cerr *CancelError) *StreamError {
+	err := &StreamError{ID: msgID, Err: cerr}
+	if assembler.reader != nil {
+		assembler.reader.finish(err)
+	}
+	p.discardStream(msgID, assembler)
+	return err
+}
+
+// receiveCancel handles a cancel frame. A stream canceled by its sender is discarded
+// and reported as a *StreamError; a rejected outgoing stream stops sending.
+func (p *Protocol) receiveCancel(msgID uint32, cancel *StreamCancel) error {
+	cerr := &CancelError{Reason: cancel.Reason, Remote: true}
+	if cancel.Reject {
+		p.sendingMu.Lock()
+		c, ok := p.sending[msgID]
+		p.sendingMu.Unlock()
+		if ok {
+			c.cancel(cerr, false)
+		}
+		return nil
+	}
+
+	p.streamMu.Lock()
+	defer p.streamMu.Unlock()
+	assembler, ok := p.activeStreams[msgID]
+	if !ok {
+		return nil
+	}
+	return p.cancelStream(msgID, assembler, cerr)
+}
+
+// rejectFailed tells the sender of a stream discarded with err to stop sending it.
+// The cancel frame is written from its own goroutine, so the receive loop never
+// waits for a peer that isn't reading. This is best effort: rejects beyond
+// maxPendingRejects are dropped, and the sender then keeps sending the stream to
+// the end, its chunks dropped here as chunks of an unknown stream.
+func (p *Protocol) rejectFailed(err error) {
+	var streamErr *StreamError
+	if !errors.As(err, &streamErr) {
+		return
+	}
+	if p.pendingRejects.Add(1) > maxPendingRejects {
+		p.pendingRejects.Add(-1)
+		return
+	}
+
+	reason := CancelRejected
+	switch {
+	case errors.Is(err, ErrPayloadTooLarge):
+		reason = CancelTooLarge
+	case errors.Is(err, ErrStreamLimit):
+		reason = CancelLimit
+	case errors.Is(err, ErrStreamMismatch):
+		reason = CancelInvalid
+	}
+	go func() {
+		defer p.pendingRejects.Add(-1)
+		_ = p.sendDirect(MessageTypeStreamCancel, streamErr.ID, &StreamCancel{Reason: reason, Reject: true})
+	}()
+}
@@ -0,0 +1,550 @@
+package rdgproto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrChannelExists  = errors.New("channel already open")
+	ErrChannelNotOpen = errors.New("channel not open")
+	ErrChannelClosed  = errors.New("channel closed")
+	ErrChannelWindow  = errors.New("channel flow control window exceeded")
+)
+
+// Kinds of MessageTypeExtension frames
+const (
+	extensionChannelData   byte = 1 // [channel][message type][payload], ID is the message's
+	extensionChannelCredit byte = 2 // [channel][bytes]
+	extensionCall          byte = 3 // [operation]..., ID is the call's (see Call)
+	extensionError         byte = 4 // [status], ID is the failed message's (see Protocol.SendError)
+	extensionChannelClose  byte = 5 // [channel][reply], see Channel.Close
+)
+
+const (
+	// maxPendingCredits bounds the channels the peer may grant credit to before they are opened here
+	maxPendingCredits = 64
+
+	// maxChannelWindow keeps credit grants within their 32-bit encoding
+	maxChannelWindow = 1 << 30
+)
+
+// ChannelHandler handles the messages of a logical channel, one at a time and in
+// the order they were sent. With MessageOptions.PooledBuffers, the handler owns msg
+// and should call msg.Release once done with it.
+type ChannelHandler func(msg *Message, payload interface{})
+
+// ChannelError reports a message on a logical channel that was dropped on arrival.
+// The connection and the channel remain usable.
+type ChannelError struct {
+	Channel uint32
+	ID      uint32
+	Err     error
+}
+
+func (e *ChannelError) Error() string {
+	return fmt.Sprintf("channel %d: message %d: %v", e.Channel, e.ID, e.Err)
+}
+
+func (e *ChannelError) Unwrap() error {
+	return e.Err
+}
+
+// Channel is a numbered logical channel multiplexed over a Protocol's connection,
+// with its own message order, handler and credit-based flow control.
+//
+// Each side of a channel grants the other a receive window (MessageOptions.ChannelWindow)
+// and returns credit as its handler works through the messages. A sender waits once the
+// window is used up, so a slow handler holds back its own channel only: the receive loop
+// never waits for a channel's handler, and other channels and direct messages go on.
+type Channel struct {
+	p       *Protocol
+	id      uint32
+	handler ChannelHandler
+	window  int64
+
+	mu     sync.Mutex
+	credit int64         // bytes the peer accepts before granting more
+	wake   chan struct{} // signaled when credit arrives
+	done   chan struct{} // closed once the channel is closed on either side
+	closed bool
+
+	// frameMu keeps credit grants ahead of the close frame, so the peer never
+	// takes a grant for the closed channel as one for a later channel with its id
+	frameMu sync.Mutex
+
+	// Receiving side
+	allowance int64 // bytes the peer may still send
+	consumed  int64 // bytes handled and not yet returned to the peer
+	queue     []channelMessage
+	running   bool
+}
+
+// channelMessage is a received message waiting for the channel's handler.
+// A nil msg only returns credit.
+type channelMessage struct {
+	msg     *Message
+	payload interface{}
+	cost    int64
+}
+
+// channelFrame is the payload of a channel data frame
+type channelFrame struct {
+	channel     uint32
+	messageType byte
+	payload     interface{}
+}
+
+func (f *channelFrame) AppendMarshal(dst []byte) ([]byte, error) {
+	dst = append(dst, extensionChannelData)
+	dst = AppendUint32(dst, f.channel)
+	dst = append(dst, f.messageType)
+	return AppendPayload(dst, f.payload)
+}
+
+// channelCredit is the payload of a channel credit frame
+type channelCredit struct {
+	channel uint32
+	credit  uint32
+}
+
+func (f *channelCredit) AppendMarshal(dst []byte) ([]byte, error) {
+	dst = append(dst, extensionChannelCredit)
+	dst = AppendUint32(dst, f.channel)
+	return AppendUint32(dst, f.credit), nil
+}
+
+// channelClose is the payload of a channel close frame. reply is set when the frame
+// answers the peer's close, and such frames are never answered themselves.
+type channelClose struct {
+	channel uint32
+	reply   bool
+}
+
+func (f *channelClose) AppendMarshal(dst []byte) ([]byte, error) {
+	dst = append(dst, extensionChannelClose)
+	dst = AppendUint32(dst, f.channel)
+	return AppendBool(dst, f.reply), nil
+}
+
+// OpenChannel opens logical channel id, delivering its incoming messages to handler.
+// Both sides open a channel under the same id. The peer can't send on the channel
+// until it has been opened here, so opening order doesn't matter.
+//
+// A channel with a nil handler only sends. Returns ErrChannelExists if the channel
+// is already open, and ErrChannelClosed if it was closed here and the peer hasn't
+// closed its side yet (see Channel.Close). A peer holding credit for maxPendingCredits
+// channels not opened on its side closes any further ones it is granted credit for.
+func (p *Protocol) OpenChannel(id uint32, handler ChannelHandler) (*Channel, error) {
+	window := int64(DefaultChannelWindow)
+	if p.opts != nil && p.opts.ChannelWindow > 0 {
+		window = int64(min(p.opts.ChannelWindow, maxChannelWindow))
+	}
+	c := &Channel{
+		p:       p,
+		id:      id,
+		handler: handler,
+		window:  window,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	p.channelsMu.Lock()
+	if _, exists := p.channels[id]; exists {
+		p.channelsMu.Unlock()
+		return nil, ErrChannelExists
+	}
+	if _, closing := p.closingIDs[id]; closing {
+		p.channelsMu.Unlock()
+		return nil, ErrChannelClosed
+	}
+	c.credit = p.pendingCredit[id]
+	delete(p.pendingCredit, id)
+	if handler != nil {
+		c.allowance = window
+	}
+	p.channels[id] = c
+	p.channelsMu.Unlock()
+
+	if handler != nil {
+		// Grant the peer its initial window
+		if err := p.grantCredit(id, window); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// ID returns the channel number
+func (c *Channel) ID() uint32 {
+	return c.id
+}
+
+// Send sends a message on the channel and returns its message ID. It waits while
+// the peer's window is used up; ctx bounds the wait. Each message counts its payload
+// plus the frame header against the window.
+func (c *Channel) Send(ctx context.Context, messageType byte, payload interface{}) (uint32, error) {
+	if IsReservedType(messageType) {
+		return 0, ErrInvalidMessage
+	}
+	p := c.p
+	id := p.NextMessageID()
+
+	bufp := getFrameBuffer()
+	defer putFrameBuffer(bufp)
+	frame, err := appendHeaderAndPayload(append(*bufp, 0, 0, 0, 0), MessageTypeExtension, id, &channelFrame{
+		channel:     c.id,
+		messageType: messageType,
+		payload:     payload,
+	})
+	if err != nil {
+		return id, err
+	}
+	*bufp = frame[:0]
+
+	if err := c.acquire(ctx, int64(len(frame)-frameLengthSize)); err != nil {
+		return id, err
+	}
+	return id, p.finishFrame(bufp, frame)
+}
+
+// acquire waits until the peer has credit left and charges cost against it.
+// The last message may overdraw the credit, so any message fits the window.
+func (c *Channel) acquire(ctx context.Context, cost int64) error {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return ErrChannelClosed
+		}
+		if c.credit > 0 {
+			c.credit -= cost
+			more := c.credit > 0
+			c.mu.Unlock()
+			if more {
+				// Let the next waiting sender go as well
+				c.signal()
+			}
+			return nil
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-c.wake:
+		case <-c.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// signal wakes one sender waiting for credit
+func (c *Channel) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close closes the channel. Waiting senders return ErrChannelClosed and queued
+// messages are dropped. The peer is told with a close frame: its channel closes too,
+// so its senders return ErrChannelClosed, while messages it has already received are
+// still handled. The id can be opened again once the peer has answered the close.
+//
+// A channel closed by the peer behaves the same way, and Close only drops the
+// messages still queued.
+func (c *Channel) Close() error {
+	p := c.p
+	p.channelsMu.Lock()
+	open := p.channels[c.id] == c
+	if open {
+		delete(p.channels, c.id)
+		p.closingIDs[c.id] = struct{}{}
+	}
+	p.channelsMu.Unlock()
+
+	c.shutdown(true)
+	if open {
+		c.sendClose(false)
+	}
+	return nil
+}
+
+// shutdown stops the channel's senders, and with drop the queued messages too
+func (c *Channel) shutdown(drop bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+	if !drop {
+		return
+	}
+	for _, item := range c.queue {
+		if item.msg != nil {
+			item.msg.Release()
+		}
+	}
+	c.queue = nil
+}
+
+// sendClose tells the peer that the channel is closed, after any credit grant
+// already under way
+func (c *Channel) sendClose(reply bool) {
+	c.frameMu.Lock()
+	defer c.frameMu.Unlock()
+	// A failed write means the connection is gone
+	_ = c.p.sendDirect(MessageTypeExtension, 0, &channelClose{channel: c.id, reply: reply})
+}
+
+// closeChannels closes all open channels along with the connection, without
+// telling the peer
+func (p *Protocol) closeChannels() {
+	p.channelsMu.Lock()
+	channels := make([]*Channel, 0, len(p.channels))
+	for _, c := range p.channels {
+		channels = append(channels, c)
+	}
+	p.channels = make(map[uint32]*Channel)
+	p.channelsMu.Unlock()
+
+	for _, c := range channels {
+		c.shutdown(true)
+	}
+}
+
+// grantCredit lets the peer send n more bytes on a channel
+func (p *Protocol) grantCredit(channel uint32, n int64) error {
+	return p.sendDirect(MessageTypeExtension, 0, &channelCredit{channel: channel, credit: uint32(n)})
+}
+
+// receiveExtension handles a MessageTypeExtension frame. Frames of unknown kinds
+// are dropped, so newer peers can add kinds.
+func (p *Protocol) receiveExtension(msg *Message) error {
+	if len(msg.Payload) > 0 {
+		switch msg.Payload[0] {
+		case extensionChannelData:
+			return p.receiveChannelData(msg)
+		case extensionChannelCredit:
+			err := p.receiveChannelCredit(msg.ID, msg.Payload[1:])
+			msg.Release()
+			return err
+		case extensionChannelClose:
+			err := p.receiveChannelClose(msg.ID, msg.Payload[1:])
+			msg.Release()
+			return err
+		case extensionCall:
+			p.receiveCall(msg)
+			return nil
+		}
+	}
+	msg.Release()
+	return nil
+}
+
+// receiveChannelData queues a channel message for the channel's handler. Messages
+// that can't be delivered are dropped and reported as a *ChannelError.
+func (p *Protocol) receiveChannelData(msg *Message) error {
+	d := NewZeroCopyDecoder(msg.Payload[1:])
+	channel := d.ReadUint32()
+	messageType := d.ReadUint8()
+	payload := d.ReadRaw(d.Remaining())
+	if err := d.Err(); err != nil || IsReservedType(messageType) {
+		msg.Release()
+		return &ChannelError{Channel: channel, ID: msg.ID, Err: ErrInvalidMessage}
+	}
+
+	p.channelsMu.Lock()
+	c := p.channels[channel]
+	_, closing := p.closingIDs[channel]
+	p.channelsMu.Unlock()
+	if closing {
+		// The peer sent it before learning of the Close
+		msg.Release()
+		return nil
+	}
+	if c == nil || c.handler == nil {
+		msg.Release()
+		return &ChannelError{Channel: channel, ID: msg.ID, Err: ErrChannelNotOpen}
+	}
+	cost := int64(HeaderSize + len(msg.Payload))
+	if !c.charge(cost) {
+		msg.Release()
+		return &ChannelError{Channel: channel, ID: msg.ID, Err: ErrChannelWindow}
+	}
+
+	decoded, err := decodePayload(messageType, payload, p.opts)
+	if err != nil {
+		msg.Release()
+		c.enqueue(channelMessage{cost: cost})
+		return &ChannelError{Channel: channel, ID: msg.ID, Err: err}
+	}
+	c.enqueue(channelMessage{
+		msg: &Message{
+			Type:      messageType,
+			ID:        msg.ID,
+			Payload:   payload,
+			Signature: msg.Signature,
+			pooled:    msg.pooled,
+		},
+		payload: decoded,
+		cost:    cost,
+	})
+	return nil
+}
+
+// receiveChannelCredit adds credit granted by the peer
+func (p *Protocol) receiveChannelCredit(msgID uint32, data []byte) error {
+	d := NewZeroCopyDecoder(data)
+	channel := d.ReadUint32()
+	credit := int64(d.ReadUint32())
+	if err := d.Err(); err != nil {
+		return &ChannelError{Channel: channel, ID: msgID, Err: ErrInvalidMessage}
+	}
+
+	p.channelsMu.Lock()
+	c := p.channels[channel]
+	if _, closing := p.closingIDs[channel]; closing {
+		// Credit for a closed channel is never used
+		p.channelsMu.Unlock()
+		return nil
+	}
+	if c == nil {
+		// Remember credit for a channel opened here later
+		if _, ok := p.pendingCredit[channel]; ok || len(p.pendingCredit) < maxPendingCredits {
+			p.pendingCredit[channel] += credit
+			p.channelsMu.Unlock()
+			return nil
+		}
+		p.channelsMu.Unlock()
+
+		// Refuse the channel rather than lose its initial grant, which would leave
+		// it without credit once opened here
+		// A failed write means the connection is gone
+		_ = p.sendDirect(MessageTypeExtension, 0, &channelClose{channel: channel})
+		return nil
+	}
+	p.channelsMu.Unlock()
+
+	c.mu.Lock()
+	c.credit += credit
+	c.mu.Unlock()
+	c.signal()
+	return nil
+}
+
+// receiveChannelClose handles the peer closing a channel. A channel still open here
+// is closed and the close answered, after which the id is free on both sides.
+func (p *Protocol) receiveChannelClose(msgID uint32, data []byte) error {
+	d := NewZeroCopyDecoder(data)
+	channel := d.ReadUint32()
+	reply := d.ReadBool()
+	if err := d.Err(); err != nil {
+		return &ChannelError{Channel: channel, ID: msgID, Err: ErrInvalidMessage}
+	}
+
+	p.channelsMu.Lock()
+	if _, closing := p.closingIDs[channel]; closing {
+		// Closed on both sides now
+		delete(p.closingIDs, channel)
+		p.channelsMu.Unlock()
+		return nil
+	}
+	if reply {
+		p.channelsMu.Unlock()
+		return nil
+	}
+	c := p.channels[channel]
+	delete(p.channels, channel)
+	delete(p.pendingCredit, channel)
+	p.channelsMu.Unlock()
+
+	if c == nil {
+		// A channel never opened here is closed already
+		_ = p.sendDirect(MessageTypeExtension, 0, &channelClose{channel: channel, reply: true})
+		return nil
+	}
+	// Messages already received are still handled
+	c.shutdown(false)
+	c.sendClose(true)
+	return nil
+}
+
+// charge counts an arriving message against the window granted to the peer.
+// A peer that respects flow control only sends while some window is left.
+func (c *Channel) charge(cost int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.allowance <= 0 {
+		return false
+	}
+	c.allowance -= cost
+	return true
+}
+
+// enqueue queues a message for the handler, starting the handler goroutine if needed
+func (c *Channel) enqueue(item channelMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		if item.msg != nil {
+			item.msg.Release()
+		}
+		return
+	}
+	c.queue = append(c.queue, item)
+	if !c.running {
+		c.running = true
+		go c.run()
+	}
+}
+
+// run hands queued messages to the handler until the queue is empty
+func (c *Channel) run() {
+	for {
+		c.mu.Lock()
+		if len(c.queue) == 0 {
+			c.running = false
+			c.mu.Unlock()
+			return
+		}
+		item := c.queue[0]
+		c.queue[0] = channelMessage{}
+		c.queue = c.queue[1:]
+		c.mu.Unlock()
+
+		if item.msg != nil {
+			c.handler(item.msg, item.payload)
+		}
+		c.consume(item.cost)
+	}
+}
+
+// consume returns the credit of a handled message to the peer, in batches of
+// at least half the window
+func (c *Channel) consume(cost int64) {
+	c.mu.Lock()
+	c.consumed += cost
+	if c.closed || c.consumed < c.window/2 {
+		c.mu.Unlock()
+		return
+	}
+	n := c.consumed
+	c.consumed = 0
+	c.allowance += n
+	c.mu.Unlock()
+
+	c.frameMu.Lock()
+	defer c.frameMu.Unlock()
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if !closed {
+		// A failed write means the connection is gone
+		_ = c.p.grantCredit(c.id, n)
+	}
+}
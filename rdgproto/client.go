@@ -1,7 +1,9 @@
 package rdgproto
 
 import (
+"context"
 "errors"
+"io"
 "sync"
 )
 
@@ -10,7 +12,21 @@ ErrNotConnected = errors.New("not connected")
 ErrClosed       = errors.New("connection closed")
 )
 
-// MessageHandler is called when a message is received
+// replyFlag is set in the message ID of replies sent with Reply. The peer numbers its
+// own messages independently, so the ID alone doesn't tell a reply from a message
+// that happens to share the ID of a pending Call.
+const replyFlag uint32 = 1 << 31
+
+// callResult carries a correlated reply back to a waiting Call
+type callResult struct {
+msg     *Message
+payload interface{}
+err     error
+}
+
+// MessageHandler is called when a message is received. An error it returns is sent
+// to the peer in an error frame correlated to the message (see Protocol.SendError),
+// with the status of the error (see StatusFromError), and reported on Errors.
 type MessageHandler func(msg *Message, payload interface{}) error
 
 // Client provides a high-level API for sending and receiving messages
@@ -23,16 +39,26 @@ mu       sync.RWMutex
 running  bool
 done     chan struct{}
 errChan  chan error
+err      error // why listen stopped, set before done is closed
+
+// Pending request/response calls keyed by message ID
+pendingMu sync.Mutex
+pending   map[uint32]chan callResult
+closeErr  error
 }
 
 // NewClient creates a new client with the given connection
 func NewClient(conn Connection, opts *MessageOptions) *Client {
-return &Client{
+c := &Client{
 proto:   NewProtocol(conn, opts),
 opts:    opts,
 done:    make(chan struct{}),
 errChan: make(chan error, 1),
+pending: make(map[uint32]chan callResult),
 }
+// Call handlers find the client through the call's context
+c.proto.callContext = context.WithValue(context.Background(), clientContextKey{}, c)
+return c
 }
 
 // SetHandler sets the message handler for incoming messages
@@ -68,7 +94,43 @@ close(c.done)
 
 for {
 msg, payload, err := c.proto.ReceiveMessage()
+var streamErr *StreamError
+if errors.As(err, &streamErr) {
+// Only the stream was lost: fail a call waiting for it and keep listening
+if streamErr.ID&replyFlag == 0 || !c.failCall(streamErr.ID&^replyFlag, err) {
+select {
+case c.errChan <- err:
+default:
+}
+}
+continue
+}
+var remoteErr *RemoteError
+if errors.As(err, &remoteErr) {
+// The peer failed to handle a message: fail the call waiting for it
+if !c.failCall(remoteErr.ID, remoteErr.Err) {
+select {
+case c.errChan <- err:
+default:
+}
+}
+continue
+}
+var channelErr *ChannelError
+if errors.As(err, &channelErr) {
+// Only a channel message was lost
+select {
+case c.errChan <- err:
+default:
+}
+continue
+}
 if err != nil {
+c.failPending(err)
+c.proto.endCalls(err)
+c.mu.Lock()
+c.err = err
+c.mu.Unlock()
 select {
 case c.errChan <- err:
 default:
@@ -76,12 +138,19 @@ default:
 return
 }
 
+// Replies to outstanding calls go to the caller, not the handler
+if c.deliverReply(msg, payload) {
+continue
+}
+
 c.mu.RLock()
 handler := c.handler
 c.mu.RUnlock()
 
 if handler != nil {
 if err := handler(msg, payload); err != nil {
+// Tell the peer the message failed; a write error ends the loop on the next read
+_ = c.proto.SendError(msg.ID, err)
 select {
 case c.errChan <- err:
 default:
@@ -97,6 +166,143 @@ func (c *Client) Send(messageType byte, payload interface{}) (uint32, error) {
 return c.proto.Send(messageType, payload)
 }
 
+// Call sends a request and blocks until the peer replies with the same message ID.
+// The peer must answer using Reply, which marks the message as a reply. If the
+// peer's handler fails instead, Call returns the status it sent as a *StatusError.
+// Messages that do not match a pending call are delivered to the regular handler.
+// The client must be started before calling Call.
+//
+// Example:
+//
+//ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+//defer cancel()
+//msg, payload, err := client.Call(ctx, MsgTypeLogin, &LoginPayload{...})
+func (c *Client) Call(ctx context.Context, messageType byte, payload interface{}) (*Message, interface{}, error) {
+c.mu.RLock()
+running := c.running
+c.mu.RUnlock()
+if !running {
+return nil, nil, ErrNotConnected
+}
+
+id := c.proto.NextMessageID()
+ch := make(chan callResult, 1)
+
+c.pendingMu.Lock()
+if c.closeErr != nil {
+err := c.closeErr
+c.pendingMu.Unlock()
+return nil, nil, err
+}
+c.pending[id] = ch
+c.pendingMu.Unlock()
+
+if err := c.proto.SendMessage(messageType, id, payload); err != nil {
+c.removePending(id)
+return nil, nil, err
+}
+
+select {
+case res := <-ch:
+return res.msg, res.payload, res.err
+case <-ctx.Done():
+c.removePending(id)
+return nil, nil, ctx.Err()
+}
+}
+
+// OpenCall opens a streaming call to the peer's call handler (see Protocol.OpenCall).
+// The client must be started before opening calls.
+func (c *Client) OpenCall(ctx context.Context, method byte) (*Call, error) {
+c.mu.RLock()
+running := c.running
+c.mu.RUnlock()
+if !running {
+return nil, ErrNotConnected
+}
+return c.proto.OpenCall(ctx, method)
+}
+
+// SetCallHandler sets the handler for streaming calls opened by the peer
+// (see Protocol.SetCallHandler). ClientFromContext(call.Context()) returns this client.
+func (c *Client) SetCallHandler(handler CallHandler) {
+c.proto.SetCallHandler(handler)
+}
+
+// Reply sends a response correlated to the given request message. The peer's Call
+// receives it with the request's ID; without a Call waiting, it reaches the peer's
+// handler with the top bit of the ID set.
+func (c *Client) Reply(request *Message, messageType byte, payload interface{}) error {
+return c.proto.SendMessage(messageType, request.ID|replyFlag, payload)
+}
+
+// ReplyError tells the peer that handling request failed with err. A Call waiting
+// for the reply returns the status as a *StatusError.
+func (c *Client) ReplyError(request *Message, err error) error {
+return c.proto.SendError(request.ID, err)
+}
+
+// PendingCalls returns the number of calls waiting for a reply
+func (c *Client) PendingCalls() int {
+c.pendingMu.Lock()
+defer c.pendingMu.Unlock()
+return len(c.pending)
+}
+
+// deliverReply routes a reply to a pending call, returning false if none is waiting
+func (c *Client) deliverReply(msg *Message, payload interface{}) bool {
+if msg.ID&replyFlag == 0 {
+return false
+}
+id := msg.ID &^ replyFlag
+c.pendingMu.Lock()
+ch, ok := c.pending[id]
+if ok {
+delete(c.pending, id)
+}
+c.pendingMu.Unlock()
+
+if !ok {
+return false
+}
+msg.ID = id
+ch <- callResult{msg: msg, payload: payload}
+return true
+}
+
+// failCall completes a pending call with err, returning false if none is waiting
+func (c *Client) failCall(id uint32, err error) bool {
+c.pendingMu.Lock()
+ch, ok := c.pending[id]
+if ok {
+delete(c.pending, id)
+}
+c.pendingMu.Unlock()
+
+if ok {
+ch <- callResult{err: err}
+}
+return ok
+}
+
+// removePending drops a pending call without delivering a result
+func (c *Client) removePending(id uint32) {
+c.pendingMu.Lock()
+defer c.pendingMu.Unlock()
+delete(c.pending, id)
+}
+
+// failPending completes all pending calls with err and rejects new ones
+func (c *Client) failPending(err error) {
+c.pendingMu.Lock()
+defer c.pendingMu.Unlock()
+c.closeErr = err
+for id, ch := range c.pending {
+ch <- callResult{err: err}
+delete(c.pending, id)
+}
+}
+
 // SendWithID sends a message with a specific message ID
 func (c *Client) SendWithID(messageType byte, messageID uint32, payload interface{}) error {
 return c.proto.SendMessage(messageType, messageID, payload)
@@ -107,15 +313,55 @@ func (c *Client) SendRaw(messageType byte, data []byte) (uint32, error) {
 return c.proto.SendRaw(messageType, data)
 }
 
-// Wait blocks until the client is closed or an error occurs
-// Returns the error that caused the client to stop, or nil if closed cleanly
-func (c *Client) Wait() error {
-select {
-case err := <-c.errChan:
-return err
-case <-c.done:
-return nil
+// SendBatch sends several messages with a single write so they arrive back to back
+// (see Protocol.SendBatch). Returns the message ID of each message.
+func (c *Client) SendBatch(msgs []Outgoing) ([]uint32, error) {
+return c.proto.SendBatch(msgs)
+}
+
+// SendStream sends everything read from r as an open-ended stream (see Protocol.SendStream)
+func (c *Client) SendStream(ctx context.Context, messageType byte, r io.Reader) (uint32, error) {
+return c.proto.SendStream(ctx, messageType, r)
 }
+
+// SendResumable sends size bytes from r as a resumable stream (see Protocol.SendResumable)
+func (c *Client) SendResumable(ctx context.Context, messageType byte, token string, r io.ReaderAt, size int64) (uint32, error) {
+return c.proto.SendResumable(ctx, messageType, token, r, size)
+}
+
+// SetStreamHandler sets the handler for incoming open-ended streams (see Protocol.SetStreamHandler)
+func (c *Client) SetStreamHandler(handler StreamHandler) {
+c.proto.SetStreamHandler(handler)
+}
+
+// OpenChannel opens a logical channel on the connection (see Protocol.OpenChannel)
+func (c *Client) OpenChannel(id uint32, handler ChannelHandler) (*Channel, error) {
+return c.proto.OpenChannel(id, handler)
+}
+
+// CancelStream cancels a stream being sent (see Protocol.CancelStream)
+func (c *Client) CancelStream(msgID uint32, reason StreamCancelReason) error {
+return c.proto.CancelStream(msgID, reason)
+}
+
+// RejectStream discards a stream being received and tells the sender (see Protocol.RejectStream)
+func (c *Client) RejectStream(msgID uint32, reason StreamCancelReason) error {
+return c.proto.RejectStream(msgID, reason)
+}
+
+// Flush waits until every message sent so far has been written (see Protocol.Flush)
+func (c *Client) Flush() error {
+return c.proto.Flush()
+}
+
+// Wait blocks until the client stops and returns the error that stopped it, such as
+// the read error after the connection was closed. Errors the client recovers from,
+// like handler errors and a *StreamError, are only reported on Errors.
+func (c *Client) Wait() error {
+<-c.done
+c.mu.RLock()
+defer c.mu.RUnlock()
+return c.err
 }
 
 // Close closes the connection and stops the client
@@ -123,7 +369,8 @@ func (c *Client) Close() error {
 return c.proto.Close()
 }
 
-// Errors returns a channel that receives errors from the listener
+// Errors returns a channel that receives errors from the listener: errors the client
+// recovers from and the one that stops it. Errors are dropped while the channel is full.
 func (c *Client) Errors() <-chan error {
 return c.errChan
 }
@@ -0,0 +1,675 @@
+package rdgproto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnsupportedType = errors.New("unsupported type for struct codec")
+	ErrInvalidTag      = errors.New("invalid rdg struct tag")
+	ErrInvalidCount    = errors.New("invalid element count")
+)
+
+// encodeFunc writes a single value to the buffer
+type encodeFunc func(buf *bytes.Buffer, v reflect.Value) error
+
+// decodeFunc reads a single value into v, which is always settable
+type decodeFunc func(r *bytes.Reader, v reflect.Value) error
+
+// structCodec holds the compiled field codecs of a struct type
+type structCodec struct {
+	fields []fieldCodec
+}
+
+// fieldCodec encodes a single tagged struct field
+type fieldCodec struct {
+	name   string
+	tag    int
+	index  int
+	encode encodeFunc
+	decode decodeFunc
+}
+
+// codecCache maps reflect.Type to *structCodec
+var codecCache sync.Map
+
+// timeType is encoded with WriteTime rather than as a nested struct
+var timeType = reflect.TypeOf(time.Time{})
+
+// MarshalStruct encodes exported fields tagged with `rdg:"N"` in ascending tag order,
+// using the same wire primitives as hand-written payloads (varints, length-prefixed strings
+// and bytes). Tag numbers only define the order, so a struct codec payload is byte-for-byte
+// identical to a hand-written Marshal that writes the same fields in the same order.
+//
+// Tag options (comma separated after the number):
+//
+//	fixed   encode 32/64-bit integers as big-endian fixed width instead of varint
+//	varint  encode integers as varint (the default)
+//
+// Supported field types: bool, signed and unsigned integers (signed values are zigzag
+// encoded), float32/float64, string, []byte, time.Time, time.Duration, arrays, slices,
+// maps (written in sorted key order), nested structs (inline) and pointers (a presence
+// byte followed by the value).
+//
+// Example:
+//
+//	type LoginPayload struct {
+//	    Username string `rdg:"1"`
+//	    Password string `rdg:"2"`
+//	    Attempts uint32 `rdg:"3,fixed"`
+//	}
+//
+//	func (p *LoginPayload) Marshal() ([]byte, error)   { return rdgproto.MarshalStruct(p) }
+//	func (p *LoginPayload) Unmarshal(data []byte) error { return rdgproto.UnmarshalStruct(data, p) }
+func MarshalStruct(v interface{}) ([]byte, error) {
+	buf := GetBuffer()
+	defer PutBuffer(buf)
+
+	if err := EncodeStruct(buf, v); err != nil {
+		return nil, err
+	}
+
+	// Copy buffer contents before returning it to pool
+	result := make([]byte, buf.Len())
+	copy(result, buf.Bytes())
+	return result, nil
+}
+
+// EncodeStruct appends the struct encoding of v to buf
+func EncodeStruct(buf *bytes.Buffer, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return fmt.Errorf("%w: nil pointer", ErrUnsupportedType)
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return fmt.Errorf("%w: %s", ErrUnsupportedType, rv.Type())
+	}
+	codec, err := codecFor(rv.Type())
+	if err != nil {
+		return err
+	}
+	return codec.encode(buf, rv)
+}
+
+// UnmarshalStruct decodes data into the struct pointed to by v using its rdg field tags
+func UnmarshalStruct(data []byte, v interface{}) error {
+	return DecodeStruct(bytes.NewReader(data), v)
+}
+
+// DecodeStruct reads the struct encoding of v from r
+func DecodeStruct(r *bytes.Reader, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("%w: decode target must be a non-nil pointer", ErrUnsupportedType)
+	}
+	rv = rv.Elem()
+	if rv.Kind() != reflect.Struct {
+		return fmt.Errorf("%w: %s", ErrUnsupportedType, rv.Type())
+	}
+	codec, err := codecFor(rv.Type())
+	if err != nil {
+		return err
+	}
+	return codec.decode(r, rv)
+}
+
+// codecFor returns the cached codec for a struct type, compiling it on first use
+func codecFor(t reflect.Type) (*structCodec, error) {
+	if c, ok := codecCache.Load(t); ok {
+		return c.(*structCodec), nil
+	}
+	c, err := compileStruct(t, make(map[reflect.Type]*structCodec))
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := codecCache.LoadOrStore(t, c)
+	return actual.(*structCodec), nil
+}
+
+func (c *structCodec) encode(buf *bytes.Buffer, v reflect.Value) error {
+	for i := range c.fields {
+		f := &c.fields[i]
+		if err := f.encode(buf, v.Field(f.index)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *structCodec) decode(r *bytes.Reader, v reflect.Value) error {
+	for i := range c.fields {
+		f := &c.fields[i]
+		if err := f.decode(r, v.Field(f.index)); err != nil {
+			return fmt.Errorf("field %s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+// compileStruct builds field codecs for every tagged exported field of t, compiling
+// nested structs along with it. building holds the structs being compiled, so a
+// recursive type refers to its own codec instead of compiling forever.
+func compileStruct(t reflect.Type, building map[reflect.Type]*structCodec) (*structCodec, error) {
+	c := &structCodec{}
+	building[t] = c
+	seen := make(map[int]string)
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag, ok := sf.Tag.Lookup("rdg")
+		if !ok || tag == "-" {
+			continue
+		}
+		if !sf.IsExported() {
+			return nil, fmt.Errorf("%w: %s.%s is unexported", ErrInvalidTag, t, sf.Name)
+		}
+
+		num, fixed, err := parseTag(tag)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s.%s: %v", ErrInvalidTag, t, sf.Name, err)
+		}
+		if prev, dup := seen[num]; dup {
+			return nil, fmt.Errorf("%w: %s.%s reuses number %d of %s", ErrInvalidTag, t, sf.Name, num, prev)
+		}
+		seen[num] = sf.Name
+
+		enc, dec, err := compileType(sf.Type, fixed, building)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", t, sf.Name, err)
+		}
+		c.fields = append(c.fields, fieldCodec{
+			name:   sf.Name,
+			tag:    num,
+			index:  i,
+			encode: enc,
+			decode: dec,
+		})
+	}
+	sort.Slice(c.fields, func(i, j int) bool { return c.fields[i].tag < c.fields[j].tag })
+	return c, nil
+}
+
+// parseTag parses `N[,fixed|,varint]`
+func parseTag(tag string) (int, bool, error) {
+	parts := strings.Split(tag, ",")
+	num, err := strconv.Atoi(parts[0])
+	if err != nil || num <= 0 {
+		return 0, false, fmt.Errorf("field number must be a positive integer, got %q", parts[0])
+	}
+	fixed := false
+	for _, opt := range parts[1:] {
+		switch opt {
+		case "fixed":
+			fixed = true
+		case "varint":
+			fixed = false
+		default:
+			return 0, false, fmt.Errorf("unknown option %q", opt)
+		}
+	}
+	return num, fixed, nil
+}
+
+// compileType returns the encoder and decoder for a value of type t
+func compileType(t reflect.Type, fixed bool, building map[reflect.Type]*structCodec) (encodeFunc, decodeFunc, error) {
+	if fixed {
+		switch t.Kind() {
+		case reflect.Uint32, reflect.Int32, reflect.Uint64, reflect.Int64:
+		default:
+			return nil, nil, fmt.Errorf("%w: fixed encoding requires a 32 or 64-bit integer, got %s", ErrInvalidTag, t)
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return encodeBool, decodeBool, nil
+
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint, reflect.Uintptr:
+		if fixed {
+			return fixedUintCodec(t.Bits())
+		}
+		return encodeUvarint, uvarintDecoder(t.Bits()), nil
+
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Int:
+		if fixed {
+			return fixedIntCodec(t.Bits())
+		}
+		return encodeZigzag, decodeZigzag, nil
+
+	case reflect.Float32:
+		return encodeFloat32, decodeFloat32, nil
+
+	case reflect.Float64:
+		return encodeFloat64, decodeFloat64, nil
+
+	case reflect.String:
+		return encodeString, decodeString, nil
+
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return encodeByteSlice, decodeByteSlice, nil
+		}
+		return sliceCodec(t, building)
+
+	case reflect.Array:
+		return arrayCodec(t, building)
+
+	case reflect.Map:
+		return mapCodec(t, building)
+
+	case reflect.Ptr:
+		return ptrCodec(t, building)
+
+	case reflect.Struct:
+		if t == timeType {
+			return encodeTime, decodeTime, nil
+		}
+		return nestedCodec(t, building)
+	}
+
+	return nil, nil, fmt.Errorf("%w: %s", ErrUnsupportedType, t)
+}
+
+func encodeBool(buf *bytes.Buffer, v reflect.Value) error {
+	return WriteBool(buf, v.Bool())
+}
+
+func decodeBool(r *bytes.Reader, v reflect.Value) error {
+	b, err := ReadBool(r)
+	if err != nil {
+		return err
+	}
+	v.SetBool(b)
+	return nil
+}
+
+func encodeUvarint(buf *bytes.Buffer, v reflect.Value) error {
+	return WriteVarint(buf, v.Uint())
+}
+
+func uvarintDecoder(bits int) decodeFunc {
+	return func(r *bytes.Reader, v reflect.Value) error {
+		u, err := ReadVarint(r)
+		if err != nil {
+			return err
+		}
+		if bits < 64 && u >= 1<<uint(bits) {
+			return ErrVarintOverflow
+		}
+		v.SetUint(u)
+		return nil
+	}
+}
+
+func encodeZigzag(buf *bytes.Buffer, v reflect.Value) error {
+	return WriteInt64(buf, v.Int())
+}
+
+func decodeZigzag(r *bytes.Reader, v reflect.Value) error {
+	i, err := ReadInt64(r)
+	if err != nil {
+		return err
+	}
+	if v.OverflowInt(i) {
+		return ErrVarintOverflow
+	}
+	v.SetInt(i)
+	return nil
+}
+
+func fixedUintCodec(bits int) (encodeFunc, decodeFunc, error) {
+	if bits == 32 {
+		enc := func(buf *bytes.Buffer, v reflect.Value) error {
+			return WriteUint32Fixed(buf, uint32(v.Uint()))
+		}
+		dec := func(r *bytes.Reader, v reflect.Value) error {
+			u, err := ReadUint32Fixed(r)
+			if err != nil {
+				return err
+			}
+			v.SetUint(uint64(u))
+			return nil
+		}
+		return enc, dec, nil
+	}
+	enc := func(buf *bytes.Buffer, v reflect.Value) error {
+		return WriteUint64Fixed(buf, v.Uint())
+	}
+	dec := func(r *bytes.Reader, v reflect.Value) error {
+		u, err := ReadUint64Fixed(r)
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+		return nil
+	}
+	return enc, dec, nil
+}
+
+func fixedIntCodec(bits int) (encodeFunc, decodeFunc, error) {
+	if bits == 32 {
+		enc := func(buf *bytes.Buffer, v reflect.Value) error {
+			return WriteInt32Fixed(buf, int32(v.Int()))
+		}
+		dec := func(r *bytes.Reader, v reflect.Value) error {
+			i, err := ReadInt32Fixed(r)
+			if err != nil {
+				return err
+			}
+			v.SetInt(int64(i))
+			return nil
+		}
+		return enc, dec, nil
+	}
+	enc := func(buf *bytes.Buffer, v reflect.Value) error {
+		return WriteInt64Fixed(buf, v.Int())
+	}
+	dec := func(r *bytes.Reader, v reflect.Value) error {
+		i, err := ReadInt64Fixed(r)
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+		return nil
+	}
+	return enc, dec, nil
+}
+
+func encodeFloat32(buf *bytes.Buffer, v reflect.Value) error {
+	return WriteFloat32(buf, float32(v.Float()))
+}
+
+func decodeFloat32(r *bytes.Reader, v reflect.Value) error {
+	f, err := ReadFloat32(r)
+	if err != nil {
+		return err
+	}
+	v.SetFloat(float64(f))
+	return nil
+}
+
+func encodeFloat64(buf *bytes.Buffer, v reflect.Value) error {
+	return WriteFloat64(buf, v.Float())
+}
+
+func decodeFloat64(r *bytes.Reader, v reflect.Value) error {
+	f, err := ReadFloat64(r)
+	if err != nil {
+		return err
+	}
+	v.SetFloat(f)
+	return nil
+}
+
+func encodeTime(buf *bytes.Buffer, v reflect.Value) error {
+	return WriteTime(buf, v.Interface().(time.Time))
+}
+
+func decodeTime(r *bytes.Reader, v reflect.Value) error {
+	t, err := ReadTime(r)
+	if err != nil {
+		return err
+	}
+	v.Set(reflect.ValueOf(t))
+	return nil
+}
+
+func encodeString(buf *bytes.Buffer, v reflect.Value) error {
+	return WriteString(buf, v.String())
+}
+
+func decodeString(r *bytes.Reader, v reflect.Value) error {
+	s, err := ReadString(r)
+	if err != nil {
+		return err
+	}
+	v.SetString(s)
+	return nil
+}
+
+func encodeByteSlice(buf *bytes.Buffer, v reflect.Value) error {
+	return WriteBytes(buf, v.Bytes())
+}
+
+func decodeByteSlice(r *bytes.Reader, v reflect.Value) error {
+	b, err := ReadBytes(r)
+	if err != nil {
+		return err
+	}
+	v.SetBytes(b)
+	return nil
+}
+
+// readCount reads a varint element count, rejecting counts larger than the remaining
+// input or MaxCollectionElements
+func readCount(r *bytes.Reader) (int, error) {
+	return readCollectionLen(r, MaxCollectionElements, 1)
+}
+
+func sliceCodec(t reflect.Type, building map[reflect.Type]*structCodec) (encodeFunc, decodeFunc, error) {
+	elemEnc, elemDec, err := compileType(t.Elem(), false, building)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc := func(buf *bytes.Buffer, v reflect.Value) error {
+		n := v.Len()
+		if err := WriteVarint(buf, uint64(n)); err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := elemEnc(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	dec := func(r *bytes.Reader, v reflect.Value) error {
+		n, err := readCount(r)
+		if err != nil {
+			return err
+		}
+		s := reflect.MakeSlice(t, n, n)
+		for i := 0; i < n; i++ {
+			if err := elemDec(r, s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+		return nil
+	}
+	return enc, dec, nil
+}
+
+func arrayCodec(t reflect.Type, building map[reflect.Type]*structCodec) (encodeFunc, decodeFunc, error) {
+	n := t.Len()
+	if t.Elem().Kind() == reflect.Uint8 {
+		// Byte arrays are written raw with no length prefix
+		enc := func(buf *bytes.Buffer, v reflect.Value) error {
+			for i := 0; i < n; i++ {
+				if err := buf.WriteByte(byte(v.Index(i).Uint())); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		dec := func(r *bytes.Reader, v reflect.Value) error {
+			for i := 0; i < n; i++ {
+				b, err := r.ReadByte()
+				if err != nil {
+					return err
+				}
+				v.Index(i).SetUint(uint64(b))
+			}
+			return nil
+		}
+		return enc, dec, nil
+	}
+
+	elemEnc, elemDec, err := compileType(t.Elem(), false, building)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc := func(buf *bytes.Buffer, v reflect.Value) error {
+		for i := 0; i < n; i++ {
+			if err := elemEnc(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	dec := func(r *bytes.Reader, v reflect.Value) error {
+		for i := 0; i < n; i++ {
+			if err := elemDec(r, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return enc, dec, nil
+}
+
+func mapCodec(t reflect.Type, building map[reflect.Type]*structCodec) (encodeFunc, decodeFunc, error) {
+	less, err := keyLess(t.Key())
+	if err != nil {
+		return nil, nil, err
+	}
+	keyEnc, keyDec, err := compileType(t.Key(), false, building)
+	if err != nil {
+		return nil, nil, err
+	}
+	valEnc, valDec, err := compileType(t.Elem(), false, building)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc := func(buf *bytes.Buffer, v reflect.Value) error {
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return less(keys[i], keys[j]) })
+		if err := WriteVarint(buf, uint64(len(keys))); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := keyEnc(buf, k); err != nil {
+				return err
+			}
+			if err := valEnc(buf, v.MapIndex(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	dec := func(r *bytes.Reader, v reflect.Value) error {
+		n, err := readCount(r)
+		if err != nil {
+			return err
+		}
+		m := reflect.MakeMapWithSize(t, n)
+		for i := 0; i < n; i++ {
+			k := reflect.New(t.Key()).Elem()
+			if err := keyDec(r, k); err != nil {
+				return err
+			}
+			val := reflect.New(t.Elem()).Elem()
+			if err := valDec(r, val); err != nil {
+				return err
+			}
+			m.SetMapIndex(k, val)
+		}
+		v.Set(m)
+		return nil
+	}
+	return enc, dec, nil
+}
+
+// keyLess returns an ordering for map keys so encoding is deterministic
+func keyLess(t reflect.Type) (func(a, b reflect.Value) bool, error) {
+	switch t.Kind() {
+	case reflect.String:
+		return func(a, b reflect.Value) bool { return a.String() < b.String() }, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return func(a, b reflect.Value) bool { return a.Int() < b.Int() }, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return func(a, b reflect.Value) bool { return a.Uint() < b.Uint() }, nil
+	case reflect.Float32, reflect.Float64:
+		return func(a, b reflect.Value) bool { return a.Float() < b.Float() }, nil
+	case reflect.Bool:
+		return func(a, b reflect.Value) bool { return !a.Bool() && b.Bool() }, nil
+	}
+	return nil, fmt.Errorf("%w: map key %s", ErrUnsupportedType, t)
+}
+
+func ptrCodec(t reflect.Type, building map[reflect.Type]*structCodec) (encodeFunc, decodeFunc, error) {
+	elemEnc, elemDec, err := compileType(t.Elem(), false, building)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc := func(buf *bytes.Buffer, v reflect.Value) error {
+		if v.IsNil() {
+			return WriteBool(buf, false)
+		}
+		if err := WriteBool(buf, true); err != nil {
+			return err
+		}
+		return elemEnc(buf, v.Elem())
+	}
+	dec := func(r *bytes.Reader, v reflect.Value) error {
+		present, err := ReadBool(r)
+		if err != nil {
+			return err
+		}
+		if !present {
+			v.Set(reflect.Zero(t))
+			return nil
+		}
+		p := reflect.New(t.Elem())
+		if err := elemDec(r, p.Elem()); err != nil {
+			return err
+		}
+		v.Set(p)
+		return nil
+	}
+	return enc, dec, nil
+}
+
+// nestedCodec encodes a nested struct inline. Its codec is compiled with the
+// enclosing struct, so unsupported fields are reported as early as top-level ones.
+// A recursive type (e.g. a struct holding a pointer to itself) uses the codec that
+// is still being built, which is complete by the time a value is encoded. A struct
+// with fields but no rdg tags, such as time.Time, would encode as nothing and is
+// rejected.
+func nestedCodec(t reflect.Type, building map[reflect.Type]*structCodec) (encodeFunc, decodeFunc, error) {
+	if !hasRdgTags(t) {
+		return nil, nil, fmt.Errorf("%w: %s has no rdg-tagged fields", ErrUnsupportedType, t)
+	}
+	c, ok := building[t]
+	if !ok {
+		if cached, ok := codecCache.Load(t); ok {
+			c = cached.(*structCodec)
+		} else {
+			var err error
+			if c, err = compileStruct(t, building); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return c.encode, c.decode, nil
+}
+
+// hasRdgTags reports whether struct type t has rdg tags or no fields at all
+func hasRdgTags(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if _, ok := t.Field(i).Tag.Lookup("rdg"); ok {
+			return true
+		}
+	}
+	return t.NumField() == 0
+}
@@ -0,0 +1,295 @@
+package rdgproto
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"slices"
+)
+
+var (
+	ErrTooManyElements = errors.New("collection exceeds maximum element count")
+)
+
+// MaxCollectionElements is the default element-count limit enforced by ReadSlice, ReadMap
+// and the ReadPacked* helpers. Use the *N variants to apply a different limit per call.
+var MaxCollectionElements = 1 << 20
+
+// maxPrealloc caps the capacity allocated up front from a peer-supplied count.
+// Larger collections grow as elements actually arrive.
+const maxPrealloc = 4096
+
+// remaining returns the number of unread bytes when r can report it, or -1
+func remaining(r io.Reader) int {
+	if l, ok := r.(interface{ Len() int }); ok {
+		return l.Len()
+	}
+	return -1
+}
+
+// readCollectionLen reads a varint element count and validates it against limit.
+// minSize is the smallest encoded size of one element, used to reject counts
+// that cannot possibly fit in the remaining input.
+func readCollectionLen(r io.Reader, limit int, minSize int) (int, error) {
+	n, err := ReadVarint(r)
+	if err != nil {
+		return 0, err
+	}
+	if rem := remaining(r); rem >= 0 && minSize > 0 && n > uint64(rem/minSize) {
+		return 0, ErrInvalidCount
+	}
+	if n > uint64(limit) {
+		return 0, ErrTooManyElements
+	}
+	return int(n), nil
+}
+
+// WriteSlice writes a varint element count followed by each element
+//
+// Example:
+//
+//	rdgproto.WriteSlice(buf, p.Names, rdgproto.WriteString)
+func WriteSlice[T any](buf *bytes.Buffer, s []T, write func(*bytes.Buffer, T) error) error {
+	if err := WriteVarint(buf, uint64(len(s))); err != nil {
+		return err
+	}
+	for _, v := range s {
+		if err := write(buf, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadSlice reads a slice written by WriteSlice, limited to MaxCollectionElements
+//
+// Example:
+//
+//	p.Names, err = rdgproto.ReadSlice(r, rdgproto.ReadString)
+func ReadSlice[T any](r io.Reader, read func(io.Reader) (T, error)) ([]T, error) {
+	return ReadSliceN(r, MaxCollectionElements, read)
+}
+
+// ReadSliceN reads a slice written by WriteSlice with at most limit elements
+func ReadSliceN[T any](r io.Reader, limit int, read func(io.Reader) (T, error)) ([]T, error) {
+	n, err := readCollectionLen(r, limit, 1)
+	if err != nil {
+		return nil, err
+	}
+	s := make([]T, 0, min(n, maxPrealloc))
+	for i := 0; i < n; i++ {
+		v, err := read(r)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, v)
+	}
+	return s, nil
+}
+
+// WriteMap writes a varint entry count followed by key/value pairs in ascending key order,
+// so equal maps always produce identical bytes
+func WriteMap[K cmp.Ordered, V any](buf *bytes.Buffer, m map[K]V, writeKey func(*bytes.Buffer, K) error, writeValue func(*bytes.Buffer, V) error) error {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	if err := WriteVarint(buf, uint64(len(keys))); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := writeKey(buf, k); err != nil {
+			return err
+		}
+		if err := writeValue(buf, m[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadMap reads a map written by WriteMap, limited to MaxCollectionElements entries
+func ReadMap[K comparable, V any](r io.Reader, readKey func(io.Reader) (K, error), readValue func(io.Reader) (V, error)) (map[K]V, error) {
+	return ReadMapN(r, MaxCollectionElements, readKey, readValue)
+}
+
+// ReadMapN reads a map written by WriteMap with at most limit entries
+func ReadMapN[K comparable, V any](r io.Reader, limit int, readKey func(io.Reader) (K, error), readValue func(io.Reader) (V, error)) (map[K]V, error) {
+	n, err := readCollectionLen(r, limit, 1)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[K]V, min(n, maxPrealloc))
+	for i := 0; i < n; i++ {
+		k, err := readKey(r)
+		if err != nil {
+			return nil, err
+		}
+		v, err := readValue(r)
+		if err != nil {
+			return nil, err
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+// WritePackedUint32 writes a count followed by varint-encoded values.
+// The format is the same as a manual WriteUint32 count + WriteUint32 loop.
+func WritePackedUint32(buf *bytes.Buffer, values []uint32) error {
+	buf.Grow(binary.MaxVarintLen32 * (len(values) + 1))
+	b := buf.AvailableBuffer()
+	b = binary.AppendUvarint(b, uint64(len(values)))
+	for _, v := range values {
+		b = binary.AppendUvarint(b, uint64(v))
+	}
+	_, err := buf.Write(b)
+	return err
+}
+
+// ReadPackedUint32 reads values written by WritePackedUint32, limited to MaxCollectionElements
+func ReadPackedUint32(r io.Reader) ([]uint32, error) {
+	return ReadPackedUint32N(r, MaxCollectionElements)
+}
+
+// ReadPackedUint32N reads values written by WritePackedUint32 with at most limit elements
+func ReadPackedUint32N(r io.Reader, limit int) ([]uint32, error) {
+	return ReadSliceN(r, limit, ReadUint32)
+}
+
+// WritePackedUint64 writes a count followed by varint-encoded values
+func WritePackedUint64(buf *bytes.Buffer, values []uint64) error {
+	buf.Grow(binary.MaxVarintLen64 * (len(values) + 1))
+	b := buf.AvailableBuffer()
+	b = binary.AppendUvarint(b, uint64(len(values)))
+	for _, v := range values {
+		b = binary.AppendUvarint(b, v)
+	}
+	_, err := buf.Write(b)
+	return err
+}
+
+// ReadPackedUint64 reads values written by WritePackedUint64, limited to MaxCollectionElements
+func ReadPackedUint64(r io.Reader) ([]uint64, error) {
+	return ReadPackedUint64N(r, MaxCollectionElements)
+}
+
+// ReadPackedUint64N reads values written by WritePackedUint64 with at most limit elements
+func ReadPackedUint64N(r io.Reader, limit int) ([]uint64, error) {
+	return ReadSliceN(r, limit, ReadUint64)
+}
+
+// WritePackedInt64 writes a count followed by zigzag varint-encoded values
+func WritePackedInt64(buf *bytes.Buffer, values []int64) error {
+	buf.Grow(binary.MaxVarintLen64 * (len(values) + 1))
+	b := buf.AvailableBuffer()
+	b = binary.AppendUvarint(b, uint64(len(values)))
+	for _, v := range values {
+		b = binary.AppendUvarint(b, zigzag(v))
+	}
+	_, err := buf.Write(b)
+	return err
+}
+
+// ReadPackedInt64 reads values written by WritePackedInt64, limited to MaxCollectionElements
+func ReadPackedInt64(r io.Reader) ([]int64, error) {
+	return ReadPackedInt64N(r, MaxCollectionElements)
+}
+
+// ReadPackedInt64N reads values written by WritePackedInt64 with at most limit elements
+func ReadPackedInt64N(r io.Reader, limit int) ([]int64, error) {
+	return ReadSliceN(r, limit, ReadInt64)
+}
+
+// WritePackedFloat64 writes a count followed by big-endian IEEE 754 values (8 bytes each)
+func WritePackedFloat64(buf *bytes.Buffer, values []float64) error {
+	buf.Grow(binary.MaxVarintLen64 + 8*len(values))
+	b := buf.AvailableBuffer()
+	b = binary.AppendUvarint(b, uint64(len(values)))
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint64(b, math.Float64bits(v))
+	}
+	_, err := buf.Write(b)
+	return err
+}
+
+// ReadPackedFloat64 reads values written by WritePackedFloat64, limited to MaxCollectionElements
+func ReadPackedFloat64(r io.Reader) ([]float64, error) {
+	return ReadPackedFloat64N(r, MaxCollectionElements)
+}
+
+// ReadPackedFloat64N reads values written by WritePackedFloat64 with at most limit elements
+func ReadPackedFloat64N(r io.Reader, limit int) ([]float64, error) {
+	n, err := readCollectionLen(r, limit, 8)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]float64, 0, min(n, maxPrealloc))
+	var b [8]byte
+	for i := 0; i < n; i++ {
+		if err := readFixed(r, b[:]); err != nil {
+			return nil, err
+		}
+		values = append(values, math.Float64frombits(binary.BigEndian.Uint64(b[:])))
+	}
+	return values, nil
+}
+
+// WritePackedBool writes a count followed by the values packed 8 per byte, least significant bit first
+func WritePackedBool(buf *bytes.Buffer, values []bool) error {
+	if err := WriteVarint(buf, uint64(len(values))); err != nil {
+		return err
+	}
+	var cur byte
+	for i, v := range values {
+		if v {
+			cur |= 1 << (i % 8)
+		}
+		if i%8 == 7 {
+			if err := buf.WriteByte(cur); err != nil {
+				return err
+			}
+			cur = 0
+		}
+	}
+	if len(values)%8 != 0 {
+		return buf.WriteByte(cur)
+	}
+	return nil
+}
+
+// ReadPackedBool reads values written by WritePackedBool, limited to MaxCollectionElements
+func ReadPackedBool(r io.Reader) ([]bool, error) {
+	return ReadPackedBoolN(r, MaxCollectionElements)
+}
+
+// ReadPackedBoolN reads values written by WritePackedBool with at most limit elements
+func ReadPackedBoolN(r io.Reader, limit int) ([]bool, error) {
+	n, err := ReadVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if rem := remaining(r); rem >= 0 && (n+7)/8 > uint64(rem) {
+		return nil, ErrInvalidCount
+	}
+	if n > uint64(limit) {
+		return nil, ErrTooManyElements
+	}
+
+	values := make([]bool, 0, min(int(n), maxPrealloc))
+	var b [1]byte
+	for i := 0; i < int(n); i++ {
+		if i%8 == 0 {
+			if err := readFixed(r, b[:]); err != nil {
+				return nil, err
+			}
+		}
+		values = append(values, b[0]&(1<<(i%8)) != 0)
+	}
+	return values, nil
+}
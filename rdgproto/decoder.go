@@ -0,0 +1,425 @@
+package rdgproto
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// Decoder reads rdgproto primitives directly from a byte slice and records the first error.
+// Once an error occurs every further read returns the zero value, so an Unmarshal method
+// can read all of its fields and check Err once at the end.
+//
+// Decoder accepts exactly the bytes produced by the Write* functions and Encoder, but
+// avoids the per-call interface dispatch of the io.Reader based Read* functions.
+// Reading past the end of the data sets io.ErrUnexpectedEOF.
+//
+// A zero-copy decoder (NewZeroCopyDecoder, Message.Decoder) returns strings and byte
+// slices that alias the input instead of copying it. See NewZeroCopyDecoder for the
+// lifetime rules.
+//
+// Example:
+//
+//	func (p *LoginPayload) Unmarshal(data []byte) error {
+//	    d := rdgproto.NewDecoder(data)
+//	    p.Username = d.ReadString()
+//	    p.Password = d.ReadString()
+//	    p.Attempts = d.ReadUint32()
+//	    return d.Err()
+//	}
+type Decoder struct {
+	data     []byte
+	off      int
+	err      error
+	zeroCopy bool
+}
+
+// NewDecoder creates a decoder over data. The decoder never modifies data.
+func NewDecoder(data []byte) *Decoder {
+	return &Decoder{data: data}
+}
+
+// NewZeroCopyDecoder creates a decoder whose ReadString, ReadBytes and ReadRaw results
+// alias data instead of copying it, so decoding large strings and blobs costs no
+// allocation per field.
+//
+// The results share memory with data and are only valid while data is unchanged:
+//   - never modify data (or the returned byte slices) after decoding
+//   - never decode from a buffer that will be reused, such as one from GetBuffer
+//   - copy values that must outlive data (strings.Clone, bytes.Clone)
+//
+// Message payloads returned by UnmarshalMessage and Protocol.ReceiveMessage are owned
+// by the Message, so decoding msg.Payload (directly or through Message.Decoder) is safe
+// for as long as the caller keeps the Message's payload unmodified. With
+// MessageOptions.PooledBuffers the payload is recycled by Message.Release, after which
+// borrowed values must no longer be used.
+func NewZeroCopyDecoder(data []byte) *Decoder {
+	return &Decoder{data: data, zeroCopy: true}
+}
+
+// Decoder returns a zero-copy decoder over the message payload.
+// Strings and byte slices it returns share memory with m.Payload and stay valid as
+// long as m.Payload is not modified; see NewZeroCopyDecoder.
+//
+// Example:
+//
+//	d := msg.Decoder()
+//	name := d.ReadString() // no allocation
+//	blob := d.ReadBytes()  // aliases msg.Payload
+//	if err := d.Err(); err != nil {
+//	    return err
+//	}
+func (m *Message) Decoder() *Decoder {
+	return NewZeroCopyDecoder(m.Payload)
+}
+
+// ZeroCopy reports whether the decoder returns strings and byte slices that alias its input
+func (d *Decoder) ZeroCopy() bool {
+	return d.zeroCopy
+}
+
+// Reset makes the decoder read from data, clearing any recorded error.
+// The zero-copy mode is kept.
+func (d *Decoder) Reset(data []byte) {
+	d.data = data
+	d.off = 0
+	d.err = nil
+}
+
+// Err returns the first error encountered, if any
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// SetErr records err unless an earlier error is already recorded.
+// Use it to report validation failures from custom decoding logic.
+func (d *Decoder) SetErr(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// Offset returns the number of bytes consumed so far
+func (d *Decoder) Offset() int {
+	return d.off
+}
+
+// Remaining returns the number of unread bytes
+func (d *Decoder) Remaining() int {
+	return len(d.data) - d.off
+}
+
+// next consumes n bytes and returns them, or records io.ErrUnexpectedEOF and returns nil
+func (d *Decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.data)-d.off {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := d.data[d.off : d.off+n : d.off+n]
+	d.off += n
+	return b
+}
+
+// ReadVarint reads an unsigned varint
+func (d *Decoder) ReadVarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	var result uint64
+	var shift uint
+	for i := d.off; i < len(d.data); i++ {
+		if shift >= 64 {
+			d.err = ErrVarintOverflow
+			return 0
+		}
+		b := d.data[i]
+		result |= uint64(b&0x7F) << shift
+		if b&0x80 == 0 {
+			d.off = i + 1
+			return result
+		}
+		shift += 7
+	}
+	d.err = io.ErrUnexpectedEOF
+	return 0
+}
+
+// ReadUint8 reads a single raw byte
+func (d *Decoder) ReadUint8() uint8 {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+// ReadRaw reads n bytes with no length prefix.
+// The result is a copy unless the decoder is in zero-copy mode.
+func (d *Decoder) ReadRaw(n int) []byte {
+	b := d.next(n)
+	if b == nil || d.zeroCopy {
+		return b
+	}
+	return append([]byte(nil), b...)
+}
+
+// readLen reads a varint length prefix and checks it against limit and the remaining input
+func (d *Decoder) readLen(limit uint64, limitErr error) int {
+	n := d.ReadVarint()
+	if d.err != nil {
+		return 0
+	}
+	if n > limit {
+		d.err = limitErr
+		return 0
+	}
+	if n > uint64(d.Remaining()) {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	return int(n)
+}
+
+// ReadString reads a length-prefixed string (maximum 1MB, like ReadString)
+func (d *Decoder) ReadString() string {
+	n := d.readLen(1<<20, ErrInvalidStringLen)
+	if n == 0 {
+		return ""
+	}
+	b := d.next(n)
+	if d.zeroCopy {
+		// #nosec G103 -- aliasing the input is the documented contract of zero-copy mode
+		return unsafe.String(&b[0], n)
+	}
+	return string(b)
+}
+
+// ReadBytes reads a length-prefixed byte slice (maximum 1GB, like ReadBytes).
+// The result is never nil on success. It is a copy unless the decoder is in
+// zero-copy mode, where it aliases the input with its capacity clipped so that
+// appending to it never overwrites the following fields.
+func (d *Decoder) ReadBytes() []byte {
+	n := d.readLen(1<<30, ErrInvalidBytesLen)
+	if d.err != nil {
+		return nil
+	}
+	if d.zeroCopy {
+		if n == 0 {
+			return []byte{}
+		}
+		return d.next(n)
+	}
+	b := make([]byte, n)
+	copy(b, d.next(n))
+	return b
+}
+
+// ReadUint32 reads a varint-encoded uint32
+func (d *Decoder) ReadUint32() uint32 {
+	v := d.ReadVarint()
+	if v > math.MaxUint32 {
+		d.SetErr(ErrVarintOverflow)
+		return 0
+	}
+	return uint32(v)
+}
+
+// ReadUint64 reads a varint-encoded uint64
+func (d *Decoder) ReadUint64() uint64 {
+	return d.ReadVarint()
+}
+
+// ReadUint32Fixed reads a big-endian uint32
+func (d *Decoder) ReadUint32Fixed() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+// ReadUint64Fixed reads a big-endian uint64
+func (d *Decoder) ReadUint64Fixed() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// ReadBool reads a boolean written by WriteBool
+func (d *Decoder) ReadBool() bool {
+	return d.ReadUint8() == 1
+}
+
+// ReadInt32 reads a zigzag varint-encoded int32
+func (d *Decoder) ReadInt32() int32 {
+	v := d.ReadInt64()
+	if v < math.MinInt32 || v > math.MaxInt32 {
+		d.SetErr(ErrVarintOverflow)
+		return 0
+	}
+	return int32(v)
+}
+
+// ReadInt64 reads a zigzag varint-encoded int64
+func (d *Decoder) ReadInt64() int64 {
+	return unzigzag(d.ReadVarint())
+}
+
+// ReadInt32Fixed reads a big-endian int32
+func (d *Decoder) ReadInt32Fixed() int32 {
+	return int32(d.ReadUint32Fixed())
+}
+
+// ReadInt64Fixed reads a big-endian int64
+func (d *Decoder) ReadInt64Fixed() int64 {
+	return int64(d.ReadUint64Fixed())
+}
+
+// ReadFloat32 reads an IEEE 754 float32
+func (d *Decoder) ReadFloat32() float32 {
+	return math.Float32frombits(d.ReadUint32Fixed())
+}
+
+// ReadFloat64 reads an IEEE 754 float64
+func (d *Decoder) ReadFloat64() float64 {
+	return math.Float64frombits(d.ReadUint64Fixed())
+}
+
+// ReadDuration reads a zigzag varint-encoded time.Duration
+func (d *Decoder) ReadDuration() time.Duration {
+	return time.Duration(d.ReadInt64())
+}
+
+// ReadTime reads a time.Time written by WriteTime
+func (d *Decoder) ReadTime() time.Time {
+	sec := d.ReadInt64()
+	nsec := d.ReadVarint()
+	name := d.ReadString()
+	offset := d.ReadInt64()
+	if d.err != nil {
+		return time.Time{}
+	}
+	if d.zeroCopy {
+		// A fixed zone keeps its name, which must not alias the input
+		name = strings.Clone(name)
+	}
+	t, err := makeTime(sec, nsec, name, offset)
+	d.SetErr(err)
+	return t
+}
+
+// ReadUUID reads a 16-byte UUID
+func (d *Decoder) ReadUUID() [UUIDSize]byte {
+	var id [UUIDSize]byte
+	copy(id[:], d.next(UUIDSize))
+	return id
+}
+
+// ReadCount reads a varint element count for a collection whose elements are at least
+// minSize bytes each. Counts that cannot fit in the remaining input set ErrInvalidCount;
+// counts above limit set ErrTooManyElements.
+//
+// Example:
+//
+//	n := d.ReadCount(rdgproto.MaxCollectionElements, 1)
+//	p.Names = make([]string, 0, n)
+//	for i := 0; i < n; i++ {
+//	    p.Names = append(p.Names, d.ReadString())
+//	}
+func (d *Decoder) ReadCount(limit int, minSize int) int {
+	n := d.ReadVarint()
+	if d.err != nil {
+		return 0
+	}
+	if minSize > 0 && n > uint64(d.Remaining()/minSize) {
+		d.err = ErrInvalidCount
+		return 0
+	}
+	if n > uint64(limit) {
+		d.err = ErrTooManyElements
+		return 0
+	}
+	return int(n)
+}
+
+// ReadPackedUint32 reads values written by WritePackedUint32, limited to MaxCollectionElements
+func (d *Decoder) ReadPackedUint32() []uint32 {
+	n := d.ReadCount(MaxCollectionElements, 1)
+	values := make([]uint32, 0, min(n, maxPrealloc))
+	for i := 0; i < n && d.err == nil; i++ {
+		values = append(values, d.ReadUint32())
+	}
+	if d.err != nil {
+		return nil
+	}
+	return values
+}
+
+// ReadPackedUint64 reads values written by WritePackedUint64, limited to MaxCollectionElements
+func (d *Decoder) ReadPackedUint64() []uint64 {
+	n := d.ReadCount(MaxCollectionElements, 1)
+	values := make([]uint64, 0, min(n, maxPrealloc))
+	for i := 0; i < n && d.err == nil; i++ {
+		values = append(values, d.ReadUint64())
+	}
+	if d.err != nil {
+		return nil
+	}
+	return values
+}
+
+// ReadPackedInt64 reads values written by WritePackedInt64, limited to MaxCollectionElements
+func (d *Decoder) ReadPackedInt64() []int64 {
+	n := d.ReadCount(MaxCollectionElements, 1)
+	values := make([]int64, 0, min(n, maxPrealloc))
+	for i := 0; i < n && d.err == nil; i++ {
+		values = append(values, d.ReadInt64())
+	}
+	if d.err != nil {
+		return nil
+	}
+	return values
+}
+
+// ReadPackedFloat64 reads values written by WritePackedFloat64, limited to MaxCollectionElements
+func (d *Decoder) ReadPackedFloat64() []float64 {
+	n := d.ReadCount(MaxCollectionElements, 8)
+	values := make([]float64, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		values = append(values, d.ReadFloat64())
+	}
+	if d.err != nil {
+		return nil
+	}
+	return values
+}
+
+// ReadPackedBool reads values written by WritePackedBool, limited to MaxCollectionElements
+func (d *Decoder) ReadPackedBool() []bool {
+	n := d.ReadVarint()
+	if d.err != nil {
+		return nil
+	}
+	if (n+7)/8 > uint64(d.Remaining()) {
+		d.err = ErrInvalidCount
+		return nil
+	}
+	if n > uint64(MaxCollectionElements) {
+		d.err = ErrTooManyElements
+		return nil
+	}
+	packed := d.next(int((n + 7) / 8))
+	values := make([]bool, n)
+	for i := range values {
+		values[i] = packed[i/8]&(1<<(i%8)) != 0
+	}
+	return values
+}
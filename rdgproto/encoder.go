@@ -0,0 +1,234 @@
+package rdgproto
+
+import (
+	"bytes"
+	"time"
+)
+
+// Encoder writes rdgproto primitives to a buffer and records the first error.
+// Once an error occurs every further write is a no-op, so a Marshal method can
+// write all of its fields and check Err (or Finish) once at the end.
+//
+// Example:
+//
+//	func (p *LoginPayload) Marshal() ([]byte, error) {
+//	    buf := rdgproto.GetBuffer()
+//	    defer rdgproto.PutBuffer(buf)
+//
+//	    e := rdgproto.NewEncoder(buf)
+//	    e.WriteString(p.Username)
+//	    e.WriteString(p.Password)
+//	    e.WriteUint32(p.Attempts)
+//	    return e.Finish()
+//	}
+type Encoder struct {
+	buf *bytes.Buffer
+	err error
+}
+
+// NewEncoder creates an encoder that appends to buf
+func NewEncoder(buf *bytes.Buffer) *Encoder {
+	return &Encoder{buf: buf}
+}
+
+// Err returns the first error encountered, if any
+func (e *Encoder) Err() error {
+	return e.err
+}
+
+// Buffer returns the underlying buffer
+func (e *Encoder) Buffer() *bytes.Buffer {
+	return e.buf
+}
+
+// Len returns the number of bytes written so far
+func (e *Encoder) Len() int {
+	return e.buf.Len()
+}
+
+// Finish returns a copy of the encoded bytes, or the first error encountered.
+// The copy stays valid after the underlying buffer is returned to the pool.
+func (e *Encoder) Finish() ([]byte, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	result := make([]byte, e.buf.Len())
+	copy(result, e.buf.Bytes())
+	return result, nil
+}
+
+// SetErr records err unless an earlier error is already recorded.
+// Use it to report validation failures from custom encoding logic.
+func (e *Encoder) SetErr(err error) {
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+// WriteVarint writes an unsigned varint
+func (e *Encoder) WriteVarint(v uint64) {
+	if e.err == nil {
+		e.err = WriteVarint(e.buf, v)
+	}
+}
+
+// WriteUint8 writes a single raw byte
+func (e *Encoder) WriteUint8(v uint8) {
+	if e.err == nil {
+		e.err = e.buf.WriteByte(v)
+	}
+}
+
+// WriteRaw writes b with no length prefix
+func (e *Encoder) WriteRaw(b []byte) {
+	if e.err == nil {
+		_, e.err = e.buf.Write(b)
+	}
+}
+
+// WriteString writes a length-prefixed string
+func (e *Encoder) WriteString(s string) {
+	if e.err == nil {
+		e.err = WriteString(e.buf, s)
+	}
+}
+
+// WriteBytes writes a length-prefixed byte slice
+func (e *Encoder) WriteBytes(b []byte) {
+	if e.err == nil {
+		e.err = WriteBytes(e.buf, b)
+	}
+}
+
+// WriteUint32 writes a varint-encoded uint32
+func (e *Encoder) WriteUint32(v uint32) {
+	if e.err == nil {
+		e.err = WriteUint32(e.buf, v)
+	}
+}
+
+// WriteUint64 writes a varint-encoded uint64
+func (e *Encoder) WriteUint64(v uint64) {
+	if e.err == nil {
+		e.err = WriteUint64(e.buf, v)
+	}
+}
+
+// WriteUint32Fixed writes a big-endian uint32 (always 4 bytes)
+func (e *Encoder) WriteUint32Fixed(v uint32) {
+	if e.err == nil {
+		e.err = WriteUint32Fixed(e.buf, v)
+	}
+}
+
+// WriteUint64Fixed writes a big-endian uint64 (always 8 bytes)
+func (e *Encoder) WriteUint64Fixed(v uint64) {
+	if e.err == nil {
+		e.err = WriteUint64Fixed(e.buf, v)
+	}
+}
+
+// WriteBool writes a boolean as a single byte
+func (e *Encoder) WriteBool(v bool) {
+	if e.err == nil {
+		e.err = WriteBool(e.buf, v)
+	}
+}
+
+// WriteInt32 writes a zigzag varint-encoded int32
+func (e *Encoder) WriteInt32(v int32) {
+	if e.err == nil {
+		e.err = WriteInt32(e.buf, v)
+	}
+}
+
+// WriteInt64 writes a zigzag varint-encoded int64
+func (e *Encoder) WriteInt64(v int64) {
+	if e.err == nil {
+		e.err = WriteInt64(e.buf, v)
+	}
+}
+
+// WriteInt32Fixed writes a big-endian int32 (always 4 bytes)
+func (e *Encoder) WriteInt32Fixed(v int32) {
+	if e.err == nil {
+		e.err = WriteInt32Fixed(e.buf, v)
+	}
+}
+
+// WriteInt64Fixed writes a big-endian int64 (always 8 bytes)
+func (e *Encoder) WriteInt64Fixed(v int64) {
+	if e.err == nil {
+		e.err = WriteInt64Fixed(e.buf, v)
+	}
+}
+
+// WriteFloat32 writes an IEEE 754 float32 (always 4 bytes)
+func (e *Encoder) WriteFloat32(v float32) {
+	if e.err == nil {
+		e.err = WriteFloat32(e.buf, v)
+	}
+}
+
+// WriteFloat64 writes an IEEE 754 float64 (always 8 bytes)
+func (e *Encoder) WriteFloat64(v float64) {
+	if e.err == nil {
+		e.err = WriteFloat64(e.buf, v)
+	}
+}
+
+// WriteTime writes a time.Time (see WriteTime)
+func (e *Encoder) WriteTime(t time.Time) {
+	if e.err == nil {
+		e.err = WriteTime(e.buf, t)
+	}
+}
+
+// WriteDuration writes a time.Duration as zigzag varint nanoseconds
+func (e *Encoder) WriteDuration(d time.Duration) {
+	if e.err == nil {
+		e.err = WriteDuration(e.buf, d)
+	}
+}
+
+// WriteUUID writes a 16-byte UUID
+func (e *Encoder) WriteUUID(id [UUIDSize]byte) {
+	if e.err == nil {
+		e.err = WriteUUID(e.buf, id)
+	}
+}
+
+// WritePackedUint32 writes a packed []uint32 (see WritePackedUint32)
+func (e *Encoder) WritePackedUint32(values []uint32) {
+	if e.err == nil {
+		e.err = WritePackedUint32(e.buf, values)
+	}
+}
+
+// WritePackedUint64 writes a packed []uint64
+func (e *Encoder) WritePackedUint64(values []uint64) {
+	if e.err == nil {
+		e.err = WritePackedUint64(e.buf, values)
+	}
+}
+
+// WritePackedInt64 writes a packed []int64
+func (e *Encoder) WritePackedInt64(values []int64) {
+	if e.err == nil {
+		e.err = WritePackedInt64(e.buf, values)
+	}
+}
+
+// WritePackedFloat64 writes a packed []float64
+func (e *Encoder) WritePackedFloat64(values []float64) {
+	if e.err == nil {
+		e.err = WritePackedFloat64(e.buf, values)
+	}
+}
+
+// WritePackedBool writes a bit-packed []bool
+func (e *Encoder) WritePackedBool(values []bool) {
+	if e.err == nil {
+		e.err = WritePackedBool(e.buf, values)
+	}
+}
@@ -0,0 +1,99 @@
+package rdgproto
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+)
+
+var (
+	ErrStreamIntegrity = errors.New("stream integrity check failed")
+)
+
+// payloadDigest returns the SHA-256 digest carried by integrity-checked streams
+func payloadDigest(payload []byte) []byte {
+	sum := sha256.Sum256(payload)
+	return sum[:]
+}
+
+// readerDigest returns the SHA-256 digest of size bytes read from r. It fails with
+// io.ErrUnexpectedEOF if r holds fewer bytes.
+func readerDigest(r io.ReaderAt, size int64) ([]byte, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	if n < size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return h.Sum(nil), nil
+}
+
+// openStreamDigest returns the running digest of an open-ended stream. It starts
+// with the stream's type and ID, so chunks can't be moved between streams.
+func openStreamDigest(messageType byte, messageID uint32) hash.Hash {
+	h := sha256.New()
+	h.Write(binary.BigEndian.AppendUint32([]byte{messageType}, messageID))
+	return h
+}
+
+// openStreamTrailer returns the end marker payload of an open-ended stream: empty, or
+// the digest of the data followed by, with a Signer, a signature of the message header
+// and digest. The signature binds the digest to the stream's type and ID, so an
+// open-ended stream is signed as a whole without holding its data.
+func (p *Protocol) openStreamTrailer(messageType byte, messageID uint32, digest []byte) ([]byte, error) {
+	signer := p.opts != nil && p.opts.Signer != nil
+	if !signer && !p.streamConfig.Integrity {
+		return []byte{}, nil
+	}
+	if !signer {
+		return digest, nil
+	}
+
+	headed, err := appendHeaderAndPayload(nil, messageType, messageID, digest)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := p.opts.Signer.Sign(headed)
+	if err != nil {
+		return nil, err
+	}
+	return append(digest, signature...), nil
+}
+
+// checkOpenStreamTrailer verifies the end marker payload of an open-ended stream
+// against the digest of the data received
+func (p *Protocol) checkOpenStreamTrailer(messageType byte, messageID uint32, digest []byte, trailer []byte) error {
+	if len(trailer) == 0 {
+		if p.verifiesStreams() {
+			return ErrSignatureRequired
+		}
+		if p.streamConfig.Integrity {
+			return ErrStreamIntegrity
+		}
+		return nil
+	}
+	if len(trailer) < sha256.Size || subtle.ConstantTimeCompare(trailer[:sha256.Size], digest) != 1 {
+		return ErrStreamIntegrity
+	}
+	if !p.verifiesStreams() {
+		return nil
+	}
+
+	signature := trailer[sha256.Size:]
+	if len(signature) == 0 {
+		return ErrSignatureRequired
+	}
+	headed, err := appendHeaderAndPayload(nil, messageType, messageID, digest)
+	if err != nil {
+		return err
+	}
+	if err := p.opts.Verifier.Verify(headed, signature); err != nil {
+		return ErrInvalidSignature
+	}
+	return nil
+}
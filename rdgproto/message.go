@@ -2,10 +2,13 @@ package rdgproto
 
 import (
 "bytes"
+"context"
 "encoding/binary"
 "errors"
 "io"
+"slices"
 "sync"
+"sync/atomic"
 )
 
 var (
@@ -114,6 +117,16 @@ StreamConfig *StreamConfig
 // StrictMode when true, rejects messages with unknown message types
 // This prevents processing of unregistered message types for security
 StrictMode   bool
+// PooledBuffers when true, receives frames into pooled buffers that Payload and
+// Signature alias. Call Message.Release once a message is handled to recycle its
+// buffer. Leave it off if your code keeps msg.Payload after handling a message.
+PooledBuffers bool
+// AsyncWrite when set, queues outgoing frames for a writer goroutine that
+// coalesces them into fewer writes (see AsyncWriteConfig)
+AsyncWrite    *AsyncWriteConfig
+// ChannelWindow is the receive window of each logical channel in bytes
+// (default: DefaultChannelWindow, see Protocol.OpenChannel)
+ChannelWindow int
 }
 
 // StrictMessageOptions creates options with strict mode enabled
@@ -134,105 +147,109 @@ return opts
 // MarshalMessage serializes a message with header and payload into binary format
 // Format: [Type(1)][ID(4)][PayloadLen(4)][Payload(N)][SignatureLen(4)][Signature(N)]
 func MarshalMessage(messageType byte, messageID uint32, payload interface{}, opts *MessageOptions) ([]byte, error) {
-// Serialize payload
-payloadBytes, err := MarshalPayload(payload)
+dst := make([]byte, 0, HeaderSize+payloadSizeHint(payload)+SignatureLengthSize)
+data, err := AppendMessage(dst, messageType, messageID, payload, opts)
 if err != nil {
 return nil, err
 }
-
-if len(payloadBytes) > MaxPayloadSize {
-return nil, ErrPayloadTooLarge
+return data, nil
 }
 
-buf := new(bytes.Buffer)
-
-// Write header
-if err := buf.WriteByte(messageType); err != nil {
-return nil, err
+// AppendMessage serializes a message like MarshalMessage but appends it to dst.
+// The header is written in place and the payload is encoded directly after it, so a
+// PayloadAppender payload is never copied. On error the returned slice is dst.
+func AppendMessage(dst []byte, messageType byte, messageID uint32, payload interface{}, opts *MessageOptions) ([]byte, error) {
+start := len(dst)
+out, err := appendHeaderAndPayload(dst, messageType, messageID, payload)
+if err != nil {
+return dst, err
 }
-if err := binary.Write(buf, binary.BigEndian, messageID); err != nil {
-return nil, err
+out, err = appendSignature(out, start, opts)
+if err != nil {
+return dst, err
 }
-if err := binary.Write(buf, binary.BigEndian, uint32(len(payloadBytes))); err != nil {
-return nil, err
+return out, nil
 }
 
-// Write payload
-if _, err := buf.Write(payloadBytes); err != nil {
-return nil, err
+// appendHeaderAndPayload appends the message header and payload to dst.
+// The payload length is filled in once the payload has been encoded.
+func appendHeaderAndPayload(dst []byte, messageType byte, messageID uint32, payload interface{}) ([]byte, error) {
+if hint := payloadSizeHint(payload); hint > 0 {
+dst = slices.Grow(dst, HeaderSize+hint+SignatureLengthSize)
 }
 
-// Optional signature
-if opts != nil && opts.Signer != nil {
-// Sign the message (header + payload)
-messageData := buf.Bytes()
-signature, err := opts.Signer.Sign(messageData)
+start := len(dst)
+dst = append(dst, messageType)
+dst = binary.BigEndian.AppendUint32(dst, messageID)
+dst = append(dst, 0, 0, 0, 0) // payload length, filled in below
+
+dst, err := AppendPayload(dst, payload)
 if err != nil {
 return nil, err
 }
-// Append signature length and signature
-if err := binary.Write(buf, binary.BigEndian, uint32(len(signature))); err != nil {
-return nil, err
+
+payloadLen := len(dst) - start - HeaderSize
+if payloadLen > MaxPayloadSize {
+return nil, ErrPayloadTooLarge
 }
-if _, err := buf.Write(signature); err != nil {
-return nil, err
+binary.BigEndian.PutUint32(dst[start+MessageTypeSize+MessageIDSize:], uint32(payloadLen))
+return dst, nil
 }
-} else {
+
+// appendSignature signs msg[start:] (header + payload) with opts.Signer if set
+// and appends the signature length and signature
+func appendSignature(msg []byte, start int, opts *MessageOptions) ([]byte, error) {
+if opts == nil || opts.Signer == nil {
 // No signature - write zero length
-if err := binary.Write(buf, binary.BigEndian, uint32(0)); err != nil {
-return nil, err
-}
+return binary.BigEndian.AppendUint32(msg, 0), nil
 }
 
-return buf.Bytes(), nil
+// Sign the message (header + payload)
+signature, err := opts.Signer.Sign(msg[start:])
+if err != nil {
+return nil, err
+}
+msg = binary.BigEndian.AppendUint32(msg, uint32(len(signature)))
+return append(msg, signature...), nil
 }
 
 // UnmarshalMessage deserializes a binary message into its components
 func UnmarshalMessage(data []byte, opts *MessageOptions) (*Message, interface{}, error) {
+return unmarshalMessage(data, opts, true)
+}
+
+// unmarshalMessage deserializes a binary message. When copyData is false the
+// message payload and signature alias data instead of being copied out of it.
+func unmarshalMessage(data []byte, opts *MessageOptions, copyData bool) (*Message, interface{}, error) {
 if len(data) < HeaderSize+SignatureLengthSize {
 return nil, nil, ErrInvalidMessage
 }
 
-r := bytes.NewReader(data)
-
 // Read header
-messageType, err := r.ReadByte()
-if err != nil {
-return nil, nil, err
-}
-
-var messageID uint32
-if err := binary.Read(r, binary.BigEndian, &messageID); err != nil {
-return nil, nil, err
-}
-
-var payloadLen uint32
-if err := binary.Read(r, binary.BigEndian, &payloadLen); err != nil {
-return nil, nil, err
-}
+messageType := data[0]
+messageID := binary.BigEndian.Uint32(data[MessageTypeSize:])
+payloadLen := binary.BigEndian.Uint32(data[MessageTypeSize+MessageIDSize:])
 
 if payloadLen > MaxPayloadSize {
 return nil, nil, ErrPayloadTooLarge
 }
 
-// Read payload
-payload := make([]byte, payloadLen)
-if _, err := io.ReadFull(r, payload); err != nil {
-return nil, nil, err
-}
-
-// Read signature length
-var sigLen uint32
-if err := binary.Read(r, binary.BigEndian, &sigLen); err != nil {
-return nil, nil, err
+// Read payload and signature length
+payloadEnd := HeaderSize + int(payloadLen)
+if len(data) < payloadEnd+SignatureLengthSize {
+return nil, nil, io.ErrUnexpectedEOF
 }
+payload := data[HeaderSize:payloadEnd:payloadEnd]
+sigLen := binary.BigEndian.Uint32(data[payloadEnd:])
 
 var signature []byte
 if sigLen > 0 {
-signature = make([]byte, sigLen)
-if _, err := io.ReadFull(r, signature); err != nil {
-return nil, nil, err
+sigStart := payloadEnd + SignatureLengthSize
+if uint64(len(data)-sigStart) < uint64(sigLen) {
+return nil, nil, io.ErrUnexpectedEOF
 }
+sigEnd := sigStart + int(sigLen)
+signature = data[sigStart:sigEnd:sigEnd]
 }
 
 // Verify signature if verifier is provided
@@ -241,12 +258,16 @@ if sigLen == 0 {
 return nil, nil, ErrSignatureRequired
 }
 // Message data for verification is header + payload
-messageDataLen := HeaderSize + int(payloadLen)
-if err := opts.Verifier.Verify(data[:messageDataLen], signature); err != nil {
+if err := opts.Verifier.Verify(data[:payloadEnd], signature); err != nil {
 return nil, nil, ErrInvalidSignature
 }
 }
 
+if copyData {
+payload = bytes.Clone(payload)
+signature = bytes.Clone(signature)
+}
+
 msg := &Message{
 Type:      messageType,
 ID:        messageID,
@@ -254,14 +275,7 @@ Payload:   payload,
 Signature: signature,
 }
 
-// Deserialize payload using registry if provided, respecting strict mode
-var payloadObj interface{}
-strictMode := opts != nil && opts.StrictMode
-if opts != nil && opts.Registry != nil {
-payloadObj, err = UnmarshalPayloadWithRegistryStrict(messageType, payload, opts.Registry, strictMode)
-} else {
-payloadObj, err = UnmarshalPayloadStrict(messageType, payload, strictMode)
-}
+payloadObj, err := decodePayload(messageType, payload, opts)
 if err != nil {
 return msg, nil, err
 }
@@ -269,6 +283,52 @@ return msg, nil, err
 return msg, payloadObj, nil
 }
 
+// decodePayload deserializes a payload using the registry from opts if provided,
+// respecting strict mode. Both direct and reassembled streamed messages go through it.
+// Reserved types are decoded by the protocol itself, so registries and strict mode
+// never affect streaming.
+func decodePayload(messageType byte, payload []byte, opts *MessageOptions) (interface{}, error) {
+if IsReservedType(messageType) {
+return decodeReservedPayload(messageType, payload, opts)
+}
+
+strictMode := opts != nil && opts.StrictMode
+if opts != nil && opts.Registry != nil {
+return UnmarshalPayloadWithRegistryStrict(messageType, payload, opts.Registry, strictMode)
+}
+return UnmarshalPayloadStrict(messageType, payload, strictMode)
+}
+
+// decodeReservedPayload deserializes the payload of an internal message type.
+// Types without a structured payload are returned as raw bytes, except error
+// frames, which are returned as a *StatusError.
+func decodeReservedPayload(messageType byte, payload []byte, opts *MessageOptions) (interface{}, error) {
+var p PayloadUnmarshaler
+switch messageType {
+case MessageTypeExtension:
+if len(payload) > 0 && payload[0] == extensionError {
+status, err := readStatus(NewDecoder(payload[1:]), opts)
+if err != nil {
+return nil, err
+}
+return status, nil
+}
+return payload, nil
+case MessageTypeStreamStart:
+p = &StreamHeader{}
+case MessageTypeStreamChunk:
+p = &StreamChunk{}
+case MessageTypeStreamCancel:
+p = &StreamCancel{}
+default:
+return payload, nil
+}
+if err := p.Unmarshal(payload); err != nil {
+return nil, err
+}
+return p, nil
+}
+
 // Protocol handles message sending and receiving over a connection
 type Protocol struct {
 conn         Connection
@@ -278,17 +338,47 @@ readMu       sync.Mutex
 nextID       uint32
 idMu         sync.Mutex
 streamConfig *StreamConfig
+vectored     bool
+lenBuf       [frameLengthSize]byte // guarded by readMu
+async        *asyncWriter
+scheduler    *streamScheduler
+limiter      atomic.Pointer[rateLimiter] // paces outgoing stream chunks, nil without StreamConfig.RateLimit
+
+// Goroutines waiting for or holding mu to write a message; stream chunks yield to them
+directWriters atomic.Int32
 
 // Stream assembly state
 streamMu        sync.Mutex
 activeStreams   map[uint32]*streamAssembler
-}
+streamBytes     int64   // bytes charged against StreamConfig.MaxStreamBytes
+streamErrs      []error // expired streams not yet reported
+streamHandler   StreamHandler
+
+// Wake-ups of a receive loop blocked on a quiet connection (see wakeReceiver)
+wakeMu sync.Mutex
+waking bool
 
-// streamAssembler collects chunks for a streamed message
-type streamAssembler struct {
-header   *StreamHeader
-chunks   map[uint32][]byte
-received uint32
+// SendResumable calls waiting for the receiver's resume answer
+resumeMu      sync.Mutex
+resumeWaiters map[uint32]chan []byte
+
+// Outgoing streams that can be canceled
+sendingMu      sync.Mutex
+sending        map[uint32]*streamCanceler
+pendingRejects atomic.Int32 // cancel frames for failed incoming streams not yet written
+
+// Logical channels
+channelsMu    sync.Mutex
+channels      map[uint32]*Channel
+pendingCredit map[uint32]int64    // credit granted for channels not opened yet
+closingIDs    map[uint32]struct{} // ids of channels closed here until the peer closes them too
+
+// Streaming calls opened here and by the peer, each keyed by call ID
+callsMu     sync.Mutex
+calls       map[uint32]*Call
+peerCalls   map[uint32]*Call
+callHandler CallHandler
+callContext context.Context // parent of the contexts of calls opened by the peer
 }
 
 // NewProtocol creates a new Protocol instance with the given connection
@@ -298,13 +388,28 @@ if opts != nil && opts.StreamConfig != nil {
 streamCfg = opts.StreamConfig
 }
 
-return &Protocol{
+p := &Protocol{
 conn:          conn,
 opts:          opts,
 nextID:        1,
 streamConfig:  streamCfg,
+vectored:      supportsVectoredWrite(conn),
 activeStreams: make(map[uint32]*streamAssembler),
+resumeWaiters: make(map[uint32]chan []byte),
+sending:       make(map[uint32]*streamCanceler),
+channels:      make(map[uint32]*Channel),
+pendingCredit: make(map[uint32]int64),
+closingIDs:    make(map[uint32]struct{}),
+calls:         make(map[uint32]*Call),
+peerCalls:     make(map[uint32]*Call),
+callContext:   context.Background(),
 }
+p.scheduler = newStreamScheduler(p)
+p.limiter.Store(newRateLimiter(streamCfg.RateLimit, streamCfg.ChunkSize))
+if opts != nil && opts.AsyncWrite != nil {
+p.async = newAsyncWriter(conn, opts.AsyncWrite)
+}
+return p
 }
 
 // NextMessageID returns the next message ID and increments the counter
@@ -312,51 +417,167 @@ func (p *Protocol) NextMessageID() uint32 {
 p.idMu.Lock()
 defer p.idMu.Unlock()
 id := p.nextID
-p.nextID++
+// IDs stay below replyFlag, which marks replies (see Client.Reply)
+p.nextID = max((p.nextID+1)&^replyFlag, 1)
 return id
 }
 
 // SendMessage serializes and sends a message over the connection
 // Automatically uses streaming for large payloads
 func (p *Protocol) SendMessage(messageType byte, messageID uint32, payload interface{}) error {
-// Serialize payload first to check size
-payloadBytes, err := MarshalPayload(payload)
+return p.sendMessage(messageType, messageID, payload, 1)
+}
+
+// SendMessageWeighted sends a message like SendMessage. If the payload is streamed,
+// its chunks are sent weight chunks per turn while other streams are active, so a
+// stream with weight 3 gets three times the bandwidth of a stream with weight 1.
+// Weights below 1 count as 1. Has no effect with StreamConfig.Sequential.
+func (p *Protocol) SendMessageWeighted(messageType byte, messageID uint32, payload interface{}, weight int) error {
+return p.sendMessage(messageType, messageID, payload, weight)
+}
+
+// sendMessage encodes and sends a message, streaming large payloads with the given weight
+func (p *Protocol) sendMessage(messageType byte, messageID uint32, payload interface{}, weight int) error {
+if b, ok := payload.([]byte); ok {
+// Raw bytes need no encoding, so decide on streaming without copying them
+if p.streamConfig.Enabled && len(b) >= p.streamConfig.Threshold {
+return p.sendStreamed(messageType, messageID, b, nil, weight)
+}
+return p.sendDirect(messageType, messageID, b)
+}
+
+bufp := getFrameBuffer()
+defer putFrameBuffer(bufp)
+
+// Encode the payload once, directly after room for the length prefix and header
+frame, err := appendHeaderAndPayload(append(*bufp, 0, 0, 0, 0), messageType, messageID, payload)
 if err != nil {
 return err
 }
+*bufp = frame[:0]
 
 // Check if streaming is needed
+payloadBytes := frame[frameLengthSize+HeaderSize:]
 if p.streamConfig.Enabled && len(payloadBytes) >= p.streamConfig.Threshold {
-return p.sendStreamed(messageType, messageID, payloadBytes)
+return p.sendStreamed(messageType, messageID, payloadBytes, frame[frameLengthSize:], weight)
 }
 
-return p.sendDirect(messageType, messageID, payload)
+return p.finishFrame(bufp, frame)
 }
 
 // sendDirect sends a message without streaming
 func (p *Protocol) sendDirect(messageType byte, messageID uint32, payload interface{}) error {
-data, err := MarshalMessage(messageType, messageID, payload, p.opts)
+bufp := getFrameBuffer()
+defer putFrameBuffer(bufp)
+
+if sent, err := p.sendVectored(bufp, messageType, messageID, payload); sent {
+return err
+}
+
+frame, err := appendHeaderAndPayload(append(*bufp, 0, 0, 0, 0), messageType, messageID, payload)
 if err != nil {
 return err
 }
+return p.finishFrame(bufp, frame)
+}
 
-p.mu.Lock()
-defer p.mu.Unlock()
+// finishFrame signs a frame holding the length prefix, header and payload,
+// fills in the length prefix and writes the frame with a single Write call
+func (p *Protocol) finishFrame(bufp *[]byte, frame []byte) error {
+frame, err := appendSignature(frame, frameLengthSize, p.opts)
+if err != nil {
+return err
+}
+*bufp = frame[:0]
+
+// Message length first (for framing)
+binary.BigEndian.PutUint32(frame, uint32(len(frame)-frameLengthSize))
+return p.writeFrames(bufp, frame)
+}
+
+// writeFrames writes one or more complete frames held in *bufp with a single Write
+// call, or hands them to the async writer as one unit
+func (p *Protocol) writeFrames(bufp *[]byte, frames []byte) error {
+if p.async != nil {
+// Hand the frames to the writer and leave the caller an empty buffer to return
+queued := getFrameBuffer()
+*queued, *bufp = frames, (*queued)[:0]
+return p.async.enqueue(queued, nil)
+}
 
-// Write message length first (for framing)
-lenBuf := make([]byte, 4)
-binary.BigEndian.PutUint32(lenBuf, uint32(len(data)))
-if _, err := p.conn.Write(lenBuf); err != nil {
+p.lockWrite()
+defer p.unlockWrite()
+_, err := p.conn.Write(frames)
 return err
 }
 
-// Write message data
-_, err = p.conn.Write(data)
+// lockWrite acquires the write lock, counting the caller as a direct writer
+// so the stream scheduler lets it go ahead of the next chunk
+func (p *Protocol) lockWrite() {
+p.directWriters.Add(1)
+p.mu.Lock()
+}
+
+// unlockWrite releases the write lock taken by lockWrite
+func (p *Protocol) unlockWrite() {
+p.mu.Unlock()
+p.directWriters.Add(-1)
+}
+
+// frameLengthSize is the size of the length prefix in front of every message on a connection
+const frameLengthSize = 4
+
+// maxPooledFrame is the largest frame buffer kept in framePool (matches PutBuffer)
+const maxPooledFrame = 64 * 1024
+
+// framePool holds buffers used to encode outgoing frames
+var framePool = sync.Pool{
+New: func() interface{} {
+b := make([]byte, 0, 1024)
+return &b
+},
+}
+
+// getFrameBuffer gets an empty frame buffer from the pool
+func getFrameBuffer() *[]byte {
+bufp := framePool.Get().(*[]byte)
+*bufp = (*bufp)[:0]
+return bufp
+}
+
+// putFrameBuffer returns a frame buffer to the pool
+func putFrameBuffer(bufp *[]byte) {
+if cap(*bufp) <= maxPooledFrame {
+framePool.Put(bufp)
+}
+}
+
+// sendStreamed sends a large payload as multiple chunks. Unless StreamConfig.Sequential
+// is set, the chunks are interleaved with other streams and direct messages by the
+// stream scheduler.
+//
+// With a Signer, the stream end marker carries a signature of the whole message
+// (header + payload), exactly as if it had been sent directly. headed holds the
+// header followed by payloadBytes when the caller has it, saving a copy.
+// With StreamConfig.Integrity, the stream header carries the payload's digest.
+// A stream canceled with CancelStream or rejected by the receiver stops before its
+// next chunk and returns a *CancelError.
+func (p *Protocol) sendStreamed(messageType byte, messageID uint32, payloadBytes []byte, headed []byte, weight int) error {
+end := []byte{}
+if p.opts != nil && p.opts.Signer != nil {
+if headed == nil {
+var err error
+if headed, err = appendHeaderAndPayload(nil, messageType, messageID, payloadBytes); err != nil {
 return err
 }
+}
+signature, err := p.opts.Signer.Sign(headed)
+if err != nil {
+return err
+}
+end = signature
+}
 
-// sendStreamed sends a large payload as multiple chunks
-func (p *Protocol) sendStreamed(messageType byte, messageID uint32, payloadBytes []byte) error {
 chunkSize := p.streamConfig.ChunkSize
 totalSize := uint64(len(payloadBytes))
 totalChunks := uint32((len(payloadBytes) + chunkSize - 1) / chunkSize)
@@ -367,29 +588,42 @@ OriginalType: messageType,
 TotalSize:    totalSize,
 TotalChunks:  totalChunks,
 }
+if p.streamConfig.Integrity {
+header.Digest = payloadDigest(payloadBytes)
+}
+canceler := p.trackSending(messageID)
+defer p.untrackSending(messageID, canceler)
 if err := p.sendDirect(MessageTypeStreamStart, messageID, header); err != nil {
 return err
 }
 
+if !p.streamConfig.Sequential {
+return p.scheduler.send(messageID, header, payloadBytes, chunkSize, weight, end, canceler)
+}
+
 // Send chunks
 for i := uint32(0); i < totalChunks; i++ {
-start := int(i) * chunkSize
-end := start + chunkSize
-if end > len(payloadBytes) {
-end = len(payloadBytes)
+if canceler.canceled() != nil {
+return p.stopSending(messageID, canceler)
 }
+start := int(i) * chunkSize
+stop := min(start+chunkSize, len(payloadBytes))
 
+if err := p.limiter.Load().wait(context.Background(), stop-start); err != nil {
+return err
+}
 chunk := &StreamChunk{
 ChunkIndex: i,
-Data:       payloadBytes[start:end],
+Data:       payloadBytes[start:stop],
 }
 if err := p.sendDirect(MessageTypeStreamChunk, messageID, chunk); err != nil {
 return err
 }
+p.reportSent(messageID, header, uint64(stop), i+1)
 }
 
 // Send stream end marker
-if err := p.sendDirect(MessageTypeStreamEnd, messageID, []byte{}); err != nil {
+if err := p.sendDirect(MessageTypeStreamEnd, messageID, end); err != nil {
 return err
 }
 
@@ -398,71 +632,95 @@ return nil
 
 // ReceiveMessage reads and deserializes a message from the connection
 // Automatically reassembles streamed messages
+// A streamed message that cannot be reassembled is reported as a *StreamError;
+// the connection remains usable and the next call continues with the next message.
+// An error frame from the peer (see SendError) is reported as a *RemoteError the same way.
 func (p *Protocol) ReceiveMessage() (*Message, interface{}, error) {
 for {
+// Report streams that expired while waiting
+if err := p.takeStreamError(); err != nil {
+return nil, nil, err
+}
+
 msg, payload, err := p.receiveRaw()
+if err == errWake {
+// Interrupted between frames to report an expired stream
+continue
+}
 if err != nil {
 return nil, nil, err
 }
 
 // Handle streaming messages internally
+var assembled *Message
 switch msg.Type {
 case MessageTypeStreamStart:
 header := payload.(*StreamHeader)
-p.startStream(msg.ID, header)
-continue
-
-case MessageTypeStreamChunk:
-chunk := payload.(*StreamChunk)
-complete, assembledPayload := p.addChunk(msg.ID, chunk)
-if complete {
-// Stream complete, unmarshal the assembled payload
-p.streamMu.Lock()
-assembler := p.activeStreams[msg.ID]
-originalType := assembler.header.OriginalType
-delete(p.activeStreams, msg.ID)
-p.streamMu.Unlock()
-
-payloadObj, err := UnmarshalPayload(originalType, assembledPayload)
+msg.Release()
+held, err := p.startStream(msg.ID, header)
 if err != nil {
+p.rejectFailed(err)
+return nil, nil, err
+}
+if held != nil {
+// Tell the sender of a resumable stream which chunks to skip
+if err := p.sendDirect(MessageTypeStreamResume, msg.ID, held); err != nil {
 return nil, nil, err
 }
-
-return &Message{
-Type:    originalType,
-ID:      msg.ID,
-Payload: assembledPayload,
-}, payloadObj, nil
 }
 continue
 
-case MessageTypeStreamEnd:
-// Stream end marker - check if we have all chunks
-p.streamMu.Lock()
-assembler, exists := p.activeStreams[msg.ID]
-if exists && assembler.received == assembler.header.TotalChunks {
-originalType := assembler.header.OriginalType
-assembledPayload := p.assembleStream(assembler)
-delete(p.activeStreams, msg.ID)
-p.streamMu.Unlock()
-
-payloadObj, err := UnmarshalPayload(originalType, assembledPayload)
+case MessageTypeStreamResume:
+p.deliverResume(msg.ID, msg.Payload)
+msg.Release()
+continue
+
+case MessageTypeStreamCancel:
+err := p.receiveCancel(msg.ID, payload.(*StreamCancel))
+msg.Release()
 if err != nil {
 return nil, nil, err
 }
+continue
 
-return &Message{
-Type:    originalType,
-ID:      msg.ID,
-Payload: assembledPayload,
-}, payloadObj, nil
+case MessageTypeExtension:
+if status, ok := payload.(*StatusError); ok {
+msg.Release()
+return nil, nil, &RemoteError{ID: msg.ID, Err: status}
+}
+if err := p.receiveExtension(msg); err != nil {
+return nil, nil, err
 }
-p.streamMu.Unlock()
 continue
 
+case MessageTypeStreamChunk:
+chunk := payload.(*StreamChunk)
+if assembled, err = p.addChunk(msg, chunk); err != nil {
+p.rejectFailed(err)
+}
+
+case MessageTypeStreamEnd:
+// The end marker carries the whole-payload signature of signed streams
+assembled, err = p.endStream(msg.ID, msg.Payload)
+msg.Release()
+
 default:
 return msg, payload, nil
 }
+
+if err != nil {
+return nil, nil, err
+}
+if assembled == nil {
+continue
+}
+
+// Stream complete, decode the assembled payload like a direct message
+payloadObj, err := decodePayload(assembled.Type, assembled.Payload, p.opts)
+if err != nil {
+return nil, nil, err
+}
+return assembled, payloadObj, nil
 }
 }
 
@@ -472,66 +730,63 @@ p.readMu.Lock()
 defer p.readMu.Unlock()
 
 // Read message length
-lenBuf := make([]byte, 4)
-if _, err := io.ReadFull(p.conn, lenBuf); err != nil {
+if err := p.readFull(p.lenBuf[:], true); err != nil {
 return nil, nil, err
 }
-msgLen := binary.BigEndian.Uint32(lenBuf)
+msgLen := binary.BigEndian.Uint32(p.lenBuf[:])
 
 if msgLen > MaxPayloadSize+HeaderSize+SignatureLengthSize+1024 {
 return nil, nil, ErrPayloadTooLarge
 }
 
-// Read message data
+// Read message data. The frame belongs to this message alone, so the
+// payload can alias it instead of being copied again.
+if p.opts == nil || !p.opts.PooledBuffers {
 data := make([]byte, msgLen)
-if _, err := io.ReadFull(p.conn, data); err != nil {
+if err := p.readFull(data, false); err != nil {
 return nil, nil, err
 }
-
-return UnmarshalMessage(data, p.opts)
+return unmarshalMessage(data, p.opts, false)
 }
 
-// startStream initializes a new stream assembler
-func (p *Protocol) startStream(msgID uint32, header *StreamHeader) {
-p.streamMu.Lock()
-defer p.streamMu.Unlock()
-
-p.activeStreams[msgID] = &streamAssembler{
-header:   header,
-chunks:   make(map[uint32][]byte),
-received: 0,
+data, bufp := getRecvBuffer(int(msgLen))
+if err := p.readFull(data, false); err != nil {
+if bufp != nil {
+putRecvBuffer(bufp)
+}
+return nil, nil, err
 }
+msg, payload, err := unmarshalMessage(data, p.opts, false)
+if err != nil {
+if bufp != nil {
+putRecvBuffer(bufp)
 }
-
-// addChunk adds a chunk to a stream and returns true if complete
-func (p *Protocol) addChunk(msgID uint32, chunk *StreamChunk) (bool, []byte) {
-p.streamMu.Lock()
-defer p.streamMu.Unlock()
-
-assembler, exists := p.activeStreams[msgID]
-if !exists {
-return false, nil
+return nil, nil, err
 }
-
-// Store chunk
-assembler.chunks[chunk.ChunkIndex] = chunk.Data
-assembler.received++
-
-// Check if complete
-if assembler.received == assembler.header.TotalChunks {
-return true, p.assembleStream(assembler)
+msg.pooled = bufp
+return msg, payload, nil
 }
 
-return false, nil
+// readFull reads len(b) bytes like io.ReadFull. A wake-up (see wakeReceiver) at the
+// start of a frame returns errWake; inside a frame, the read just goes on.
+func (p *Protocol) readFull(b []byte, frameStart bool) error {
+n := 0
+for n < len(b) {
+m, err := p.conn.Read(b[n:])
+n += m
+switch {
+case err == nil || n == len(b):
+case p.woken(err):
+if frameStart && n == 0 {
+return errWake
+}
+case err == io.EOF && n > 0:
+return io.ErrUnexpectedEOF
+default:
+return err
 }
-
-// assembleStream combines all chunks into the final payload
-func (p *Protocol) assembleStream(assembler *streamAssembler) []byte {
-result := make([]byte, 0, assembler.header.TotalSize)
-for i := uint32(0); i < assembler.header.TotalChunks; i++ {
-result = append(result, assembler.chunks[i]...)
 }
-return result
+return nil
 }
 
 // Send is a convenience method that sends a message with auto-generated ID
@@ -541,18 +796,49 @@ return id, p.SendMessage(messageType, id, payload)
 }
 
 // Close closes the underlying connection
+// With AsyncWrite, frames still queued are discarded; call Flush first to write them.
 func (p *Protocol) Close() error {
+p.discardStreams()
+p.closeChannels()
+p.endCalls(ErrClosed)
+if p.async == nil {
 return p.conn.Close()
 }
+p.async.close()
+err := p.conn.Close()
+<-p.async.done
+return err
+}
+
+// Flush waits until every message sent so far has been written to the connection
+// and returns the first write error, if any. Without AsyncWrite, messages are written
+// before Send returns and Flush returns nil.
+func (p *Protocol) Flush() error {
+if p.async == nil {
+return nil
+}
+return p.async.flush()
+}
+
+// SendMessageSync sends a message like SendMessage and, with AsyncWrite, waits until
+// it has been written so write errors are reported immediately
+func (p *Protocol) SendMessageSync(messageType byte, messageID uint32, payload interface{}) error {
+if err := p.SendMessage(messageType, messageID, payload); err != nil {
+return err
+}
+return p.Flush()
+}
 
 // SendRaw sends raw bytes with a custom message type
 func (p *Protocol) SendRaw(messageType byte, data []byte) (uint32, error) {
 return p.Send(messageType, data)
 }
 
-// SetStreamConfig updates the streaming configuration
+// SetStreamConfig updates the streaming configuration. A new RateLimit applies to
+// chunks sent from then on, with a fresh allowance.
 func (p *Protocol) SetStreamConfig(config *StreamConfig) {
 p.streamConfig = config
+p.limiter.Store(newRateLimiter(config.RateLimit, config.ChunkSize))
 }
 
 // GetStreamConfig returns the current streaming configuration
@@ -0,0 +1,174 @@
+package rdgproto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrUnregisteredType = errors.New("handler registered for message type without payload registration")
+)
+
+// HandlerFunc handles a single routed message.
+// The context carries the receiving Client when the mux is bound to one (see ClientFromContext).
+type HandlerFunc func(ctx context.Context, msg *Message, payload interface{}) error
+
+// clientContextKey is the context key for the Client a message arrived on
+type clientContextKey struct{}
+
+// ClientFromContext returns the Client that received the message being handled
+func ClientFromContext(ctx context.Context) (*Client, bool) {
+	c, ok := ctx.Value(clientContextKey{}).(*Client)
+	return c, ok
+}
+
+// ServeMux routes incoming messages to handlers registered per message type
+//
+// Example:
+//
+//	mux := rdgproto.NewServeMux()
+//	mux.Handle(MsgTypeLogin, func(ctx context.Context, msg *rdgproto.Message, payload interface{}) error {
+//	    client, _ := rdgproto.ClientFromContext(ctx)
+//	    return client.Reply(msg, MsgTypeResponse, &ResponsePayload{Success: true})
+//	})
+//	server.SetConnectionHandler(mux.ServeClient)
+type ServeMux struct {
+	mu       sync.RWMutex
+	handlers map[byte]HandlerFunc
+	fallback HandlerFunc
+	calls    map[byte]CallHandler
+}
+
+// NewServeMux creates an empty message router
+func NewServeMux() *ServeMux {
+	return &ServeMux{
+		handlers: make(map[byte]HandlerFunc),
+		calls:    make(map[byte]CallHandler),
+	}
+}
+
+// Handle registers the handler for a message type, replacing any existing one.
+// Reserved types are ignored, as by PayloadRegistry.Register.
+func (m *ServeMux) Handle(messageType byte, handler HandlerFunc) {
+	if IsReservedType(messageType) {
+		return // Reserved types are handled by the protocol itself
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[messageType] = handler
+}
+
+// HandleFallback registers the handler for message types with no specific handler.
+// Without a fallback, such messages are dropped.
+func (m *ServeMux) HandleFallback(handler HandlerFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fallback = handler
+}
+
+// HandleCall registers the handler for streaming calls opened with method,
+// replacing any existing one
+func (m *ServeMux) HandleCall(method byte, handler CallHandler) {
+	if IsReservedType(method) {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls[method] = handler
+}
+
+// ServeCall implements CallHandler, routing a call to the handler registered for
+// its method. Calls without one end with StatusUnimplemented.
+func (m *ServeMux) ServeCall(call *Call) error {
+	m.mu.RLock()
+	handler := m.calls[call.Method()]
+	m.mu.RUnlock()
+	if handler == nil {
+		return &StatusError{Code: StatusUnimplemented, Message: fmt.Sprintf("no handler for method %d", call.Method())}
+	}
+	return handler(call)
+}
+
+// Remove unregisters the handler for a message type
+func (m *ServeMux) Remove(messageType byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.handlers, messageType)
+}
+
+// Handler returns the handler that would be used for a message type, or nil
+func (m *ServeMux) Handler(messageType byte) HandlerFunc {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if h, ok := m.handlers[messageType]; ok {
+		return h
+	}
+	return m.fallback
+}
+
+// Types returns the message types with a registered handler in ascending order
+func (m *ServeMux) Types() []byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	types := make([]byte, 0, len(m.handlers))
+	for t := range m.handlers {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// Validate reports handlers registered for message types that have no payload factory.
+// Such handlers would only ever receive raw bytes (or nothing at all in strict mode).
+// A nil registry checks against the global registry.
+func (m *ServeMux) Validate(registry *PayloadRegistry) error {
+	if registry == nil {
+		registry = globalRegistry
+	}
+	var missing []byte
+	for _, t := range m.Types() {
+		if !registry.Has(t) {
+			missing = append(missing, t)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %v", ErrUnregisteredType, missing)
+	}
+	return nil
+}
+
+// Dispatch routes a message to its handler using the given context
+func (m *ServeMux) Dispatch(ctx context.Context, msg *Message, payload interface{}) error {
+	handler := m.Handler(msg.Type)
+	if handler == nil {
+		return nil
+	}
+	return handler(ctx, msg, payload)
+}
+
+// HandleMessage implements MessageHandler so the mux can be passed to Client.SetHandler.
+// Handlers invoked this way receive a context without a Client; use Bind to attach one.
+func (m *ServeMux) HandleMessage(msg *Message, payload interface{}) error {
+	return m.Dispatch(context.Background(), msg, payload)
+}
+
+// Bind returns a MessageHandler that dispatches with the client available via ClientFromContext
+func (m *ServeMux) Bind(client *Client) MessageHandler {
+	ctx := context.WithValue(context.Background(), clientContextKey{}, client)
+	return func(msg *Message, payload interface{}) error {
+		return m.Dispatch(ctx, msg, payload)
+	}
+}
+
+// ServeClient implements ConnectionHandler so the mux can be passed to Server.SetConnectionHandler.
+// It binds the mux to the client, serves calls with ServeCall, starts the client and
+// blocks until it stops.
+func (m *ServeMux) ServeClient(client *Client) {
+	client.SetHandler(m.Bind(client))
+	client.SetCallHandler(m.ServeCall)
+	client.Start()
+	<-client.Done()
+}
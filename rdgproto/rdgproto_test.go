@@ -2,9 +2,19 @@ package rdgproto
 
 import (
 "bytes"
+"context"
 "encoding/binary"
+"errors"
+"fmt"
+"io"
+"math"
 "net"
+"reflect"
+"slices"
+"strings"
+"sync"
 "testing"
+"time"
 )
 
 // =========================================================================
@@ -713,44 +723,3221 @@ t.Errorf("TotalSize mismatch: got %d, want %d", decoded.TotalSize, original.Tota
 if decoded.TotalChunks != original.TotalChunks {
 t.Errorf("TotalChunks mismatch: got %d, want %d", decoded.TotalChunks, original.TotalChunks)
 }
+
+// Resumable streams add trailing fields that older decoders skip
+original.ChunkSize = 65536
+original.Token = "upload-1"
+data, _ = original.Marshal()
+if len(data) != original.Size() {
+t.Errorf("Size mismatch: got %d, want %d", original.Size(), len(data))
+}
+decoded = &StreamHeader{}
+if err := decoded.Unmarshal(data); err != nil || !reflect.DeepEqual(decoded, original) {
+t.Errorf("Resumable header mismatch: got %+v, %v", decoded, err)
+}
+
+// Integrity-checked streams add the digest, with or without a token
+original.Token = ""
+original.Digest = payloadDigest([]byte("payload"))
+data, _ = original.Marshal()
+if len(data) != original.Size() {
+t.Errorf("Size mismatch: got %d, want %d", original.Size(), len(data))
+}
+decoded = &StreamHeader{}
+if err := decoded.Unmarshal(data); err != nil || !reflect.DeepEqual(decoded, original) {
+t.Errorf("Digest header mismatch: got %+v, %v", decoded, err)
+}
+}
+
+func TestStreamChunk(t *testing.T) {
+original := &StreamChunk{
+ChunkIndex: 42,
+Data:       []byte{0xDE, 0xAD, 0xBE, 0xEF},
+}
+
+data, err := original.Marshal()
+if err != nil {
+t.Fatalf("Marshal failed: %v", err)
+}
+
+decoded := &StreamChunk{}
+if err := decoded.Unmarshal(data); err != nil {
+t.Fatalf("Unmarshal failed: %v", err)
+}
+
+if decoded.ChunkIndex != original.ChunkIndex {
+t.Errorf("ChunkIndex mismatch: got %d, want %d", decoded.ChunkIndex, original.ChunkIndex)
+}
+if !bytes.Equal(decoded.Data, original.Data) {
+t.Errorf("Data mismatch: got %v, want %v", decoded.Data, original.Data)
+}
+}
+
+func TestIsReservedType(t *testing.T) {
+if IsReservedType(1) {
+t.Error("Type 1 should not be reserved")
+}
+if IsReservedType(249) {
+t.Error("Type 249 should not be reserved")
+}
+if !IsReservedType(250) {
+t.Error("Type 250 should be reserved")
+}
+if !IsReservedType(255) {
+t.Error("Type 255 should be reserved")
+}
+}
+
+// newClientPair connects two started clients over loopback TCP
+func newClientPair(t *testing.T, opts *MessageOptions, serverHandler MessageHandler, clientHandler MessageHandler) (*Client, *Client) {
+t.Helper()
+listener, err := net.Listen("tcp", "127.0.0.1:0")
+if err != nil {
+t.Fatalf("Failed to create listener: %v", err)
+}
+defer listener.Close()
+
+accepted := make(chan net.Conn, 1)
+go func() {
+conn, err := listener.Accept()
+if err != nil {
+accepted <- nil
+return
+}
+accepted <- conn
+}()
+
+clientConn, err := net.Dial("tcp", listener.Addr().String())
+if err != nil {
+t.Fatalf("Failed to connect: %v", err)
+}
+serverConn := <-accepted
+if serverConn == nil {
+t.Fatal("Accept failed")
+}
+
+server := NewClient(serverConn, opts)
+client := NewClient(clientConn, opts)
+if serverHandler != nil {
+server.SetHandler(serverHandler)
+}
+if clientHandler != nil {
+client.SetHandler(clientHandler)
+}
+server.Start()
+client.Start()
+t.Cleanup(func() {
+client.Close()
+server.Close()
+})
+return server, client
+}
+
+func TestClientCall(t *testing.T) {
+var server *Client
+unsolicited := make(chan *Message, 1)
+server, client := newClientPair(t, nil, func(msg *Message, payload interface{}) error {
+login := payload.(*LoginPayload)
+// A message that only shares the request's ID is not the reply
+if err := server.SendWithID(MsgTypeResponse, msg.ID, &ResponsePayload{Message: "not a reply"}); err != nil {
+return err
+}
+return server.Reply(msg, MsgTypeResponse, &ResponsePayload{
+Success: true,
+Message: "hello " + login.Username,
+})
+}, func(msg *Message, payload interface{}) error {
+unsolicited <- msg
+return nil
+})
+
+ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+defer cancel()
+
+msg, payload, err := client.Call(ctx, MsgTypeLogin, &LoginPayload{Username: "alice"})
+if err != nil {
+t.Fatalf("Call failed: %v", err)
+}
+if msg.Type != MsgTypeResponse {
+t.Errorf("Type mismatch: got %d, want %d", msg.Type, MsgTypeResponse)
+}
+resp, ok := payload.(*ResponsePayload)
+if !ok {
+t.Fatalf("Payload type assertion failed, got %T", payload)
+}
+if resp.Message != "hello alice" {
+t.Errorf("Message mismatch: got %s, want hello alice", resp.Message)
+}
+if client.PendingCalls() != 0 {
+t.Errorf("Expected no pending calls, got %d", client.PendingCalls())
+}
+select {
+case got := <-unsolicited:
+if got.ID != msg.ID {
+t.Errorf("ID mismatch: got %d, want %d", got.ID, msg.ID)
+}
+case <-time.After(5 * time.Second):
+t.Fatal("Message sharing the request's ID was not delivered to the handler")
+}
+
+// Messages with no pending call still reach the handler
+if err := server.SendWithID(MsgTypeResponse, 9999, &ResponsePayload{Message: "push"}); err != nil {
+t.Fatalf("SendWithID failed: %v", err)
+}
+select {
+case msg := <-unsolicited:
+if msg.ID != 9999 {
+t.Errorf("ID mismatch: got %d, want 9999", msg.ID)
+}
+case <-time.After(5 * time.Second):
+t.Fatal("Unsolicited message was not delivered to handler")
+}
+}
+
+func TestClientCallContextCanceled(t *testing.T) {
+_, client := newClientPair(t, nil, func(msg *Message, payload interface{}) error {
+return nil // never reply
+}, nil)
+
+ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+defer cancel()
+
+_, _, err := client.Call(ctx, MsgTypeLogin, &LoginPayload{Username: "bob"})
+if !errors.Is(err, context.DeadlineExceeded) {
+t.Fatalf("Expected context.DeadlineExceeded, got: %v", err)
+}
+if client.PendingCalls() != 0 {
+t.Errorf("Expected pending call to be removed, got %d", client.PendingCalls())
+}
+}
+
+func TestClientCallFailsOnDisconnect(t *testing.T) {
+received := make(chan struct{}, 1)
+server, client := newClientPair(t, nil, func(msg *Message, payload interface{}) error {
+received <- struct{}{}
+return nil
+}, nil)
+
+errc := make(chan error, 1)
+go func() {
+_, _, err := client.Call(context.Background(), MsgTypeLogin, &LoginPayload{Username: "carol"})
+errc <- err
+}()
+
+<-received
+server.Close()
+
+select {
+case err := <-errc:
+if err == nil {
+t.Fatal("Expected error after disconnect, got nil")
+}
+case <-time.After(5 * time.Second):
+t.Fatal("Pending call was not released after disconnect")
+}
+
+if _, _, err := client.Call(context.Background(), MsgTypeLogin, &LoginPayload{}); err == nil {
+t.Error("Expected Call on stopped client to fail")
+}
+}
+
+func TestServeMuxRouting(t *testing.T) {
+mux := NewServeMux()
+var got []byte
+mux.Handle(MsgTypeLogin, func(ctx context.Context, msg *Message, payload interface{}) error {
+got = append(got, msg.Type)
+return nil
+})
+mux.Handle(MsgTypeResponse, func(ctx context.Context, msg *Message, payload interface{}) error {
+got = append(got, msg.Type)
+return nil
+})
+
+// Unknown types are dropped without a fallback
+if err := mux.HandleMessage(&Message{Type: 200}, nil); err != nil {
+t.Fatalf("Expected unknown type to be dropped, got: %v", err)
+}
+
+errFallback := errors.New("unhandled")
+mux.HandleFallback(func(ctx context.Context, msg *Message, payload interface{}) error {
+return errFallback
+})
+
+mux.HandleMessage(&Message{Type: MsgTypeResponse}, nil)
+mux.HandleMessage(&Message{Type: MsgTypeLogin}, nil)
+if !bytes.Equal(got, []byte{MsgTypeResponse, MsgTypeLogin}) {
+t.Errorf("Routing mismatch: got %v", got)
+}
+if err := mux.HandleMessage(&Message{Type: 200}, nil); err != errFallback {
+t.Errorf("Expected fallback error, got: %v", err)
+}
+
+// Reserved types are handled by the protocol, so registering them has no effect
+mux.Handle(MessageTypeStreamStart, func(ctx context.Context, msg *Message, payload interface{}) error { return nil })
+if slices.Contains(mux.Types(), MessageTypeStreamStart) {
+t.Error("Expected a reserved type to be ignored")
+}
+}
+
+func TestServeMuxValidate(t *testing.T) {
+mux := NewServeMux()
+noop := func(ctx context.Context, msg *Message, payload interface{}) error { return nil }
+mux.Handle(MsgTypeLogin, noop)
+if err := mux.Validate(nil); err != nil {
+t.Fatalf("Validate failed for registered type: %v", err)
+}
+
+mux.Handle(201, noop)
+if err := mux.Validate(nil); !errors.Is(err, ErrUnregisteredType) {
+t.Errorf("Expected ErrUnregisteredType, got: %v", err)
+}
+
+registry := NewPayloadRegistry()
+registry.Register(201, func() PayloadUnmarshaler { return &LoginPayload{} })
+if err := mux.Validate(registry); !errors.Is(err, ErrUnregisteredType) {
+t.Errorf("Expected MsgTypeLogin to be missing from custom registry, got: %v", err)
+}
+}
+
+func TestServeMuxServeClient(t *testing.T) {
+listener, err := net.Listen("tcp", "127.0.0.1:0")
+if err != nil {
+t.Fatalf("Failed to create listener: %v", err)
+}
+
+mux := NewServeMux()
+mux.Handle(MsgTypeLogin, func(ctx context.Context, msg *Message, payload interface{}) error {
+client, ok := ClientFromContext(ctx)
+if !ok {
+return errors.New("missing client in context")
+}
+login := payload.(*LoginPayload)
+return client.Reply(msg, MsgTypeResponse, &ResponsePayload{Success: true, Message: login.Username})
+})
+handled := make(chan struct{}, 1)
+mux.Handle(MsgTypeData, func(ctx context.Context, msg *Message, payload interface{}) error {
+handled <- struct{}{}
+return errors.New("rejected")
+})
+
+server := NewServer(listener, nil)
+server.SetConnectionHandler(mux.ServeClient)
+server.StartAsync()
+defer server.Stop()
+
+conn, err := net.Dial("tcp", listener.Addr().String())
+if err != nil {
+t.Fatalf("Failed to connect: %v", err)
+}
+client := NewClient(conn, nil)
+client.Start()
+defer client.Close()
+
+ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+defer cancel()
+_, payload, err := client.Call(ctx, MsgTypeLogin, &LoginPayload{Username: "dave"})
+if err != nil {
+t.Fatalf("Call failed: %v", err)
+}
+if resp := payload.(*ResponsePayload); resp.Message != "dave" {
+t.Errorf("Message mismatch: got %s, want dave", resp.Message)
+}
+
+// A handler error doesn't end the served connection
+if _, err := client.Send(MsgTypeData, &DataPayload{ID: "x"}); err != nil {
+t.Fatalf("Send failed: %v", err)
+}
+<-handled
+if _, _, err := client.Call(ctx, MsgTypeLogin, &LoginPayload{Username: "erin"}); err != nil {
+t.Fatalf("Call after a handler error failed: %v", err)
+}
+select {
+case <-client.Done():
+t.Fatal("Client stopped after an error frame")
+default:
+}
+}
+
+func TestRegisterTyped(t *testing.T) {
+registry := NewPayloadRegistry()
+RegisterWith[LoginPayload](registry, 210)
+
+opts := &MessageOptions{Registry: registry, StrictMode: true}
+data, err := MarshalMessage(210, 1, &LoginPayload{Username: "erin"}, nil)
+if err != nil {
+t.Fatalf("MarshalMessage failed: %v", err)
+}
+_, payload, err := UnmarshalMessage(data, opts)
+if err != nil {
+t.Fatalf("UnmarshalMessage failed: %v", err)
+}
+if login, ok := payload.(*LoginPayload); !ok || login.Username != "erin" {
+t.Errorf("Unexpected payload: %#v", payload)
+}
+
+Register[ResponsePayload](211)
+defer UnregisterPayloadType(211)
+if !HasPayloadType(211) {
+t.Error("Expected type 211 to be registered globally")
+}
+}
+
+func TestHandleTyped(t *testing.T) {
+mux := NewServeMux()
+var got string
+HandleTyped(mux, MsgTypeLogin, func(ctx context.Context, msg *Message, login *LoginPayload) error {
+got = login.Username
+return nil
+})
+
+if err := mux.HandleMessage(&Message{Type: MsgTypeLogin}, &LoginPayload{Username: "frank"}); err != nil {
+t.Fatalf("Typed handler failed: %v", err)
+}
+if got != "frank" {
+t.Errorf("Username mismatch: got %s, want frank", got)
+}
+
+// Raw bytes are decoded into the handler's type
+raw, _ := (&LoginPayload{Username: "grace"}).Marshal()
+if err := mux.HandleMessage(&Message{Type: MsgTypeLogin}, raw); err != nil {
+t.Fatalf("Typed handler failed on raw bytes: %v", err)
+}
+if got != "grace" {
+t.Errorf("Username mismatch: got %s, want grace", got)
+}
+
+err := mux.HandleMessage(&Message{Type: MsgTypeLogin}, &ResponsePayload{})
+if !errors.Is(err, ErrPayloadTypeMismatch) {
+t.Errorf("Expected ErrPayloadTypeMismatch, got: %v", err)
+}
+}
+
+// codecInner is a nested struct used by the struct codec tests
+type codecInner struct {
+Label string `rdg:"1"`
+Score int32  `rdg:"2"`
+}
+
+// codecPayload exercises every struct codec field kind
+type codecPayload struct {
+Name     string            `rdg:"2"`
+ID       uint64            `rdg:"1"`
+Offset   int64             `rdg:"3"`
+Counter  uint32            `rdg:"4,fixed"`
+Delta    int64             `rdg:"5,fixed"`
+Ratio    float64           `rdg:"6"`
+Enabled  bool              `rdg:"7"`
+Raw      []byte            `rdg:"8"`
+Tags     []string          `rdg:"9"`
+Inner    codecInner        `rdg:"10"`
+Children []codecInner      `rdg:"11"`
+Attrs    map[string]uint32 `rdg:"12"`
+Parent   *codecInner       `rdg:"13"`
+Missing  *codecInner       `rdg:"14"`
+Hash     [4]byte           `rdg:"15"`
+Ignored  string
+}
+
+func TestStructCodecRoundTrip(t *testing.T) {
+original := &codecPayload{
+Name:     "device",
+ID:       1 << 40,
+Offset:   -12345,
+Counter:  0xDEADBEEF,
+Delta:    -1,
+Ratio:    3.25,
+Enabled:  true,
+Raw:      []byte{1, 2, 3},
+Tags:     []string{"a", "bc"},
+Inner:    codecInner{Label: "inner", Score: -7},
+Children: []codecInner{{Label: "x", Score: 1}, {Label: "y", Score: 2}},
+Attrs:    map[string]uint32{"b": 2, "a": 1, "c": 3},
+Parent:   &codecInner{Label: "parent"},
+Hash:     [4]byte{9, 8, 7, 6},
+Ignored:  "not encoded",
+}
+
+data, err := MarshalStruct(original)
+if err != nil {
+t.Fatalf("MarshalStruct failed: %v", err)
+}
+
+// Map encoding must be deterministic
+again, _ := MarshalStruct(original)
+if !bytes.Equal(data, again) {
+t.Error("Struct encoding is not deterministic")
+}
+
+decoded := &codecPayload{}
+if err := UnmarshalStruct(data, decoded); err != nil {
+t.Fatalf("UnmarshalStruct failed: %v", err)
+}
+
+original.Ignored = ""
+if decoded.Name != original.Name || decoded.ID != original.ID || decoded.Offset != original.Offset ||
+decoded.Counter != original.Counter || decoded.Delta != original.Delta || decoded.Ratio != original.Ratio ||
+decoded.Enabled != original.Enabled || !bytes.Equal(decoded.Raw, original.Raw) || decoded.Hash != original.Hash {
+t.Errorf("Scalar mismatch: got %+v, want %+v", decoded, original)
+}
+if len(decoded.Tags) != 2 || decoded.Tags[1] != "bc" {
+t.Errorf("Tags mismatch: got %v", decoded.Tags)
+}
+if decoded.Inner != original.Inner {
+t.Errorf("Inner mismatch: got %+v, want %+v", decoded.Inner, original.Inner)
+}
+if len(decoded.Children) != 2 || decoded.Children[1] != original.Children[1] {
+t.Errorf("Children mismatch: got %+v", decoded.Children)
+}
+if len(decoded.Attrs) != 3 || decoded.Attrs["c"] != 3 {
+t.Errorf("Attrs mismatch: got %v", decoded.Attrs)
+}
+if decoded.Parent == nil || decoded.Parent.Label != "parent" {
+t.Errorf("Parent mismatch: got %+v", decoded.Parent)
+}
+if decoded.Missing != nil {
+t.Errorf("Expected nil Missing, got %+v", decoded.Missing)
+}
+if decoded.Ignored != "" {
+t.Errorf("Untagged field should not be decoded, got %q", decoded.Ignored)
+}
+}
+
+func TestStructCodecMatchesHandWritten(t *testing.T) {
+type taggedLogin struct {
+ClientID string `rdg:"3"`
+Username string `rdg:"1"`
+Password string `rdg:"2"`
+}
+
+handWritten, _ := (&LoginPayload{Username: "u", Password: "p", ClientID: "c"}).Marshal()
+tagged, err := MarshalStruct(&taggedLogin{Username: "u", Password: "p", ClientID: "c"})
+if err != nil {
+t.Fatalf("MarshalStruct failed: %v", err)
+}
+if !bytes.Equal(handWritten, tagged) {
+t.Errorf("Encoding mismatch: got %v, want %v", tagged, handWritten)
+}
+}
+
+func TestStructCodecErrors(t *testing.T) {
+type duplicate struct {
+A string `rdg:"1"`
+B string `rdg:"1"`
+}
+if _, err := MarshalStruct(&duplicate{}); !errors.Is(err, ErrInvalidTag) {
+t.Errorf("Expected ErrInvalidTag for duplicate numbers, got: %v", err)
+}
+
+type badFixed struct {
+A uint8 `rdg:"1,fixed"`
+}
+if _, err := MarshalStruct(&badFixed{}); !errors.Is(err, ErrInvalidTag) {
+t.Errorf("Expected ErrInvalidTag for fixed uint8, got: %v", err)
+}
+
+type unsupported struct {
+C chan int `rdg:"1"`
+}
+if _, err := MarshalStruct(&unsupported{}); !errors.Is(err, ErrUnsupportedType) {
+t.Errorf("Expected ErrUnsupportedType, got: %v", err)
+}
+
+// Nested structs are compiled with the outer one, even behind a nil pointer
+type badInner struct {
+C chan int `rdg:"1"`
+}
+type outer struct {
+Inner *badInner `rdg:"1"`
+}
+if _, err := MarshalStruct(&outer{}); !errors.Is(err, ErrUnsupportedType) {
+t.Errorf("Expected ErrUnsupportedType for a nested field, got: %v", err)
+}
+
+// Recursive types compile and round-trip
+type node struct {
+Value uint32 `rdg:"1"`
+Next  *node  `rdg:"2"`
+}
+chain := node{Value: 1, Next: &node{Value: 2, Next: &node{Value: 3}}}
+data, err := MarshalStruct(&chain)
+if err != nil {
+t.Fatalf("MarshalStruct of a recursive type failed: %v", err)
+}
+var decodedList node
+if err := UnmarshalStruct(data, &decodedList); err != nil || decodedList.Next.Next.Value != 3 || decodedList.Next.Next.Next != nil {
+t.Errorf("Recursive round trip mismatch: %+v, %v", decodedList, err)
+}
+
+// A nested struct without rdg tags would encode as nothing
+type untagged struct {
+Inner struct{ N int } `rdg:"1"`
+}
+if _, err := MarshalStruct(&untagged{}); !errors.Is(err, ErrUnsupportedType) {
+t.Errorf("Expected ErrUnsupportedType for an untagged nested struct, got: %v", err)
+}
+
+// Element counts larger than the input are rejected before allocating
+type list struct {
+Values []uint32 `rdg:"1"`
+}
+var decoded list
+if err := UnmarshalStruct([]byte{0xFF, 0xFF, 0xFF, 0x7F}, &decoded); !errors.Is(err, ErrInvalidCount) {
+t.Errorf("Expected ErrInvalidCount, got: %v", err)
+}
+}
+
+// onlyReader hides io.ByteReader to exercise the non-ByteReader fallbacks
+type onlyReader struct {
+r *bytes.Reader
+}
+
+func (o onlyReader) Read(p []byte) (int, error) {
+return o.r.Read(p)
+}
+
+func TestSignedAndFloatHelpers(t *testing.T) {
+buf := new(bytes.Buffer)
+WriteInt64(buf, -1)
+WriteInt64(buf, math.MinInt64)
+WriteInt32(buf, math.MaxInt32)
+WriteInt32Fixed(buf, -5)
+WriteInt64Fixed(buf, -6)
+WriteFloat32(buf, -1.25)
+WriteFloat64(buf, math.Pi)
+WriteDuration(buf, -90*time.Second)
+WriteUUID(buf, [UUIDSize]byte{0: 0xAB, 15: 0xCD})
+
+// -1 zigzags to a single byte
+if buf.Bytes()[0] != 1 {
+t.Errorf("Expected zigzag(-1) = 1, got %d", buf.Bytes()[0])
+}
+
+for _, r := range []io.Reader{bytes.NewReader(buf.Bytes()), onlyReader{bytes.NewReader(buf.Bytes())}} {
+if v, err := ReadInt64(r); err != nil || v != -1 {
+t.Errorf("ReadInt64: got %d, %v", v, err)
+}
+if v, err := ReadInt64(r); err != nil || v != math.MinInt64 {
+t.Errorf("ReadInt64: got %d, %v", v, err)
+}
+if v, err := ReadInt32(r); err != nil || v != math.MaxInt32 {
+t.Errorf("ReadInt32: got %d, %v", v, err)
+}
+if v, err := ReadInt32Fixed(r); err != nil || v != -5 {
+t.Errorf("ReadInt32Fixed: got %d, %v", v, err)
+}
+if v, err := ReadInt64Fixed(r); err != nil || v != -6 {
+t.Errorf("ReadInt64Fixed: got %d, %v", v, err)
+}
+if v, err := ReadFloat32(r); err != nil || v != -1.25 {
+t.Errorf("ReadFloat32: got %v, %v", v, err)
+}
+if v, err := ReadFloat64(r); err != nil || v != math.Pi {
+t.Errorf("ReadFloat64: got %v, %v", v, err)
+}
+if v, err := ReadDuration(r); err != nil || v != -90*time.Second {
+t.Errorf("ReadDuration: got %v, %v", v, err)
+}
+if v, err := ReadUUID(r); err != nil || v[0] != 0xAB || v[15] != 0xCD {
+t.Errorf("ReadUUID: got %x, %v", v, err)
+}
+}
+
+// Truncated fixed values report an unexpected EOF
+if _, err := ReadUint64Fixed(bytes.NewReader([]byte{1, 2, 3})); err != io.ErrUnexpectedEOF {
+t.Errorf("Expected io.ErrUnexpectedEOF, got: %v", err)
+}
+}
+
+func TestTimeHelpers(t *testing.T) {
+paris, err := time.LoadLocation("Europe/Paris")
+if err != nil {
+paris = time.FixedZone("CET", 3600)
+}
+times := []time.Time{
+{},
+time.Date(2024, 2, 29, 23, 59, 59, 999999999, time.UTC),
+time.Date(1969, 7, 20, 20, 17, 40, 1, time.FixedZone("EDT-ish", -4*3600)),
+time.Date(2030, 6, 1, 12, 0, 0, 0, paris),
+// An abbreviation that loads a different zone on the reader: tzdata's EST is UTC-5
+time.Date(2024, 1, 15, 9, 0, 0, 0, time.FixedZone("EST", 10*3600)),
+}
+
+for _, want := range times {
+buf := new(bytes.Buffer)
+if err := WriteTime(buf, want); err != nil {
+t.Fatalf("WriteTime failed: %v", err)
+}
+got, err := ReadTime(bytes.NewReader(buf.Bytes()))
+if err != nil {
+t.Fatalf("ReadTime failed: %v", err)
+}
+if !got.Equal(want) {
+t.Errorf("Instant mismatch: got %v, want %v", got, want)
+}
+gotName, gotOffset := got.Zone()
+wantName, wantOffset := want.Zone()
+if gotName != wantName || gotOffset != wantOffset {
+t.Errorf("Zone mismatch: got %s/%d, want %s/%d", gotName, gotOffset, wantName, wantOffset)
+}
+}
+
+if got, _ := ReadTime(bytes.NewReader(mustWriteTime(time.Time{}))); !got.IsZero() {
+t.Errorf("Expected zero time to round trip, got %v", got)
+}
+}
+
+func mustWriteTime(tm time.Time) []byte {
+buf := new(bytes.Buffer)
+WriteTime(buf, tm)
+return buf.Bytes()
+}
+
+func TestCollectionHelpers(t *testing.T) {
+buf := new(bytes.Buffer)
+WriteSlice(buf, []string{"a", "bb", "ccc"}, WriteString)
+WriteMap(buf, map[string]int64{"z": -1, "a": 1, "m": 0}, WriteString, WriteInt64)
+
+r := bytes.NewReader(buf.Bytes())
+names, err := ReadSlice(r, ReadString)
+if err != nil || len(names) != 3 || names[2] != "ccc" {
+t.Fatalf("ReadSlice: got %v, %v", names, err)
+}
+m, err := ReadMap(r, ReadString, ReadInt64)
+if err != nil || len(m) != 3 || m["z"] != -1 {
+t.Fatalf("ReadMap: got %v, %v", m, err)
+}
+
+// Map output is independent of iteration order
+a, b := new(bytes.Buffer), new(bytes.Buffer)
+big := make(map[uint32]bool)
+for i := uint32(0); i < 100; i++ {
+big[i*7] = i%2 == 0
+}
+WriteMap(a, big, WriteUint32, WriteBool)
+WriteMap(b, big, WriteUint32, WriteBool)
+if !bytes.Equal(a.Bytes(), b.Bytes()) {
+t.Error("WriteMap is not deterministic")
+}
+}
+
+func TestPackedHelpers(t *testing.T) {
+u32 := []uint32{0, 1, 300, math.MaxUint32}
+u64 := []uint64{0, math.MaxUint64}
+i64 := []int64{-1, 0, math.MinInt64, math.MaxInt64}
+f64 := []float64{-0.5, math.Inf(1), 1e300}
+bools := []bool{true, false, true, true, false, false, false, true, true}
+
+buf := new(bytes.Buffer)
+WritePackedUint32(buf, u32)
+WritePackedUint64(buf, u64)
+WritePackedInt64(buf, i64)
+WritePackedFloat64(buf, f64)
+WritePackedBool(buf, bools)
+
+// Packed uint32 matches a manual count + WriteUint32 loop
+manual := new(bytes.Buffer)
+WriteUint32(manual, uint32(len(u32)))
+for _, v := range u32 {
+WriteUint32(manual, v)
+}
+if !bytes.HasPrefix(buf.Bytes(), manual.Bytes()) {
+t.Error("WritePackedUint32 differs from manual encoding")
+}
+
+r := bytes.NewReader(buf.Bytes())
+if got, err := ReadPackedUint32(r); err != nil || !slices.Equal(got, u32) {
+t.Errorf("ReadPackedUint32: got %v, %v", got, err)
+}
+if got, err := ReadPackedUint64(r); err != nil || !slices.Equal(got, u64) {
+t.Errorf("ReadPackedUint64: got %v, %v", got, err)
+}
+if got, err := ReadPackedInt64(r); err != nil || !slices.Equal(got, i64) {
+t.Errorf("ReadPackedInt64: got %v, %v", got, err)
+}
+if got, err := ReadPackedFloat64(r); err != nil || !slices.Equal(got, f64) {
+t.Errorf("ReadPackedFloat64: got %v, %v", got, err)
+}
+if got, err := ReadPackedBool(r); err != nil || !slices.Equal(got, bools) {
+t.Errorf("ReadPackedBool: got %v, %v", got, err)
+}
+if r.Len() != 0 {
+t.Errorf("Expected all input consumed, %d bytes left", r.Len())
+}
+}
+
+func TestCollectionLimits(t *testing.T) {
+buf := new(bytes.Buffer)
+WritePackedUint32(buf, make([]uint32, 10))
+
+if _, err := ReadPackedUint32N(bytes.NewReader(buf.Bytes()), 5); err != ErrTooManyElements {
+t.Errorf("Expected ErrTooManyElements, got: %v", err)
+}
+
+// A huge count with a tiny body is rejected before allocating
+huge := new(bytes.Buffer)
+WriteVarint(huge, 1<<40)
+huge.WriteByte(0)
+if _, err := ReadPackedFloat64(bytes.NewReader(huge.Bytes())); err != ErrInvalidCount {
+t.Errorf("Expected ErrInvalidCount, got: %v", err)
+}
+if _, err := ReadBytes(bytes.NewReader(huge.Bytes())); err == nil {
+t.Error("Expected ReadBytes to reject length beyond input")
+}
+
+// Readers that can't report their size are still bounded by the limit
+if _, err := ReadSliceN(onlyReader{bytes.NewReader(huge.Bytes())}, 1000, ReadUint32); err != ErrTooManyElements {
+t.Errorf("Expected ErrTooManyElements, got: %v", err)
+}
+}
+
+func TestEncoderDecoderRoundTrip(t *testing.T) {
+at := time.Date(2024, 5, 6, 7, 8, 9, 10, time.UTC)
+id := [UUIDSize]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+
+e := NewEncoder(new(bytes.Buffer))
+e.WriteString("hello")
+e.WriteBytes([]byte{1, 2, 3})
+e.WriteUint32(300)
+e.WriteUint64(math.MaxUint64)
+e.WriteUint32Fixed(0xDEADBEEF)
+e.WriteUint64Fixed(1 << 60)
+e.WriteBool(true)
+e.WriteUint8(0xAB)
+e.WriteInt32(-5)
+e.WriteInt64(math.MinInt64)
+e.WriteInt32Fixed(-7)
+e.WriteInt64Fixed(-8)
+e.WriteFloat32(1.5)
+e.WriteFloat64(-2.25)
+e.WriteTime(at)
+e.WriteDuration(-time.Second)
+e.WriteUUID(id)
+e.WritePackedUint32([]uint32{1, 2})
+e.WritePackedBool([]bool{true, false, true})
+data, err := e.Finish()
+if err != nil {
+t.Fatalf("Finish failed: %v", err)
+}
+
+// The encoder produces the same bytes as the io.Reader helpers consume
+r := bytes.NewReader(data)
+if s, err := ReadString(r); err != nil || s != "hello" {
+t.Errorf("ReadString on encoder output: %q, %v", s, err)
+}
+
+d := NewDecoder(data)
+if v := d.ReadString(); v != "hello" {
+t.Errorf("ReadString: got %q", v)
+}
+if v := d.ReadBytes(); !bytes.Equal(v, []byte{1, 2, 3}) {
+t.Errorf("ReadBytes: got %v", v)
+}
+if v := d.ReadUint32(); v != 300 {
+t.Errorf("ReadUint32: got %d", v)
+}
+if v := d.ReadUint64(); v != math.MaxUint64 {
+t.Errorf("ReadUint64: got %d", v)
+}
+if v := d.ReadUint32Fixed(); v != 0xDEADBEEF {
+t.Errorf("ReadUint32Fixed: got %x", v)
+}
+if v := d.ReadUint64Fixed(); v != 1<<60 {
+t.Errorf("ReadUint64Fixed: got %d", v)
+}
+if v := d.ReadBool(); !v {
+t.Error("ReadBool: got false")
+}
+if v := d.ReadUint8(); v != 0xAB {
+t.Errorf("ReadUint8: got %x", v)
+}
+if v := d.ReadInt32(); v != -5 {
+t.Errorf("ReadInt32: got %d", v)
+}
+if v := d.ReadInt64(); v != math.MinInt64 {
+t.Errorf("ReadInt64: got %d", v)
+}
+if v := d.ReadInt32Fixed(); v != -7 {
+t.Errorf("ReadInt32Fixed: got %d", v)
+}
+if v := d.ReadInt64Fixed(); v != -8 {
+t.Errorf("ReadInt64Fixed: got %d", v)
+}
+if v := d.ReadFloat32(); v != 1.5 {
+t.Errorf("ReadFloat32: got %v", v)
+}
+if v := d.ReadFloat64(); v != -2.25 {
+t.Errorf("ReadFloat64: got %v", v)
+}
+if v := d.ReadTime(); !v.Equal(at) || v.Location() != time.UTC {
+t.Errorf("ReadTime: got %v", v)
+}
+if v := d.ReadDuration(); v != -time.Second {
+t.Errorf("ReadDuration: got %v", v)
+}
+if v := d.ReadUUID(); v != id {
+t.Errorf("ReadUUID: got %v", v)
+}
+if v := d.ReadPackedUint32(); !slices.Equal(v, []uint32{1, 2}) {
+t.Errorf("ReadPackedUint32: got %v", v)
+}
+if v := d.ReadPackedBool(); !slices.Equal(v, []bool{true, false, true}) {
+t.Errorf("ReadPackedBool: got %v", v)
+}
+if err := d.Err(); err != nil {
+t.Fatalf("Decoder error: %v", err)
+}
+if d.Remaining() != 0 || d.Offset() != len(data) {
+t.Errorf("Expected all input consumed, %d bytes left", d.Remaining())
+}
+}
+
+func TestDecoderStickyError(t *testing.T) {
+buf := new(bytes.Buffer)
+WriteString(buf, "hello")
+WriteUint32(buf, 42)
+data := buf.Bytes()
+
+// Truncated input: the first failing read sets the error, later reads return zero values
+d := NewDecoder(data[:3])
+if v := d.ReadString(); v != "" {
+t.Errorf("Expected empty string on error, got %q", v)
+}
+if v := d.ReadUint32(); v != 0 {
+t.Errorf("Expected zero after error, got %d", v)
+}
+if err := d.Err(); err != io.ErrUnexpectedEOF {
+t.Errorf("Expected io.ErrUnexpectedEOF, got: %v", err)
+}
+
+// Varint overflow
+d = NewDecoder(bytes.Repeat([]byte{0xFF}, 11))
+d.ReadVarint()
+if err := d.Err(); err != ErrVarintOverflow {
+t.Errorf("Expected ErrVarintOverflow, got: %v", err)
+}
+
+// Oversized counts are rejected before allocating
+huge := new(bytes.Buffer)
+WriteVarint(huge, 1<<40)
+d = NewDecoder(huge.Bytes())
+if n := d.ReadCount(MaxCollectionElements, 1); n != 0 || d.Err() != ErrInvalidCount {
+t.Errorf("Expected ErrInvalidCount, got %d, %v", n, d.Err())
+}
+
+// The first error wins
+d = NewDecoder(nil)
+d.SetErr(ErrInvalidTime)
+d.ReadUint8()
+if d.Err() != ErrInvalidTime {
+t.Errorf("Expected first error to be kept, got: %v", d.Err())
+}
+
+e := NewEncoder(new(bytes.Buffer))
+e.SetErr(ErrInvalidPayloadType)
+e.WriteString("ignored")
+if _, err := e.Finish(); err != ErrInvalidPayloadType {
+t.Errorf("Expected encoder error, got: %v", err)
+}
+if e.Len() != 0 {
+t.Errorf("Expected no writes after error, got %d bytes", e.Len())
+}
+}
+
+func TestZeroCopyDecoder(t *testing.T) {
+blob := bytes.Repeat([]byte{0xAB}, 4096)
+e := NewEncoder(new(bytes.Buffer))
+e.WriteString("device-42")
+e.WriteBytes(blob)
+e.WriteBytes(nil)
+e.WriteTime(time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("XYZ", 3600)))
+data, err := e.Finish()
+if err != nil {
+t.Fatal(err)
+}
+
+d := NewZeroCopyDecoder(data)
+if !d.ZeroCopy() || NewDecoder(data).ZeroCopy() {
+t.Error("Unexpected ZeroCopy mode")
+}
+name := d.ReadString()
+got := d.ReadBytes()
+empty := d.ReadBytes()
+at := d.ReadTime()
+if err := d.Err(); err != nil {
+t.Fatalf("Decode failed: %v", err)
+}
+if name != "device-42" || !bytes.Equal(got, blob) || empty == nil || len(empty) != 0 {
+t.Fatalf("Unexpected values: %q, %d bytes, %v", name, len(got), empty)
+}
+
+// The blob starts after the string (1+9 bytes) and its 2-byte length prefix
+if &got[0] != &data[12] {
+t.Error("Expected borrowed bytes to alias the input")
+}
+if cap(got) != len(got) {
+t.Errorf("Expected borrowed slice capacity to be clipped, got cap %d len %d", cap(got), len(got))
+}
+
+// Decoding borrowed fields does not allocate
+allocs := testing.AllocsPerRun(100, func() {
+d.Reset(data)
+d.ReadString()
+d.ReadBytes()
+})
+if allocs != 0 {
+t.Errorf("Expected zero allocations, got %v", allocs)
+}
+
+// Borrowed strings see changes to the input, the time zone name does not
+clear(data)
+if name == "device-42" {
+t.Error("Expected borrowed string to alias the input")
+}
+if at.Location().String() != "XYZ" {
+t.Errorf("Time zone name should not alias the input, got %q", at.Location())
+}
+}
+
+func TestMessageDecoder(t *testing.T) {
+data, err := MarshalMessage(MsgTypeData, 7, &DataPayload{ID: "k", ChunkIndex: 1, TotalChunks: 2, Data: []byte("value")}, nil)
+if err != nil {
+t.Fatal(err)
+}
+msg, _, err := UnmarshalMessage(data, nil)
+if err != nil {
+t.Fatal(err)
+}
+
+d := msg.Decoder()
+key := d.ReadString()
+d.ReadUint32Fixed()
+d.ReadUint32Fixed()
+value := d.ReadBytes()
+if err := d.Err(); err != nil || key != "k" || string(value) != "value" {
+t.Fatalf("Unexpected decode: %q, %q, %v", key, value, err)
+}
+if &value[0] != &msg.Payload[len(msg.Payload)-len(value)] {
+t.Error("Expected value to alias the message payload")
+}
+}
+
+// blobPayload implements only AppendMarshal and Size, counting encodes
+type blobPayload struct {
+Name    string
+Data    []byte
+appends int
+}
+
+func (p *blobPayload) AppendMarshal(dst []byte) ([]byte, error) {
+p.appends++
+dst = AppendString(dst, p.Name)
+return AppendBytes(dst, p.Data), nil
+}
+
+func (p *blobPayload) Size() int {
+return SizeString(p.Name) + SizeBytes(p.Data)
+}
+
+func TestAppendHelpersMatchWriters(t *testing.T) {
+buf := new(bytes.Buffer)
+WriteVarint(buf, 1<<40)
+WriteString(buf, "hello")
+WriteBytes(buf, []byte{1, 2})
+WriteUint32(buf, 300)
+WriteUint64(buf, math.MaxUint64)
+WriteUint32Fixed(buf, 7)
+WriteUint64Fixed(buf, 8)
+WriteBool(buf, true)
+WriteInt32(buf, -3)
+WriteInt64(buf, math.MinInt64)
+WriteFloat32(buf, 1.5)
+WriteFloat64(buf, -2.5)
+
+var b []byte
+b = AppendVarint(b, 1<<40)
+b = AppendString(b, "hello")
+b = AppendBytes(b, []byte{1, 2})
+b = AppendUint32(b, 300)
+b = AppendUint64(b, math.MaxUint64)
+b = AppendUint32Fixed(b, 7)
+b = AppendUint64Fixed(b, 8)
+b = AppendBool(b, true)
+b = AppendInt32(b, -3)
+b = AppendInt64(b, math.MinInt64)
+b = AppendFloat32(b, 1.5)
+b = AppendFloat64(b, -2.5)
+if !bytes.Equal(b, buf.Bytes()) {
+t.Errorf("Append helpers differ from Write helpers:\n%v\n%v", b, buf.Bytes())
+}
+
+for _, v := range []uint64{0, 1, 127, 128, 16383, 16384, math.MaxUint32, math.MaxUint64} {
+if got := SizeVarint(v); got != len(AppendVarint(nil, v)) {
+t.Errorf("SizeVarint(%d) = %d, want %d", v, got, len(AppendVarint(nil, v)))
+}
+}
+}
+
+func TestAppendMessage(t *testing.T) {
+opts := SecureMessageOptions([]byte("append-secret"))
+payload := &LoginPayload{Username: "u", Password: "p", ClientID: "c"}
+
+want, err := MarshalMessage(MsgTypeLogin, 9, payload, opts)
+if err != nil {
+t.Fatal(err)
+}
+prefix := []byte("prefix")
+got, err := AppendMessage(prefix, MsgTypeLogin, 9, payload, opts)
+if err != nil {
+t.Fatal(err)
+}
+if !bytes.Equal(got[:len(prefix)], prefix) || !bytes.Equal(got[len(prefix):], want) {
+t.Error("AppendMessage output differs from MarshalMessage")
+}
+
+// Appender-only payloads work everywhere a Marshal payload does
+blob := &blobPayload{Name: "n", Data: []byte{1, 2, 3}}
+data, err := MarshalMessage(42, 1, blob, opts)
+if err != nil {
+t.Fatalf("MarshalMessage with appender failed: %v", err)
+}
+msg, _, err := UnmarshalMessage(data, opts)
+if err != nil {
+t.Fatal(err)
+}
+if !bytes.Equal(msg.Payload, AppendBytes(AppendString(nil, "n"), []byte{1, 2, 3})) {
+t.Errorf("Unexpected payload bytes: %v", msg.Payload)
+}
+if payloadBytes, err := MarshalPayload(blob); err != nil || !bytes.Equal(payloadBytes, msg.Payload) {
+t.Errorf("MarshalPayload with appender: %v, %v", payloadBytes, err)
+}
+}
+
+func TestSendMessageEncodesOnce(t *testing.T) {
+for _, size := range []int{16, 4096} {
+serverConn, clientConn := net.Pipe()
+opts := &MessageOptions{StreamConfig: &StreamConfig{Threshold: 1024, ChunkSize: 256, Enabled: true}}
+sender := NewProtocol(clientConn, opts)
+receiver := NewProtocol(serverConn, opts)
+
+blob := &blobPayload{Name: "blob", Data: bytes.Repeat([]byte{7}, size)}
+errCh := make(chan error, 1)
+go func() {
+errCh <- sender.SendMessage(42, 5, blob)
+}()
+
+msg, _, err := receiver.ReceiveMessage()
+if err != nil {
+t.Fatalf("Receive failed (size %d): %v", size, err)
+}
+// Drain the stream end marker
+go io.Copy(io.Discard, serverConn)
+if err := <-errCh; err != nil {
+t.Fatalf("Send failed (size %d): %v", size, err)
+}
+if blob.appends != 1 {
+t.Errorf("Expected payload to be encoded once (size %d), got %d", size, blob.appends)
+}
+if want := AppendBytes(AppendString(nil, "blob"), blob.Data); msg.ID != 5 || !bytes.Equal(msg.Payload, want) {
+t.Errorf("Unexpected message (size %d): id %d, %d payload bytes", size, msg.ID, len(msg.Payload))
+}
+clientConn.Close()
+serverConn.Close()
+}
+}
+
+// loopbackProtocols connects two Protocols over a real socket
+func loopbackProtocols(t *testing.T, network string, opts *MessageOptions) (*Protocol, *Protocol) {
+t.Helper()
+address := "127.0.0.1:0"
+if network == "unix" {
+address = t.TempDir() + "/rdg.sock"
+}
+listener, err := net.Listen(network, address)
+if err != nil {
+t.Fatalf("Failed to listen on %s: %v", network, err)
+}
+defer listener.Close()
+
+accepted := make(chan net.Conn, 1)
+go func() {
+conn, _ := listener.Accept()
+accepted <- conn
+}()
+conn, err := net.Dial(network, listener.Addr().String())
+if err != nil {
+t.Fatalf("Failed to dial %s: %v", network, err)
+}
+serverConn := <-accepted
+if serverConn == nil {
+t.Fatal("Accept failed")
+}
+t.Cleanup(func() {
+conn.Close()
+serverConn.Close()
+})
+return NewProtocol(conn, opts), NewProtocol(serverConn, opts)
+}
+
+func TestVectoredSend(t *testing.T) {
+raw := bytes.Repeat([]byte{1, 2, 3}, 20*1024)
+large := make([]byte, 300*1024)
+for i := range large {
+large[i] = byte(i % 251)
+}
+streamCfg := &StreamConfig{Threshold: 128 * 1024, ChunkSize: 16 * 1024, Enabled: true}
+signed := SecureMessageOptions([]byte("vectored"))
+signed.StreamConfig = streamCfg
+
+for _, network := range []string{"tcp", "unix"} {
+for _, opts := range []*MessageOptions{{StreamConfig: streamCfg}, signed} {
+sender, receiver := loopbackProtocols(t, network, opts)
+if !sender.vectored {
+t.Errorf("Expected vectored writes on %s connection", network)
+}
+
+// Sends are buffered by the socket, so no reader goroutine is needed
+if err := sender.SendMessage(42, 1, raw); err != nil {
+t.Fatalf("Send failed on %s: %v", network, err)
+}
+go sender.SendMessage(42, 2, large)
+
+for _, want := range [][]byte{raw, large} {
+msg, _, err := receiver.ReceiveMessage()
+if err != nil {
+t.Fatalf("Receive failed on %s (signed %v): %v", network, opts.Signer != nil, err)
+}
+if !bytes.Equal(msg.Payload, want) {
+t.Errorf("Payload mismatch on %s (signed %v), got %d bytes", network, opts.Signer != nil, len(msg.Payload))
+}
+}
+}
+}
+
+// In-memory connections keep using a single contiguous Write
+a, b := net.Pipe()
+defer a.Close()
+defer b.Close()
+if NewProtocol(a, nil).vectored {
+t.Error("net.Pipe should not use vectored writes")
+}
+}
+
+func TestRecvBufferClasses(t *testing.T) {
+for _, tc := range []struct {
+n, capacity int
+}{
+{1, 512}, {512, 512}, {513, 1024}, {64 * 1024, 64 * 1024}, {64*1024 + 20, 128 * 1024}, {4 << 20, 4 << 20},
+} {
+b, bufp := getRecvBuffer(tc.n)
+if len(b) != tc.n || cap(b) != tc.capacity || bufp == nil {
+t.Errorf("getRecvBuffer(%d): len %d cap %d, want cap %d", tc.n, len(b), cap(b), tc.capacity)
+continue
+}
+putRecvBuffer(bufp)
+}
+
+// Frames above the largest class are not pooled
+if b, bufp := getRecvBuffer(4<<20 + 1); bufp != nil || len(b) != 4<<20+1 {
+t.Error("Expected oversized buffer to be allocated without pooling")
+}
+}
+
+func TestPooledReceive(t *testing.T) {
+opts := &MessageOptions{
+PooledBuffers: true,
+StreamConfig:  &StreamConfig{Threshold: 64 * 1024, ChunkSize: 8 * 1024, Enabled: true},
+}
+serverConn, clientConn := net.Pipe()
+defer serverConn.Close()
+defer clientConn.Close()
+sender := NewProtocol(clientConn, opts)
+receiver := NewProtocol(serverConn, opts)
+
+large := make([]byte, 200*1024)
+for i := range large {
+large[i] = byte(i % 253)
+}
+go func() {
+sender.Send(MsgTypeLogin, &LoginPayload{Username: "pooled", Password: "p", ClientID: "c"})
+sender.Send(42, large)
+}()
+
+msg, payload, err := receiver.ReceiveMessage()
+if err != nil {
+t.Fatalf("Receive failed: %v", err)
+}
+if msg.pooled == nil {
+t.Error("Expected message to use a pooled buffer")
+}
+login, ok := payload.(*LoginPayload)
+if !ok || login.Username != "pooled" {
+t.Fatalf("Unexpected payload: %#v", payload)
+}
+msg.Release()
+msg.Release()
+if msg.Payload != nil || msg.pooled != nil {
+t.Error("Expected Release to clear the payload")
+}
+// Payloads decoded with copying helpers outlive the buffer
+if login.Username != "pooled" {
+t.Errorf("Decoded payload changed after Release: %q", login.Username)
+}
+
+// Streamed messages are reassembled from pooled chunk frames
+msg, _, err = receiver.ReceiveMessage()
+if err != nil {
+t.Fatalf("Streamed receive failed: %v", err)
+}
+if !bytes.Equal(msg.Payload, large) {
+t.Errorf("Streamed payload mismatch, got %d bytes", len(msg.Payload))
+}
+msg.Release()
+}
+
+// countingConn counts Write calls on a connection
+type countingConn struct {
+net.Conn
+mu     sync.Mutex
+writes int
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+c.mu.Lock()
+c.writes++
+c.mu.Unlock()
+return c.Conn.Write(b)
+}
+
+func (c *countingConn) Writes() int {
+c.mu.Lock()
+defer c.mu.Unlock()
+return c.writes
+}
+
+// failingConn rejects every write
+type failingConn struct {
+net.Conn
+}
+
+func (failingConn) Write([]byte) (int, error) {
+return 0, io.ErrClosedPipe
+}
+
+func TestAsyncWriterCoalesces(t *testing.T) {
+serverConn, clientConn := net.Pipe()
+defer serverConn.Close()
+conn := &countingConn{Conn: clientConn}
+opts := &MessageOptions{AsyncWrite: &AsyncWriteConfig{QueueSize: 256, MaxBatchBytes: 64 * 1024, MaxDelay: 20 * time.Millisecond}}
+sender := NewProtocol(conn, opts)
+receiver := NewProtocol(serverConn, nil)
+
+const count = 100
+received := make(chan error, 1)
+go func() {
+for i := 1; i <= count; i++ {
+msg, payload, err := receiver.ReceiveMessage()
+if err != nil {
+received <- err
+return
+}
+if login, ok := payload.(*LoginPayload); !ok || msg.ID != uint32(i) || login.Username != "user" {
+received <- errors.New("message out of order")
+return
+}
+}
+received <- nil
+}()
+
+for i := 1; i <= count; i++ {
+if err := sender.SendMessage(MsgTypeLogin, uint32(i), &LoginPayload{Username: "user"}); err != nil {
+t.Fatalf("Send %d failed: %v", i, err)
+}
+}
+if err := sender.Flush(); err != nil {
+t.Fatalf("Flush failed: %v", err)
+}
+if err := <-received; err != nil {
+t.Fatalf("Receive failed: %v", err)
+}
+if writes := conn.Writes(); writes >= count {
+t.Errorf("Expected writes to be coalesced, got %d writes for %d messages", writes, count)
+}
+
+if err := sender.Close(); err != nil {
+t.Errorf("Close failed: %v", err)
+}
+if err := sender.SendMessage(MsgTypeLogin, 1, &LoginPayload{}); err != ErrWriterClosed {
+t.Errorf("Expected ErrWriterClosed after Close, got: %v", err)
+}
+}
+
+func TestAsyncWriterErrors(t *testing.T) {
+a, b := net.Pipe()
+defer a.Close()
+defer b.Close()
+sender := NewProtocol(failingConn{a}, &MessageOptions{AsyncWrite: DefaultAsyncWriteConfig()})
+defer sender.Close()
+
+// Send only queues the frame, the sync variant reports the write error
+if err := sender.SendMessageSync(MsgTypeLogin, 1, &LoginPayload{}); err != io.ErrClosedPipe {
+t.Fatalf("Expected io.ErrClosedPipe from SendMessageSync, got: %v", err)
+}
+
+// The error is sticky
+if _, err := sender.Send(MsgTypeLogin, &LoginPayload{}); err != io.ErrClosedPipe {
+t.Errorf("Expected sticky error from Send, got: %v", err)
+}
+if err := sender.Flush(); err != io.ErrClosedPipe {
+t.Errorf("Expected sticky error from Flush, got: %v", err)
+}
+
+// Without AsyncWrite, Flush has nothing to do
+if err := NewProtocol(b, nil).Flush(); err != nil {
+t.Errorf("Expected nil Flush without async writer, got: %v", err)
+}
+}
+
+func TestSendBatch(t *testing.T) {
+a, b := net.Pipe()
+defer a.Close()
+defer b.Close()
+conn := &countingConn{Conn: a}
+sender := NewProtocol(conn, nil)
+receiver := NewProtocol(b, nil)
+
+// A batch that fails to encode writes nothing
+if _, err := sender.SendBatch([]Outgoing{
+{Type: MsgTypeLogin, Payload: &LoginPayload{Username: "ok"}},
+{Type: 42, Payload: make(chan int)},
+}); err == nil {
+t.Fatal("Expected error for unsupported payload")
+}
+if conn.Writes() != 0 {
+t.Fatalf("Expected no writes after failed batch, got %d", conn.Writes())
+}
+
+batch := []Outgoing{
+{Type: MsgTypeLogin, Payload: &LoginPayload{Username: "alice"}},
+{Type: 42, ID: 777, Payload: []byte("raw")},
+{Type: MsgTypeData, Payload: &DataPayload{ID: "d", Data: bytes.Repeat([]byte{1}, 5000)}},
+}
+errCh := make(chan error, 1)
+var ids []uint32
+go func() {
+var err error
+ids, err = sender.SendBatch(batch)
+errCh <- err
+}()
+
+var got []*Message
+for range batch {
+msg, _, err := receiver.ReceiveMessage()
+if err != nil {
+t.Fatalf("ReceiveMessage failed: %v", err)
+}
+got = append(got, msg)
+}
+if err := <-errCh; err != nil {
+t.Fatalf("SendBatch failed: %v", err)
+}
+if conn.Writes() != 1 {
+t.Errorf("Expected a single write, got %d", conn.Writes())
+}
+if len(ids) != len(batch) || ids[1] != 777 || ids[0] == 0 || ids[2] == ids[0] {
+t.Fatalf("Unexpected IDs: %v", ids)
+}
+for i, msg := range got {
+if msg.Type != batch[i].Type || msg.ID != ids[i] {
+t.Errorf("Message %d: got type %d ID %d, expected type %d ID %d", i, msg.Type, msg.ID, batch[i].Type, ids[i])
+}
+}
+if !bytes.Equal(got[1].Payload, []byte("raw")) {
+t.Errorf("Unexpected raw payload: %q", got[1].Payload)
+}
+}
+
+func TestSendBatchAtomic(t *testing.T) {
+for _, async := range []bool{false, true} {
+opts := &MessageOptions{}
+if async {
+opts.AsyncWrite = DefaultAsyncWriteConfig()
+}
+sender, receiver := loopbackProtocols(t, "tcp", opts)
+
+// Batches from several goroutines must arrive contiguously
+const senders, batches, batchLen = 4, 20, 5
+var wg sync.WaitGroup
+for g := 0; g < senders; g++ {
+wg.Add(1)
+go func(g int) {
+defer wg.Done()
+for i := 0; i < batches; i++ {
+batch := make([]Outgoing, batchLen)
+for j := range batch {
+batch[j] = Outgoing{Type: 42, Payload: []byte{byte(g), byte(j)}}
+}
+if _, err := sender.SendBatch(batch); err != nil {
+t.Errorf("SendBatch failed: %v", err)
+return
+}
+}
+}(g)
+}
+
+for n := 0; n < senders*batches; n++ {
+var first byte
+for j := 0; j < batchLen; j++ {
+msg, _, err := receiver.ReceiveMessage()
+if err != nil {
+t.Fatalf("ReceiveMessage failed: %v", err)
+}
+if j == 0 {
+first = msg.Payload[0]
+}
+if msg.Payload[0] != first || msg.Payload[1] != byte(j) {
+t.Fatalf("async=%v: batch interleaved: got %v at position %d of batch from %d", async, msg.Payload, j, first)
+}
+}
+}
+wg.Wait()
+}
+}
+
+func TestStreamInterleaving(t *testing.T) {
+a, b := net.Pipe()
+defer a.Close()
+defer b.Close()
+opts := &MessageOptions{StreamConfig: &StreamConfig{Threshold: 100, ChunkSize: 10, Enabled: true}}
+sender := NewProtocol(a, opts)
+receiver := NewProtocol(b, nil)
+
+// A bulk stream of 100 chunks with weight 3, and a small one of 10 chunks with weight 1
+weights := map[uint32]int{1: 3, 2: 1}
+errCh := make(chan error, 2)
+go func() {
+errCh <- sender.SendMessageWeighted(42, 1, bytes.Repeat([]byte{1}, 1000), 3)
+}()
+go func() {
+errCh <- sender.SendMessageWeighted(42, 2, bytes.Repeat([]byte{2}, 100), 1)
+}()
+
+// Read raw frames to see the order chunks are written in
+started := map[uint32]bool{}
+remaining := map[uint32]int{1: 100, 2: 10}
+next := map[uint32]uint32{}
+var runID uint32
+run := 0
+for ended := 0; ended < 2; {
+msg, payload, err := receiver.receiveRaw()
+if err != nil {
+t.Fatalf("receiveRaw failed: %v", err)
+}
+switch msg.Type {
+case MessageTypeStreamStart:
+started[msg.ID] = true
+case MessageTypeStreamChunk:
+if index := payload.(*StreamChunk).ChunkIndex; index != next[msg.ID] {
+t.Fatalf("Stream %d: expected chunk %d, got %d", msg.ID, next[msg.ID], index)
+}
+next[msg.ID]++
+remaining[msg.ID]--
+if msg.ID != runID {
+runID, run = msg.ID, 0
+}
+run++
+// While both streams are active, each gets at most its weight per turn
+if started[1] && started[2] && remaining[1] > 0 && remaining[2] > 0 && run > weights[msg.ID] {
+t.Fatalf("Stream %d sent %d chunks in a row, weight is %d", msg.ID, run, weights[msg.ID])
+}
+case MessageTypeStreamEnd:
+if msg.ID == 2 && remaining[1] == 0 {
+t.Error("Small stream was not interleaved with the bulk stream")
+}
+ended++
+}
+}
+for i := 0; i < 2; i++ {
+if err := <-errCh; err != nil {
+t.Fatalf("SendMessageWeighted failed: %v", err)
+}
+}
+}
+
+func TestStreamSchedulerDirectPriority(t *testing.T) {
+for _, async := range []bool{false, true} {
+a, b := net.Pipe()
+opts := &MessageOptions{StreamConfig: &StreamConfig{Threshold: 100, ChunkSize: 10, Enabled: true}}
+if async {
+opts.AsyncWrite = DefaultAsyncWriteConfig()
+}
+sender := NewProtocol(a, opts)
+receiver := NewProtocol(b, nil)
+
+streamDone := make(chan error, 1)
+go func() {
+streamDone <- sender.SendMessage(42, 1, bytes.Repeat([]byte{1}, 10000))
+}()
+
+// Wait for the stream to start, then send a small message
+msg, _, err := receiver.receiveRaw()
+if err != nil || msg.Type != MessageTypeStreamStart {
+t.Fatalf("Expected stream start, got %v, %v", msg, err)
+}
+directDone := make(chan error, 1)
+go func() {
+directDone <- sender.SendMessageSync(42, 2, []byte("ping"))
+}()
+
+// The small message must not wait for the remaining chunks of the stream
+msg, _, err = receiver.ReceiveMessage()
+if err != nil {
+t.Fatalf("ReceiveMessage failed: %v", err)
+}
+if msg.ID != 2 {
+t.Fatalf("async=%v: expected direct message before the stream, got message %d", async, msg.ID)
+}
+if err := <-directDone; err != nil {
+t.Fatalf("Direct send failed: %v", err)
+}
+
+// The rest of the stream is still received
+go io.Copy(io.Discard, b)
+if err := <-streamDone; err != nil {
+t.Fatalf("Streamed send failed: %v", err)
+}
+sender.Close()
+b.Close()
+}
+}
+
+// sendFrames sends each message in order from a goroutine, as a misbehaving peer would
+func sendFrames(t *testing.T, conn net.Conn, opts *MessageOptions, frames []Outgoing, pause time.Duration) {
+sender := NewProtocol(conn, opts)
+go func() {
+for _, f := range frames {
+if f.Type == 0 {
+time.Sleep(pause)
+continue
+}
+if err := sender.SendMessage(f.Type, f.ID, f.Payload); err != nil {
+t.Errorf("SendMessage failed: %v", err)
+return
+}
+}
+}()
+}
+
+// expectStreamError receives the next message and checks it is a StreamError
+func expectStreamError(t *testing.T, p *Protocol, id uint32, target error) {
+t.Helper()
+_, _, err := p.ReceiveMessage()
+var streamErr *StreamError
+if !errors.As(err, &streamErr) || streamErr.ID != id || !errors.Is(err, target) {
+t.Fatalf("Expected StreamError for stream %d wrapping %v, got: %v", id, target, err)
+}
+}
+
+// expectMessage receives the next message and checks its ID and payload
+func expectMessage(t *testing.T, p *Protocol, id uint32, payload string) {
+t.Helper()
+msg, _, err := p.ReceiveMessage()
+if err != nil {
+t.Fatalf("ReceiveMessage failed: %v", err)
+}
+if msg.ID != id || string(msg.Payload) != payload {
+t.Fatalf("Expected message %d with %q, got message %d with %q", id, payload, msg.ID, msg.Payload)
+}
+}
+
+func TestStreamReassemblyValidation(t *testing.T) {
+a, b := net.Pipe()
+defer a.Close()
+defer b.Close()
+receiver := NewProtocol(b, nil)
+
+header := &StreamHeader{OriginalType: 42, TotalSize: 6, TotalChunks: 2}
+chunk := func(i uint32, data string) *StreamChunk {
+return &StreamChunk{ChunkIndex: i, Data: []byte(data)}
+}
+sendFrames(t, a, nil, []Outgoing{
+// More chunks than bytes
+{Type: MessageTypeStreamStart, ID: 1, Payload: &StreamHeader{OriginalType: 42, TotalSize: 1, TotalChunks: 2}},
+// Reserved original type
+{Type: MessageTypeStreamStart, ID: 2, Payload: &StreamHeader{OriginalType: MessageTypeStreamEnd, TotalSize: 1, TotalChunks: 1}},
+// Chunk index out of range
+{Type: MessageTypeStreamStart, ID: 3, Payload: header},
+{Type: MessageTypeStreamChunk, ID: 3, Payload: chunk(0, "abc")},
+{Type: MessageTypeStreamChunk, ID: 3, Payload: chunk(2, "def")},
+// Chunks larger than the announced size
+{Type: MessageTypeStreamStart, ID: 4, Payload: header},
+{Type: MessageTypeStreamChunk, ID: 4, Payload: chunk(0, "abcd")},
+{Type: MessageTypeStreamChunk, ID: 4, Payload: chunk(1, "efg")},
+// Ended with a chunk missing
+{Type: MessageTypeStreamStart, ID: 5, Payload: header},
+{Type: MessageTypeStreamChunk, ID: 5, Payload: chunk(1, "def")},
+{Type: MessageTypeStreamEnd, ID: 5, Payload: []byte{}},
+// Out of order with a duplicate: the first copy is kept
+{Type: MessageTypeStreamStart, ID: 6, Payload: header},
+{Type: MessageTypeStreamChunk, ID: 6, Payload: chunk(1, "def")},
+{Type: MessageTypeStreamChunk, ID: 6, Payload: chunk(1, "xyz")},
+{Type: MessageTypeStreamChunk, ID: 6, Payload: chunk(0, "abc")},
+{Type: MessageTypeStreamEnd, ID: 6, Payload: []byte{}},
+// Chunks of unknown streams are ignored
+{Type: MessageTypeStreamChunk, ID: 7, Payload: chunk(0, "abc")},
+{Type: 42, ID: 8, Payload: []byte("after")},
+}, 0)
+
+expectStreamError(t, receiver, 1, ErrStreamMismatch)
+expectStreamError(t, receiver, 2, ErrStreamMismatch)
+expectStreamError(t, receiver, 3, ErrStreamMismatch)
+expectStreamError(t, receiver, 4, ErrStreamMismatch)
+expectStreamError(t, receiver, 5, ErrStreamInterrupted)
+expectMessage(t, receiver, 6, "abcdef")
+expectMessage(t, receiver, 8, "after")
+
+receiver.streamMu.Lock()
+defer receiver.streamMu.Unlock()
+if len(receiver.activeStreams) != 0 || receiver.streamBytes != 0 {
+t.Errorf("Expected no stream state, got %d streams holding %d bytes", len(receiver.activeStreams), receiver.streamBytes)
+}
+}
+
+func TestStreamReassemblyLimits(t *testing.T) {
+a, b := net.Pipe()
+defer a.Close()
+defer b.Close()
+receiver := NewProtocol(b, &MessageOptions{StreamConfig: &StreamConfig{
+Threshold:      StreamingThreshold,
+ChunkSize:      DefaultChunkSize,
+Enabled:        true,
+MaxStreams:     1,
+MaxStreamBytes: 16, // 8 bytes of chunk bitmap per stream, plus data
+}})
+
+sendFrames(t, a, nil, []Outgoing{
+{Type: MessageTypeStreamStart, ID: 1, Payload: &StreamHeader{OriginalType: 42, TotalSize: 8, TotalChunks: 1}},
+{Type: MessageTypeStreamStart, ID: 2, Payload: &StreamHeader{OriginalType: 42, TotalSize: 8, TotalChunks: 1}},
+{Type: MessageTypeStreamChunk, ID: 2, Payload: &StreamChunk{ChunkIndex: 0, Data: []byte("ignored!")}},
+{Type: MessageTypeStreamChunk, ID: 1, Payload: &StreamChunk{ChunkIndex: 0, Data: []byte("12345678")}},
+{Type: MessageTypeStreamStart, ID: 3, Payload: &StreamHeader{OriginalType: 42, TotalSize: 20, TotalChunks: 2}},
+{Type: MessageTypeStreamChunk, ID: 3, Payload: &StreamChunk{ChunkIndex: 0, Data: make([]byte, 10)}},
+{Type: MessageTypeStreamChunk, ID: 3, Payload: &StreamChunk{ChunkIndex: 1, Data: make([]byte, 10)}},
+{Type: 42, ID: 4, Payload: []byte("after")},
+}, 0)
+
+expectStreamError(t, receiver, 2, ErrStreamLimit)
+expectMessage(t, receiver, 1, "12345678")
+expectStreamError(t, receiver, 3, ErrStreamLimit)
+expectMessage(t, receiver, 4, "after")
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+a, b := net.Pipe()
+defer a.Close()
+defer b.Close()
+receiver := NewProtocol(b, &MessageOptions{StreamConfig: &StreamConfig{
+Threshold:   StreamingThreshold,
+ChunkSize:   DefaultChunkSize,
+Enabled:     true,
+IdleTimeout: 20 * time.Millisecond,
+}})
+
+sendFrames(t, a, nil, []Outgoing{
+{Type: MessageTypeStreamStart, ID: 1, Payload: &StreamHeader{OriginalType: 42, TotalSize: 6, TotalChunks: 2}},
+{Type: MessageTypeStreamChunk, ID: 1, Payload: &StreamChunk{ChunkIndex: 0, Data: []byte("abc")}},
+{}, // pause past the idle timeout
+{Type: 42, ID: 2, Payload: []byte("first")},
+{Type: MessageTypeStreamChunk, ID: 1, Payload: &StreamChunk{ChunkIndex: 1, Data: []byte("def")}},
+{Type: 42, ID: 3, Payload: []byte("second")},
+}, 100*time.Millisecond)
+
+// The stream expires while the receiver waits, which interrupts the wait
+expectStreamError(t, receiver, 1, ErrStreamInterrupted)
+expectMessage(t, receiver, 2, "first")
+expectMessage(t, receiver, 3, "second")
+
+// Nothing follows a stalled stream: the error doesn't wait for another frame
+sendFrames(t, a, nil, []Outgoing{
+{Type: MessageTypeStreamStart, ID: 4, Payload: &StreamHeader{OriginalType: 42, TotalSize: 6, TotalChunks: 2}},
+{Type: MessageTypeStreamChunk, ID: 4, Payload: &StreamChunk{ChunkIndex: 0, Data: []byte("abc")}},
+}, 0)
+result := make(chan error, 1)
+go func() {
+_, _, err := receiver.ReceiveMessage()
+result <- err
+}()
+select {
+case err := <-result:
+var streamErr *StreamError
+if !errors.As(err, &streamErr) || streamErr.ID != 4 || !errors.Is(err, ErrStreamInterrupted) {
+t.Fatalf("Expected StreamError for stream 4 wrapping ErrStreamInterrupted, got: %v", err)
+}
+case <-time.After(5 * time.Second):
+t.Fatal("Expired stream was not reported on a quiet connection")
+}
+
+// The connection reads normally afterwards
+sendFrames(t, a, nil, []Outgoing{{Type: 42, ID: 5, Payload: []byte("third")}}, 0)
+expectMessage(t, receiver, 5, "third")
+}
+
+func TestServedStreamErrors(t *testing.T) {
+listener, err := net.Listen("tcp", "127.0.0.1:0")
+if err != nil {
+t.Fatalf("Failed to create listener: %v", err)
+}
+mux := NewServeMux()
+mux.Handle(MsgTypeLogin, func(ctx context.Context, msg *Message, payload interface{}) error {
+client, _ := ClientFromContext(ctx)
+return client.Reply(msg, MsgTypeResponse, &ResponsePayload{Success: true})
+})
+served := make(chan *Client, 1)
+server := NewServer(listener, &MessageOptions{StreamConfig: &StreamConfig{
+Threshold:      StreamingThreshold,
+ChunkSize:      DefaultChunkSize,
+Enabled:        true,
+MaxStreamBytes: 1024,
+IdleTimeout:    20 * time.Millisecond,
+}})
+server.SetConnectionHandler(func(c *Client) {
+served <- c
+mux.ServeClient(c)
+})
+server.StartAsync()
+defer server.Stop()
+
+conn, err := net.Dial("tcp", listener.Addr().String())
+if err != nil {
+t.Fatalf("Failed to connect: %v", err)
+}
+client := NewClient(conn, nil)
+client.Start()
+defer client.Close()
+peer := <-served
+
+ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+defer cancel()
+raw := client.Protocol()
+for _, tc := range []struct {
+name  string
+send  func() error
+pause time.Duration
+}{
+{"Expired", func() error {
+if err := raw.SendMessage(MessageTypeStreamStart, 100, &StreamHeader{OriginalType: 42, TotalSize: 6, TotalChunks: 2}); err != nil {
+return err
+}
+return raw.SendMessage(MessageTypeStreamChunk, 100, &StreamChunk{ChunkIndex: 0, Data: []byte("abc")})
+}, 100 * time.Millisecond},
+{"OverLimit", func() error {
+if err := raw.SendMessage(MessageTypeStreamStart, 101, &StreamHeader{OriginalType: 42, TotalSize: 4096, TotalChunks: 1}); err != nil {
+return err
+}
+return raw.SendMessage(MessageTypeStreamChunk, 101, &StreamChunk{ChunkIndex: 0, Data: make([]byte, 4096)})
+}, 0},
+} {
+if err := tc.send(); err != nil {
+t.Fatalf("%s: sending failed: %v", tc.name, err)
+}
+time.Sleep(tc.pause)
+// The served connection stays usable after the stream is lost
+if _, _, err := client.Call(ctx, MsgTypeLogin, &LoginPayload{Username: tc.name}); err != nil {
+t.Fatalf("%s: Call failed: %v", tc.name, err)
+}
+select {
+case err := <-peer.Errors():
+var streamErr *StreamError
+if !errors.As(err, &streamErr) {
+t.Errorf("%s: expected a *StreamError, got %v", tc.name, err)
+}
+case <-time.After(5 * time.Second):
+t.Fatalf("%s: stream error was not reported", tc.name)
+}
+}
+}
+
+func TestStreamedMessageRegistry(t *testing.T) {
+a, b := net.Pipe()
+defer a.Close()
+defer b.Close()
+streamCfg := &StreamConfig{Threshold: 100, ChunkSize: 32, Enabled: true}
+registry := NewPayloadRegistry()
+registry.Register(77, func() PayloadUnmarshaler { return &DataPayload{} })
+sender := NewProtocol(a, &MessageOptions{StreamConfig: streamCfg})
+receiver := NewProtocol(b, &MessageOptions{StreamConfig: streamCfg, Registry: registry, StrictMode: true})
+
+data := &DataPayload{ID: "big", Data: bytes.Repeat([]byte{7}, 500)}
+go func() {
+sender.SendMessage(77, 1, data)
+// Registered globally, but not in the receiver's registry
+sender.SendMessage(MsgTypeData, 2, data)
+}()
+
+msg, payload, err := receiver.ReceiveMessage()
+if err != nil {
+t.Fatalf("ReceiveMessage failed: %v", err)
+}
+if got, ok := payload.(*DataPayload); !ok || msg.ID != 1 || !bytes.Equal(got.Data, data.Data) {
+t.Fatalf("Expected DataPayload from the custom registry, got %T", payload)
+}
+if _, _, err := receiver.ReceiveMessage(); err != ErrUnknownMessageType {
+t.Fatalf("Expected ErrUnknownMessageType for streamed message in strict mode, got: %v", err)
+}
+}
+
+func TestSignedStream(t *testing.T) {
+secret := []byte("stream-secret")
+streamCfg := &StreamConfig{Threshold: 100, ChunkSize: 32, Enabled: true}
+opts := SecureMessageOptions(secret)
+opts.StreamConfig = streamCfg
+
+// A signed stream verifies as a whole
+sender, receiver := loopbackProtocols(t, "tcp", opts)
+payload := bytes.Repeat([]byte("0123456789"), 50)
+go sender.SendMessage(42, 1, payload)
+msg, _, err := receiver.ReceiveMessage()
+if err != nil {
+t.Fatalf("ReceiveMessage failed: %v", err)
+}
+if !bytes.Equal(msg.Payload, payload) || len(msg.Signature) == 0 {
+t.Fatalf("Unexpected signed stream: %d bytes, signature %x", len(msg.Payload), msg.Signature)
+}
+
+// Individually signed chunks that don't add up to the signed message are rejected
+a, b := net.Pipe()
+defer a.Close()
+defer b.Close()
+spliced := NewProtocol(b, opts)
+good, err := MarshalMessage(42, 2, []byte("abcdef"), opts)
+if err != nil {
+t.Fatal(err)
+}
+signature := good[len(good)-32:]
+header := &StreamHeader{OriginalType: 42, TotalSize: 6, TotalChunks: 2}
+sendFrames(t, a, opts, []Outgoing{
+{Type: MessageTypeStreamStart, ID: 2, Payload: header},
+{Type: MessageTypeStreamChunk, ID: 2, Payload: &StreamChunk{ChunkIndex: 0, Data: []byte("abc")}},
+{Type: MessageTypeStreamChunk, ID: 2, Payload: &StreamChunk{ChunkIndex: 1, Data: []byte("xyz")}},
+{Type: MessageTypeStreamEnd, ID: 2, Payload: signature},
+{Type: MessageTypeStreamStart, ID: 3, Payload: header},
+{Type: MessageTypeStreamChunk, ID: 3, Payload: &StreamChunk{ChunkIndex: 0, Data: []byte("abc")}},
+{Type: MessageTypeStreamChunk, ID: 3, Payload: &StreamChunk{ChunkIndex: 1, Data: []byte("def")}},
+{Type: MessageTypeStreamEnd, ID: 3, Payload: []byte{}},
+{Type: MessageTypeStreamStart, ID: 2, Payload: header},
+{Type: MessageTypeStreamChunk, ID: 2, Payload: &StreamChunk{ChunkIndex: 1, Data: []byte("def")}},
+{Type: MessageTypeStreamChunk, ID: 2, Payload: &StreamChunk{ChunkIndex: 0, Data: []byte("abc")}},
+{Type: MessageTypeStreamEnd, ID: 2, Payload: signature},
+}, 0)
+expectStreamError(t, spliced, 2, ErrInvalidSignature)
+expectStreamError(t, spliced, 3, ErrSignatureRequired)
+expectMessage(t, spliced, 2, "abcdef")
+}
+
+func TestStreamIntegrity(t *testing.T) {
+streamCfg := &StreamConfig{Threshold: 100, ChunkSize: 32, Enabled: true, Integrity: true}
+
+// The digest travels in the header and is checked on arrival
+sender, receiver := loopbackProtocols(t, "tcp", &MessageOptions{StreamConfig: streamCfg})
+payload := bytes.Repeat([]byte("0123456789"), 50)
+go sender.SendMessage(42, 1, payload)
+msg, _, err := receiver.ReceiveMessage()
+if err != nil {
+t.Fatalf("ReceiveMessage failed: %v", err)
+}
+if !bytes.Equal(msg.Payload, payload) {
+t.Fatalf("Payload mismatch: got %d bytes", len(msg.Payload))
+}
+
+// Corrupted chunks are caught before delivery, in or out of order
+a, b := net.Pipe()
+defer a.Close()
+defer b.Close()
+corrupted := NewProtocol(b, nil)
+header := &StreamHeader{OriginalType: 42, TotalSize: 6, TotalChunks: 2, Digest: payloadDigest([]byte("abcdef"))}
+sendFrames(t, a, nil, []Outgoing{
+{Type: MessageTypeStreamStart, ID: 2, Payload: header},
+{Type: MessageTypeStreamChunk, ID: 2, Payload: &StreamChunk{ChunkIndex: 0, Data: []byte("abc")}},
+{Type: MessageTypeStreamChunk, ID: 2, Payload: &StreamChunk{ChunkIndex: 1, Data: []byte("xyz")}},
+{Type: MessageTypeStreamStart, ID: 3, Payload: header},
+{Type: MessageTypeStreamChunk, ID: 3, Payload: &StreamChunk{ChunkIndex: 1, Data: []byte("def")}},
+{Type: MessageTypeStreamChunk, ID: 3, Payload: &StreamChunk{ChunkIndex: 0, Data: []byte("abx")}},
+{Type: MessageTypeStreamStart, ID: 4, Payload: &StreamHeader{OriginalType: 42, TotalSize: 6, TotalChunks: 2, Digest: []byte("short")}},
+{Type: MessageTypeStreamStart, ID: 5, Payload: header},
+{Type: MessageTypeStreamChunk, ID: 5, Payload: &StreamChunk{ChunkIndex: 1, Data: []byte("def")}},
+{Type: MessageTypeStreamChunk, ID: 5, Payload: &StreamChunk{ChunkIndex: 0, Data: []byte("abc")}},
+}, 0)
+expectStreamError(t, corrupted, 2, ErrStreamIntegrity)
+expectStreamError(t, corrupted, 3, ErrStreamIntegrity)
+expectStreamError(t, corrupted, 4, ErrStreamMismatch)
+expectMessage(t, corrupted, 5, "abcdef")
+
+// Open-ended streams carry the digest in the end marker, signed with a Signer
+for _, opts := range []*MessageOptions{{StreamConfig: streamCfg}, SecureMessageOptions([]byte("stream-secret"))} {
+sender, receiver := loopbackProtocols(t, "tcp", opts)
+results := make(chan error, 1)
+receiver.SetStreamHandler(func(msg *Message, r io.Reader) {
+data, err := io.ReadAll(r)
+if err == nil && !bytes.Equal(data, payload) {
+err = fmt.Errorf("got %d bytes", len(data))
+}
+results <- err
+})
+_, errs := receiveLoop(receiver)
+if _, err := sender.SendStream(context.Background(), 42, bytes.NewReader(payload)); err != nil {
+t.Fatalf("SendStream failed: %v", err)
+}
+if err := <-results; err != nil {
+t.Fatalf("Reading verified stream failed: %v", err)
+}
+select {
+case err := <-errs:
+t.Fatalf("Unexpected error: %v", err)
+default:
+}
+}
+
+// A mismatching digest fails the handler's Read instead of io.EOF
+c, d := net.Pipe()
+defer c.Close()
+defer d.Close()
+tampered := NewProtocol(d, nil)
+results := make(chan error, 1)
+tampered.SetStreamHandler(func(msg *Message, r io.Reader) {
+_, err := io.ReadAll(r)
+results <- err
+})
+digest := openStreamDigest(42, 6)
+digest.Write([]byte("abc"))
+sendFrames(t, c, nil, []Outgoing{
+{Type: MessageTypeStreamStart, ID: 6, Payload: &StreamHeader{OriginalType: 42, TotalChunks: UnknownStreamChunks}},
+{Type: MessageTypeStreamChunk, ID: 6, Payload: &StreamChunk{ChunkIndex: 0, Data: []byte("abx")}},
+{Type: MessageTypeStreamEnd, ID: 6, Payload: digest.Sum(nil)},
+}, 0)
+expectStreamError(t, tampered, 6, ErrStreamIntegrity)
+if err := <-results; !errors.Is(err, ErrStreamIntegrity) {
+t.Fatalf("Expected ErrStreamIntegrity from Read, got: %v", err)
+}
+
+// The running digest in each chunk stops bad data before the handler reads it,
+// and a receiver with Integrity refuses streams without digests
+e, f := net.Pipe()
+defer e.Close()
+defer f.Close()
+strict := NewProtocol(f, &MessageOptions{StreamConfig: streamCfg})
+reads := make(chan string, 4)
+strict.SetStreamHandler(func(msg *Message, r io.Reader) {
+data, err := io.ReadAll(r)
+reads <- fmt.Sprintf("%d:%s:%v", msg.ID, data, err)
+})
+sendFrames(t, e, nil, []Outgoing{
+{Type: MessageTypeStreamStart, ID: 6, Payload: &StreamHeader{OriginalType: 42, TotalChunks: UnknownStreamChunks}},
+{Type: MessageTypeStreamChunk, ID: 6, Payload: &StreamChunk{ChunkIndex: 0, Data: []byte("abx"), Digest: digest.Sum(nil)}},
+{Type: MessageTypeStreamStart, ID: 7, Payload: &StreamHeader{OriginalType: 42, TotalChunks: UnknownStreamChunks}},
+{Type: MessageTypeStreamChunk, ID: 7, Payload: &StreamChunk{ChunkIndex: 0, Data: []byte("abc")}},
+{Type: MessageTypeStreamStart, ID: 6, Payload: &StreamHeader{OriginalType: 42, TotalChunks: UnknownStreamChunks}},
+{Type: MessageTypeStreamChunk, ID: 6, Payload: &StreamChunk{ChunkIndex: 0, Data: []byte("abc"), Digest: digest.Sum(nil)}},
+{Type: MessageTypeStreamEnd, ID: 6, Payload: []byte{}},
+{Type: MessageTypeStreamStart, ID: 8, Payload: &StreamHeader{OriginalType: 42, TotalSize: 6, TotalChunks: 2}},
+}, 0)
+expectStreamError(t, strict, 6, ErrStreamIntegrity)
+expectStreamError(t, strict, 7, ErrStreamIntegrity)
+expectStreamError(t, strict, 6, ErrStreamIntegrity)
+expectStreamError(t, strict, 8, ErrStreamIntegrity)
+got := map[string]bool{<-reads: true, <-reads: true, <-reads: true}
+for _, want := range []string{"6::stream 6: ", "7::stream 7: ", "6:abc:stream 6: "} {
+if want += ErrStreamIntegrity.Error(); !got[want] {
+t.Errorf("Expected handler result %q, got %v", want, got)
+}
+}
+}
+
+func TestStreamProgress(t *testing.T) {
+var mu sync.Mutex
+var sent, received []StreamProgress
+streamCfg := &StreamConfig{
+Threshold: 100,
+ChunkSize: 32,
+Enabled:   true,
+OnSendProgress: func(p StreamProgress) {
+mu.Lock()
+sent = append(sent, p)
+mu.Unlock()
+},
+OnReceiveProgress: func(p StreamProgress) {
+mu.Lock()
+received = append(received, p)
+mu.Unlock()
+},
+}
+sender, receiver := loopbackProtocols(t, "tcp", &MessageOptions{StreamConfig: streamCfg})
+
+// 500 bytes in 16 chunks, the last one 20 bytes
+payload := bytes.Repeat([]byte("0123456789"), 50)
+done := make(chan error, 1)
+go func() { done <- sender.SendMessage(42, 1, payload) }()
+if _, _, err := receiver.ReceiveMessage(); err != nil {
+t.Fatalf("ReceiveMessage failed: %v", err)
+}
+if err := <-done; err != nil {
+t.Fatalf("SendMessage failed: %v", err)
+}
+
+mu.Lock()
+defer mu.Unlock()
+for name, reports := range map[string][]StreamProgress{"send": sent, "receive": received} {
+if len(reports) != 16 {
+t.Fatalf("Expected 16 %s reports, got %d", name, len(reports))
+}
+for i, p := range reports {
+want := StreamProgress{ID: 1, Type: 42, Bytes: uint64(min(32*(i+1), 500)), Chunks: uint32(i + 1), TotalSize: 500, TotalChunks: 16}
+if p != want {
+t.Errorf("Unexpected %s report %d: got %+v, want %+v", name, i, p, want)
+}
+}
+}
+}
+
+func TestStreamRateLimit(t *testing.T) {
+streamCfg := &StreamConfig{Threshold: 1024, ChunkSize: 1024, Enabled: true, RateLimit: 32 * 1024}
+sender, receiver := loopbackProtocols(t, "tcp", &MessageOptions{StreamConfig: streamCfg})
+msgs, _ := receiveLoop(receiver)
+
+// The first chunk goes out at once, the other 15 take about 470ms
+start := time.Now()
+if err := sender.SendMessage(42, 1, make([]byte, 16*1024)); err != nil {
+t.Fatalf("SendMessage failed: %v", err)
+}
+if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+t.Errorf("Expected the stream to take about 470ms, took %v", elapsed)
+}
+<-msgs
+
+// Direct messages are not limited
+start = time.Now()
+for i := 0; i < 100; i++ {
+if _, err := sender.Send(42, make([]byte, 512)); err != nil {
+t.Fatal(err)
+}
+}
+if elapsed := time.Since(start); elapsed > time.Second {
+t.Errorf("Direct messages were throttled: took %v", elapsed)
+}
+
+// A waiting SendStream gives up when its context is done
+ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+defer cancel()
+if _, err := sender.SendStream(ctx, 42, bytes.NewReader(make([]byte, 16*1024))); err != context.DeadlineExceeded {
+t.Errorf("Expected context.DeadlineExceeded, got: %v", err)
+}
+
+// SetStreamConfig changes the limit of a running Protocol
+unlimited := *streamCfg
+unlimited.RateLimit = 0
+sender.SetStreamConfig(&unlimited)
+start = time.Now()
+if err := sender.SendMessage(42, 2, make([]byte, 16*1024)); err != nil {
+t.Fatalf("SendMessage failed: %v", err)
+}
+if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+t.Errorf("Expected an unlimited stream, took %v", elapsed)
+}
+
+limited := unlimited
+limited.RateLimit = 32 * 1024
+sender.SetStreamConfig(&limited)
+start = time.Now()
+if err := sender.SendMessage(42, 3, make([]byte, 16*1024)); err != nil {
+t.Fatalf("SendMessage failed: %v", err)
+}
+if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+t.Errorf("Expected a RateLimit set later to apply, took %v", elapsed)
+}
+}
+
+// expectCanceled checks that err is a CancelError with the given reason and origin
+func expectCanceled(t *testing.T, err error, reason StreamCancelReason, remote bool) {
+t.Helper()
+var cancelErr *CancelError
+if !errors.As(err, &cancelErr) || !errors.Is(err, ErrStreamCanceled) || cancelErr.Reason != reason || cancelErr.Remote != remote {
+t.Fatalf("Expected CancelError %v (remote %v), got: %v", reason, remote, err)
+}
+}
+
+func TestStreamCancel(t *testing.T) {
+var sender, receiver *Protocol
+var cancelAt, rejectAt uint32
+streamCfg := &StreamConfig{
+Threshold: 1024,
+ChunkSize: 1024,
+Enabled:   true,
+RateLimit: 256 * 1024,
+OnSendProgress: func(p StreamProgress) {
+if p.Chunks == cancelAt {
+sender.CancelStream(p.ID, CancelApplication+1)
+}
+},
+OnReceiveProgress: func(p StreamProgress) {
+if p.Chunks == rejectAt {
+receiver.RejectStream(p.ID, CancelUnauthorized)
+}
+},
+}
+sender, receiver = loopbackProtocols(t, "tcp", &MessageOptions{StreamConfig: streamCfg})
+senderErrs := make(chan error, 1)
+go func() {
+_, _, err := sender.ReceiveMessage()
+senderErrs <- err
+}()
+// 256KB takes a second at the rate limit
+payload := make([]byte, 256*1024)
+
+// The sender cancels: both ends stop and the connection carries on
+cancelAt = 2
+sent := make(chan error, 1)
+go func() { sent <- sender.SendMessage(42, 1, payload) }()
+_, _, err := receiver.ReceiveMessage()
+var streamErr *StreamError
+if !errors.As(err, &streamErr) || streamErr.ID != 1 {
+t.Fatalf("Expected StreamError for stream 1, got: %v", err)
+}
+expectCanceled(t, err, CancelApplication+1, true)
+expectCanceled(t, <-sent, CancelApplication+1, false)
+if err := sender.CancelStream(1, CancelAborted); err != ErrStreamNotActive {
+t.Errorf("Expected ErrStreamNotActive for a finished stream, got: %v", err)
+}
+
+// The receiver rejects: the sender stops early
+cancelAt, rejectAt = 0, 2
+start := time.Now()
+go func() { sent <- sender.SendMessage(42, 2, payload) }()
+next := make(chan *Message, 1)
+go func() {
+msg, _, _ := receiver.ReceiveMessage()
+next <- msg
+}()
+expectCanceled(t, <-sent, CancelUnauthorized, true)
+if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+t.Errorf("Rejected stream took %v to stop", elapsed)
+}
+if err := sender.SendMessage(42, 3, []byte("after")); err != nil {
+t.Fatal(err)
+}
+if msg := <-next; msg == nil || msg.ID != 3 {
+t.Fatalf("Expected message 3 after the rejected stream, got %+v", msg)
+}
+if err := receiver.RejectStream(2, CancelRejected); err != ErrStreamNotActive {
+t.Errorf("Expected ErrStreamNotActive for a rejected stream, got: %v", err)
+}
+
+// A stream the receiver can't take is rejected automatically
+rejectAt = 0
+streamErrs := make(chan error, 1)
+go func() {
+_, _, err := receiver.ReceiveMessage()
+streamErrs <- err
+}()
+_, err = sender.SendStream(context.Background(), 42, bytes.NewReader(payload))
+expectCanceled(t, err, CancelRejected, true)
+if err := <-streamErrs; !errors.Is(err, ErrNoStreamHandler) {
+t.Fatalf("Expected ErrNoStreamHandler, got: %v", err)
+}
+
+// A sender that gives up cancels the stream instead of leaving it to time out
+read := make(chan error, 1)
+receiver.SetStreamHandler(func(msg *Message, r io.Reader) {
+_, err := io.ReadAll(r)
+read <- err
+})
+ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+defer cancel()
+if _, err := sender.SendStream(ctx, 42, bytes.NewReader(payload)); err != context.DeadlineExceeded {
+t.Fatalf("Expected context.DeadlineExceeded, got: %v", err)
+}
+go receiver.ReceiveMessage()
+expectCanceled(t, <-read, CancelAborted, true)
+
+select {
+case err := <-senderErrs:
+t.Fatalf("Sender's receive loop failed: %v", err)
+default:
+}
+}
+
+func TestChannels(t *testing.T) {
+opts := &MessageOptions{ChannelWindow: 4096}
+sender, receiver := loopbackProtocols(t, "tcp", opts)
+receiveLoop(sender) // credit arrives through the sender's receive loop
+msgs, errs := receiveLoop(receiver)
+
+type delivery struct {
+channel uint32
+payload string
+}
+delivered := make(chan delivery, 256)
+gate := make(chan struct{})
+slow, err := receiver.OpenChannel(1, func(msg *Message, payload interface{}) {
+<-gate
+delivered <- delivery{1, string(msg.Payload)}
+})
+if err != nil {
+t.Fatal(err)
+}
+if _, err := receiver.OpenChannel(1, nil); err != ErrChannelExists {
+t.Errorf("Expected ErrChannelExists, got: %v", err)
+}
+receiver.OpenChannel(2, func(msg *Message, payload interface{}) {
+delivered <- delivery{2, string(msg.Payload)}
+})
+
+// Send-only on this side
+bulk, _ := sender.OpenChannel(1, nil)
+control, _ := sender.OpenChannel(2, nil)
+
+// The stalled channel runs out of credit after about a window's worth
+ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+defer cancel()
+sent := 0
+for ; sent < 100; sent++ {
+if _, err := bulk.Send(ctx, 42, []byte(fmt.Sprintf("%04d", sent)+strings.Repeat("x", 996))); err != nil {
+if err != context.DeadlineExceeded {
+t.Fatalf("Expected context.DeadlineExceeded, got: %v", err)
+}
+break
+}
+}
+if sent == 0 || sent > 5 {
+t.Fatalf("Expected the window to stop the stalled channel after a few messages, sent %d", sent)
+}
+
+// Other channels and direct messages are unaffected
+for i := 0; i < 50; i++ {
+if _, err := control.Send(context.Background(), 42, []byte(fmt.Sprint(i))); err != nil {
+t.Fatalf("Send on channel 2 failed: %v", err)
+}
+}
+for i := 0; i < 50; i++ {
+if d := <-delivered; d.channel != 2 || d.payload != fmt.Sprint(i) {
+t.Fatalf("Expected message %d on channel 2, got %+v", i, d)
+}
+}
+if _, err := sender.Send(42, []byte("direct")); err != nil {
+t.Fatal(err)
+}
+if msg := <-msgs; string(msg.Payload) != "direct" {
+t.Fatalf("Expected direct message, got %q", msg.Payload)
+}
+
+// Once the handler catches up, credit comes back and order is kept
+close(gate)
+for i := 0; i < sent; i++ {
+if d := <-delivered; d.channel != 1 || d.payload[:4] != fmt.Sprintf("%04d", i) {
+t.Fatalf("Expected message %d on channel 1, got %+v", i, d.payload[:4])
+}
+}
+for i := sent; i < sent+20; i++ {
+if _, err := bulk.Send(context.Background(), 42, []byte(fmt.Sprintf("%04d", i)+strings.Repeat("x", 996))); err != nil {
+t.Fatalf("Send after catching up failed: %v", err)
+}
+if d := <-delivered; d.payload[:4] != fmt.Sprintf("%04d", i) {
+t.Fatalf("Expected message %d on channel 1, got %+v", i, d.payload[:4])
+}
+}
+
+// Opening order doesn't matter
+early, _ := sender.OpenChannel(3, nil)
+receiver.OpenChannel(4, func(msg *Message, payload interface{}) {
+delivered <- delivery{4, string(msg.Payload)}
+})
+time.Sleep(50 * time.Millisecond)
+late, _ := sender.OpenChannel(4, nil)
+if _, err := late.Send(context.Background(), 42, []byte("late")); err != nil {
+t.Fatal(err)
+}
+if d := <-delivered; d.channel != 4 {
+t.Fatalf("Expected message on channel 4, got %+v", d)
+}
+sendDone := make(chan error, 1)
+go func() {
+_, err := early.Send(context.Background(), 42, []byte("early"))
+sendDone <- err
+}()
+receiver.OpenChannel(3, func(msg *Message, payload interface{}) {
+delivered <- delivery{3, string(msg.Payload)}
+})
+if err := <-sendDone; err != nil {
+t.Fatal(err)
+}
+if d := <-delivered; d.channel != 3 || d.payload != "early" {
+t.Fatalf("Expected message on channel 3, got %+v", d)
+}
+
+// Closing a channel releases waiting senders
+stalled, _ := sender.OpenChannel(5, nil)
+go func() {
+_, err := stalled.Send(context.Background(), 42, []byte("never"))
+sendDone <- err
+}()
+time.Sleep(20 * time.Millisecond)
+stalled.Close()
+if err := <-sendDone; err != ErrChannelClosed {
+t.Errorf("Expected ErrChannelClosed, got: %v", err)
+}
+
+// The peer is told, and the id is free again once both sides have closed it
+slow.Close()
+select {
+case <-bulk.done:
+case <-time.After(5 * time.Second):
+t.Fatal("Peer's channel not closed")
+}
+if _, err := bulk.Send(context.Background(), 42, []byte("closed")); err != ErrChannelClosed {
+t.Errorf("Expected ErrChannelClosed on the peer's channel, got: %v", err)
+}
+reopen := func(p *Protocol, id uint32, handler ChannelHandler) *Channel {
+t.Helper()
+deadline := time.Now().Add(5 * time.Second)
+for {
+c, err := p.OpenChannel(id, handler)
+if err == nil {
+return c
+}
+if err != ErrChannelClosed || time.Now().After(deadline) {
+t.Fatalf("Reopening channel %d failed: %v", id, err)
+}
+time.Sleep(5 * time.Millisecond)
+}
+}
+reopen(receiver, 1, func(msg *Message, payload interface{}) {
+delivered <- delivery{1, string(msg.Payload)}
+})
+reopened := reopen(sender, 1, nil)
+if _, err := reopened.Send(context.Background(), 42, []byte("again")); err != nil {
+t.Fatalf("Send on reopened channel failed: %v", err)
+}
+if d := <-delivered; d.channel != 1 || d.payload != "again" {
+t.Fatalf("Expected message on reopened channel 1, got %+v", d)
+}
+reopen(sender, 5, nil)
+
+// Channels beyond the credit held for unopened ones are refused, not left without credit
+var refused *Channel
+for id := uint32(100); id <= 100+maxPendingCredits; id++ {
+refused = reopen(receiver, id, func(msg *Message, payload interface{}) {
+delivered <- delivery{id, string(msg.Payload)}
+})
+}
+select {
+case <-refused.done:
+case <-time.After(5 * time.Second):
+t.Fatal("Channel beyond the pending credit limit not refused")
+}
+first := reopen(sender, 100, nil)
+if _, err := first.Send(context.Background(), 42, []byte("pending")); err != nil {
+t.Fatalf("Send with pending credit failed: %v", err)
+}
+if d := <-delivered; d.channel != 100 || d.payload != "pending" {
+t.Fatalf("Expected message on channel 100, got %+v", d)
+}
+select {
+case err := <-errs:
+t.Fatalf("Unexpected receive error: %v", err)
+default:
+}
+}
+
+func TestChannelViolations(t *testing.T) {
+a, b := net.Pipe()
+defer a.Close()
+defer b.Close()
+go io.Copy(io.Discard, a) // credit grants
+receiver := NewProtocol(b, &MessageOptions{ChannelWindow: 4096})
+// A stalled handler never returns credit
+gate := make(chan struct{})
+defer close(gate)
+receiver.OpenChannel(1, func(msg *Message, payload interface{}) { <-gate })
+
+data := func(channel uint32, n int) *channelFrame {
+return &channelFrame{channel: channel, messageType: 42, payload: make([]byte, n)}
+}
+sendFrames(t, a, nil, []Outgoing{
+{Type: MessageTypeExtension, ID: 1, Payload: data(2, 10)},
+{Type: MessageTypeExtension, ID: 2, Payload: []byte{99, 1, 2, 3}}, // unknown kind, ignored
+{Type: MessageTypeExtension, ID: 3, Payload: data(1, 3000)},
+{Type: MessageTypeExtension, ID: 4, Payload: data(1, 3000)},
+{Type: MessageTypeExtension, ID: 5, Payload: data(1, 3000)},
+{Type: 42, ID: 6, Payload: []byte("direct")},
+}, 0)
+
+expectChannelError := func(id uint32, target error) {
+t.Helper()
+_, _, err := receiver.ReceiveMessage()
+var channelErr *ChannelError
+if !errors.As(err, &channelErr) || channelErr.ID != id || !errors.Is(err, target) {
+t.Fatalf("Expected ChannelError for message %d wrapping %v, got: %v", id, target, err)
+}
+}
+expectChannelError(1, ErrChannelNotOpen)
+// The window is 4096: the second message overdraws it, the third exceeds it
+expectChannelError(5, ErrChannelWindow)
+expectMessage(t, receiver, 6, "direct")
+}
+
+// receiveLoop runs ReceiveMessage until it fails, forwarding messages and errors
+func receiveLoop(p *Protocol) (<-chan *Message, <-chan error) {
+msgs := make(chan *Message, 16)
+errs := make(chan error, 16)
+go func() {
+for {
+msg, _, err := p.ReceiveMessage()
+if err != nil {
+errs <- err
+var streamErr *StreamError
+if errors.As(err, &streamErr) {
+continue
+}
+return
+}
+msgs <- msg
+}
+}()
+return msgs, errs
+}
+
+// newCallServer starts a Server routing calls through mux and returns a started client connected to it
+func newCallServer(t *testing.T, mux *ServeMux) *Client {
+t.Helper()
+listener, err := net.Listen("tcp", "127.0.0.1:0")
+if err != nil {
+t.Fatalf("Failed to create listener: %v", err)
+}
+server := NewServer(listener, nil)
+server.SetConnectionHandler(mux.ServeClient)
+server.StartAsync()
+
+conn, err := net.Dial("tcp", listener.Addr().String())
+if err != nil {
+t.Fatalf("Failed to connect: %v", err)
+}
+client := NewClient(conn, nil)
+client.Start()
+t.Cleanup(func() {
+client.Close()
+server.Stop()
+})
+return client
+}
+
+func TestStreamingCalls(t *testing.T) {
+const (
+methodWatch  byte = 1
+methodEcho   byte = 2
+methodFail   byte = 3
+methodBroken byte = 4
+count             = 5 * callWindow // beyond the window, so credit must flow
+)
+mux := NewServeMux()
+
+// Server streaming: one request, many replies
+mux.HandleCall(methodWatch, func(call *Call) error {
+if _, ok := ClientFromContext(call.Context()); !ok {
+return errors.New("missing client in context")
+}
+_, payload, err := call.Recv()
+if err != nil {
+return err
+}
+login := payload.(*LoginPayload)
+if _, _, err := call.Recv(); err != io.EOF {
+return fmt.Errorf("expected io.EOF after half-close, got %v", err)
+}
+for i := 0; i < count; i++ {
+if err := call.Send(MsgTypeResponse, &ResponsePayload{Message: fmt.Sprintf("%s %d", login.Username, i)}); err != nil {
+return err
+}
+}
+return nil
+})
+
+// Bidirectional: echo every message, then half-close before returning
+mux.HandleCall(methodEcho, func(call *Call) error {
+for {
+_, payload, err := call.Recv()
+if err == io.EOF {
+break
+}
+if err != nil {
+return err
+}
+if err := call.Send(MsgTypeResponse, &ResponsePayload{Message: payload.(*LoginPayload).Username}); err != nil {
+return err
+}
+}
+if err := call.CloseSend(); err != nil {
+return err
+}
+if err := call.Send(MsgTypeResponse, &ResponsePayload{}); !errors.Is(err, ErrCallClosed) {
+return fmt.Errorf("expected ErrCallClosed after CloseSend, got %v", err)
+}
+return nil
+})
+
+mux.HandleCall(methodFail, func(call *Call) error {
+if err := call.Send(MsgTypeResponse, &ResponsePayload{Message: "partial"}); err != nil {
+return err
+}
+return &StatusError{
+Code:    StatusNotFound,
+Message: "no such feed",
+Details: []StatusDetail{{Type: MsgTypeResponse, Payload: &ResponsePayload{Message: "feeds: news"}}},
+}
+})
+mux.HandleCall(methodBroken, func(call *Call) error {
+return errors.New("broken")
+})
+
+client := newCallServer(t, mux)
+ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+defer cancel()
+
+t.Run("ServerStreaming", func(t *testing.T) {
+call, err := client.OpenCall(ctx, methodWatch)
+if err != nil {
+t.Fatalf("OpenCall failed: %v", err)
 }
+if err := call.Send(MsgTypeLogin, &LoginPayload{Username: "alice"}); err != nil {
+t.Fatalf("Send failed: %v", err)
+}
+if err := call.CloseSend(); err != nil {
+t.Fatalf("CloseSend failed: %v", err)
+}
+for i := 0; i < count; i++ {
+msg, payload, err := call.Recv()
+if err != nil {
+t.Fatalf("Recv %d failed: %v", i, err)
+}
+if msg.ID != call.ID() || msg.Type != MsgTypeResponse {
+t.Fatalf("Message %d: got ID %d type %d", i, msg.ID, msg.Type)
+}
+if want := fmt.Sprintf("alice %d", i); payload.(*ResponsePayload).Message != want {
+t.Fatalf("Message %d: got %q, want %q", i, payload.(*ResponsePayload).Message, want)
+}
+}
+if _, _, err := call.Recv(); err != io.EOF {
+t.Fatalf("Expected io.EOF once the call ended, got %v", err)
+}
+if call.Err() != nil {
+t.Errorf("Expected the call to end with StatusOK, got %v", call.Err())
+}
+if err := call.Send(MsgTypeLogin, &LoginPayload{}); !errors.Is(err, ErrCallClosed) {
+t.Errorf("Expected ErrCallClosed from Send after the end, got %v", err)
+}
+})
 
-func TestStreamChunk(t *testing.T) {
-original := &StreamChunk{
-ChunkIndex: 42,
-Data:       []byte{0xDE, 0xAD, 0xBE, 0xEF},
+t.Run("Bidirectional", func(t *testing.T) {
+call, err := client.OpenCall(ctx, methodEcho)
+if err != nil {
+t.Fatalf("OpenCall failed: %v", err)
+}
+errc := make(chan error, 1)
+go func() {
+for i := 0; i < count; i++ {
+if err := call.Send(MsgTypeLogin, &LoginPayload{Username: fmt.Sprint(i)}); err != nil {
+errc <- err
+return
+}
+}
+errc <- call.CloseSend()
+}()
+for i := 0; i < count; i++ {
+_, payload, err := call.Recv()
+if err != nil {
+t.Fatalf("Recv %d failed: %v", i, err)
 }
+if got := payload.(*ResponsePayload).Message; got != fmt.Sprint(i) {
+t.Fatalf("Echo %d: got %q", i, got)
+}
+}
+if err := <-errc; err != nil {
+t.Fatalf("Sending failed: %v", err)
+}
+if _, _, err := call.Recv(); err != io.EOF {
+t.Fatalf("Expected io.EOF, got %v", err)
+}
+})
 
-data, err := original.Marshal()
+t.Run("Status", func(t *testing.T) {
+call, err := client.OpenCall(ctx, methodFail)
 if err != nil {
-t.Fatalf("Marshal failed: %v", err)
+t.Fatalf("OpenCall failed: %v", err)
+}
+// Messages sent before the error are still received
+if _, payload, err := call.Recv(); err != nil || payload.(*ResponsePayload).Message != "partial" {
+t.Fatalf("Expected the partial message, got %v, %v", payload, err)
+}
+_, _, err = call.Recv()
+var statusErr *StatusError
+if !errors.As(err, &statusErr) || statusErr.Code != StatusNotFound || statusErr.Message != "no such feed" {
+t.Fatalf("Expected StatusNotFound, got %v", err)
+}
+if len(statusErr.Details) != 1 || statusErr.Details[0].Payload.(*ResponsePayload).Message != "feeds: news" {
+t.Errorf("Details mismatch: %+v", statusErr.Details)
+}
+<-call.Done()
+if err := call.Send(MsgTypeLogin, &LoginPayload{}); !errors.As(err, &statusErr) {
+t.Errorf("Expected Send to return the status, got %v", err)
 }
 
-decoded := &StreamChunk{}
-if err := decoded.Unmarshal(data); err != nil {
+for method, code := range map[byte]StatusCode{methodBroken: StatusUnknown, 42: StatusUnimplemented} {
+call, err := client.OpenCall(ctx, method)
+if err != nil {
+t.Fatalf("OpenCall failed: %v", err)
+}
+if _, _, err := call.Recv(); !errors.As(err, &statusErr) || statusErr.Code != code {
+t.Errorf("Method %d: expected %v, got %v", method, code, err)
+}
+}
+})
+
+if _, err := client.OpenCall(ctx, MessageTypeExtension); !errors.Is(err, ErrInvalidMessage) {
+t.Errorf("Expected ErrInvalidMessage for a reserved method, got %v", err)
+}
+}
+
+func TestCallEnds(t *testing.T) {
+const methodHold byte = 1
+started := make(chan *Call, 2)
+ended := make(chan error, 2)
+
+server, client := newClientPair(t, nil, nil, nil)
+server.SetCallHandler(func(call *Call) error {
+started <- call
+// Recv fails once the caller gives up
+_, _, err := call.Recv()
+ended <- err
+return err
+})
+server.SetHandler(func(msg *Message, payload interface{}) error {
+return server.Reply(msg, MsgTypeResponse, &ResponsePayload{Success: true})
+})
+
+// Canceling the context ends the call on both sides
+ctx, cancel := context.WithCancel(context.Background())
+call, err := client.OpenCall(ctx, methodHold)
+if err != nil {
+t.Fatalf("OpenCall failed: %v", err)
+}
+<-started
+cancel()
+if _, _, err := call.Recv(); !errors.Is(err, context.Canceled) {
+t.Errorf("Expected context.Canceled, got %v", err)
+}
+select {
+case err := <-ended:
+var statusErr *StatusError
+if !errors.As(err, &statusErr) || statusErr.Code != StatusCanceled {
+t.Errorf("Expected the handler to see StatusCanceled, got %v", err)
+}
+case <-time.After(5 * time.Second):
+t.Fatal("Handler was not told the call was canceled")
+}
+
+// A call whose messages aren't received holds back only itself
+flood := make(chan error, 1)
+server.SetCallHandler(func(call *Call) error {
+for {
+if err := call.Send(MsgTypeResponse, &ResponsePayload{}); err != nil {
+flood <- err
+return err
+}
+}
+})
+ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+defer cancel()
+if _, err := client.OpenCall(ctx, methodHold); err != nil {
+t.Fatalf("OpenCall failed: %v", err)
+}
+if _, _, err := client.Call(ctx, MsgTypeLogin, &LoginPayload{Username: "bob"}); err != nil {
+t.Fatalf("Call next to a stalled call failed: %v", err)
+}
+
+// Losing the connection ends the remaining calls
+server.Close()
+select {
+case err := <-flood:
+var statusErr *StatusError
+if !errors.As(err, &statusErr) || statusErr.Code != StatusUnavailable {
+t.Errorf("Expected StatusUnavailable after disconnect, got %v", err)
+}
+case <-time.After(5 * time.Second):
+t.Fatal("Stalled call did not end after disconnect")
+}
+}
+
+func TestErrorFrame(t *testing.T) {
+status := Errorf(StatusNotFound, "no user %q", "alice")
+status.Details = []StatusDetail{
+{Type: MsgTypeResponse, Payload: &ResponsePayload{Message: "try bob"}},
+{Type: 200, Payload: []byte{1, 2, 3}},
+}
+data, err := MarshalError(42, fmt.Errorf("lookup: %w", status), nil)
+if err != nil {
+t.Fatalf("MarshalError failed: %v", err)
+}
+msg, payload, err := Unmarshal(data)
+if err != nil {
 t.Fatalf("Unmarshal failed: %v", err)
 }
+got, ok := payload.(*StatusError)
+if !ok || msg.ID != 42 {
+t.Fatalf("Expected a *StatusError for message 42, got %T for %d", payload, msg.ID)
+}
+if got.Code != StatusNotFound || got.Message != `no user "alice"` || len(got.Details) != 2 {
+t.Fatalf("Status mismatch: %+v", got)
+}
+if detail, ok := got.Details[0].Payload.(*ResponsePayload); !ok || detail.Message != "try bob" {
+t.Errorf("Registered detail not decoded: %#v", got.Details[0].Payload)
+}
+if !bytes.Equal(got.Details[1].Payload.([]byte), []byte{1, 2, 3}) {
+t.Errorf("Unregistered detail mismatch: %#v", got.Details[1].Payload)
+}
 
-if decoded.ChunkIndex != original.ChunkIndex {
-t.Errorf("ChunkIndex mismatch: got %d, want %d", decoded.ChunkIndex, original.ChunkIndex)
+for _, tc := range []struct {
+err  error
+code StatusCode
+}{
+{nil, StatusOK},
+{errors.New("boom"), StatusUnknown},
+{context.Canceled, StatusCanceled},
+{fmt.Errorf("waiting: %w", context.DeadlineExceeded), StatusDeadlineExceeded},
+{&RemoteError{ID: 1, Err: Errorf(StatusPermissionDenied, "no")}, StatusPermissionDenied},
+} {
+if code := ErrorCode(tc.err); code != tc.code {
+t.Errorf("ErrorCode(%v) = %v, want %v", tc.err, code, tc.code)
+}
+}
+if StatusFromError(errors.New("boom")).Message != "boom" {
+t.Error("Expected the error text as the status message")
 }
-if !bytes.Equal(decoded.Data, original.Data) {
-t.Errorf("Data mismatch: got %v, want %v", decoded.Data, original.Data)
+
+// Details beyond the limit are dropped by the sender, and a detail that doesn't
+// decode is kept raw
+status = Errorf(StatusInternal, "noisy")
+status.Details = append(status.Details, StatusDetail{Type: MsgTypeResponse, Payload: []byte{0xff}})
+for len(status.Details) < maxStatusDetails+10 {
+status.Details = append(status.Details, StatusDetail{Type: 200, Payload: []byte{1}})
+}
+data, err = MarshalError(43, status, nil)
+if err != nil {
+t.Fatalf("MarshalError failed: %v", err)
+}
+_, payload, err = Unmarshal(data)
+if err != nil {
+t.Fatalf("Unmarshal of a capped status failed: %v", err)
+}
+got = payload.(*StatusError)
+if len(got.Details) != maxStatusDetails {
+t.Errorf("Expected %d details, got %d", maxStatusDetails, len(got.Details))
 }
+if raw, ok := got.Details[0].Payload.([]byte); !ok || !bytes.Equal(raw, []byte{0xff}) {
+t.Errorf("Expected the undecodable detail as raw bytes, got %#v", got.Details[0].Payload)
 }
 
-func TestIsReservedType(t *testing.T) {
-if IsReservedType(1) {
-t.Error("Type 1 should not be reserved")
+// Truncated frames are rejected
+data, err = MarshalMessage(MessageTypeExtension, 1, []byte{extensionError, byte(StatusInternal), 2, 'x'}, nil)
+if err != nil {
+t.Fatalf("MarshalMessage failed: %v", err)
 }
-if IsReservedType(249) {
-t.Error("Type 249 should not be reserved")
+if _, _, err := Unmarshal(data); err == nil {
+t.Error("Expected an error for a truncated error frame")
 }
-if !IsReservedType(250) {
-t.Error("Type 250 should be reserved")
 }
-if !IsReservedType(255) {
-t.Error("Type 255 should be reserved")
+
+func TestHandlerErrorsReachPeer(t *testing.T) {
+var server *Client
+server, client := newClientPair(t, nil, func(msg *Message, payload interface{}) error {
+switch login := payload.(*LoginPayload); login.Username {
+case "denied":
+return &StatusError{
+Code:    StatusPermissionDenied,
+Message: "account locked",
+Details: []StatusDetail{{Type: MsgTypeResponse, Payload: &ResponsePayload{Message: "contact support"}}},
+}
+case "broken":
+return errors.New("database down")
+default:
+return server.Reply(msg, MsgTypeResponse, &ResponsePayload{Success: true})
+}
+}, nil)
+
+ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+defer cancel()
+
+_, _, err := client.Call(ctx, MsgTypeLogin, &LoginPayload{Username: "denied"})
+var statusErr *StatusError
+if !errors.As(err, &statusErr) || statusErr.Code != StatusPermissionDenied || statusErr.Message != "account locked" {
+t.Fatalf("Expected StatusPermissionDenied, got %v", err)
+}
+if len(statusErr.Details) != 1 || statusErr.Details[0].Payload.(*ResponsePayload).Message != "contact support" {
+t.Errorf("Details mismatch: %+v", statusErr.Details)
+}
+// The handler's side still reports its own error
+select {
+case err := <-server.Errors():
+if ErrorCode(err) != StatusPermissionDenied {
+t.Errorf("Expected the handler error on Errors, got %v", err)
+}
+case <-time.After(5 * time.Second):
+t.Fatal("Handler error was not reported locally")
+}
+
+_, _, err = client.Call(ctx, MsgTypeLogin, &LoginPayload{Username: "broken"})
+if !errors.As(err, &statusErr) || statusErr.Code != StatusUnknown || statusErr.Message != "database down" {
+t.Fatalf("Expected StatusUnknown, got %v", err)
+}
+<-server.Errors()
+
+// An error for a message nobody waits for is reported on Errors
+if err := server.ReplyError(&Message{ID: 9999}, Errorf(StatusAborted, "gone")); err != nil {
+t.Fatalf("ReplyError failed: %v", err)
+}
+select {
+case err := <-client.Errors():
+var remoteErr *RemoteError
+if !errors.As(err, &remoteErr) || remoteErr.ID != 9999 || remoteErr.Err.Code != StatusAborted {
+t.Errorf("Expected a *RemoteError for message 9999, got %v", err)
+}
+case <-time.After(5 * time.Second):
+t.Fatal("Unsolicited error frame was not reported")
+}
+
+// The connection stays usable
+if _, _, err := client.Call(ctx, MsgTypeLogin, &LoginPayload{Username: "ok"}); err != nil {
+t.Fatalf("Call after error frames failed: %v", err)
+}
+}
+
+func TestServedHandlerErrors(t *testing.T) {
+mux := NewServeMux()
+mux.Handle(MsgTypeLogin, func(ctx context.Context, msg *Message, payload interface{}) error {
+if login := payload.(*LoginPayload); login.Username == "denied" {
+return Errorf(StatusPermissionDenied, "account locked")
+}
+client, _ := ClientFromContext(ctx)
+return client.Reply(msg, MsgTypeResponse, &ResponsePayload{Success: true})
+})
+client := newCallServer(t, mux)
+waited := make(chan error, 1)
+go func() { waited <- client.Wait() }()
+
+ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+defer cancel()
+_, _, err := client.Call(ctx, MsgTypeLogin, &LoginPayload{Username: "denied"})
+if ErrorCode(err) != StatusPermissionDenied {
+t.Fatalf("Expected StatusPermissionDenied, got %v", err)
+}
+
+// Neither side drops the connection over the error frame
+if _, _, err := client.Call(ctx, MsgTypeLogin, &LoginPayload{Username: "ok"}); err != nil {
+t.Fatalf("Call after a handler error failed: %v", err)
+}
+select {
+case err := <-waited:
+t.Fatalf("Wait returned after an error frame: %v", err)
+default:
+}
+}
+
+func TestSendStream(t *testing.T) {
+t.Run("Copy", func(t *testing.T) { testSendStream(t, nil) })
+t.Run("Pooled", func(t *testing.T) { testSendStream(t, &MessageOptions{PooledBuffers: true}) })
+}
+
+func testSendStream(t *testing.T, opts *MessageOptions) {
+sender, receiver := loopbackProtocols(t, "tcp", opts)
+
+type result struct {
+msg  *Message
+data []byte
+err  error
+}
+results := make(chan result, 1)
+receiver.SetStreamHandler(func(msg *Message, r io.Reader) {
+data, err := io.ReadAll(r)
+results <- result{msg, data, err}
+})
+msgs, _ := receiveLoop(receiver)
+
+// Larger than the reader's buffer, from a reader of unknown size
+data := make([]byte, 5*1024*1024+123)
+for i := range data {
+data[i] = byte(i * 7)
+}
+id, err := sender.SendStream(context.Background(), 42, onlyReader{bytes.NewReader(data)})
+if err != nil {
+t.Fatalf("SendStream failed: %v", err)
+}
+
+res := <-results
+if res.err != nil {
+t.Fatalf("Reading stream failed: %v", res.err)
+}
+if res.msg.Type != 42 || res.msg.ID != id {
+t.Errorf("Expected stream type 42 ID %d, got type %d ID %d", id, res.msg.Type, res.msg.ID)
+}
+if !bytes.Equal(res.data, data) {
+t.Fatalf("Stream data mismatch: got %d bytes, expected %d", len(res.data), len(data))
+}
+
+// Direct messages still flow afterwards
+if _, err := sender.Send(42, []byte("after")); err != nil {
+t.Fatal(err)
+}
+if msg := <-msgs; string(msg.Payload) != "after" {
+t.Errorf("Expected message after stream, got %q", msg.Payload)
+}
+
+// A cancelled context stops the stream
+ctx, cancel := context.WithCancel(context.Background())
+cancel()
+if _, err := sender.SendStream(ctx, 42, bytes.NewReader(data)); err != context.Canceled {
+t.Errorf("Expected context.Canceled, got: %v", err)
+}
+}
+
+func TestSendStreamHandlerStops(t *testing.T) {
+sender, receiver := loopbackProtocols(t, "tcp", nil)
+msgs, errs := receiveLoop(receiver)
+
+// Without a handler the stream is discarded
+if _, err := sender.SendStream(context.Background(), 42, bytes.NewReader([]byte("ignored"))); err != nil {
+t.Fatal(err)
+}
+if err := <-errs; !errors.Is(err, ErrNoStreamHandler) {
+t.Fatalf("Expected ErrNoStreamHandler, got: %v", err)
+}
+
+// A handler that stops reading early doesn't stall the connection
+read := make(chan []byte, 1)
+receiver.SetStreamHandler(func(msg *Message, r io.Reader) {
+buf := make([]byte, 10)
+n, _ := io.ReadFull(r, buf)
+read <- buf[:n]
+})
+if _, err := sender.SendStream(context.Background(), 42, bytes.NewReader(make([]byte, 4*1024*1024))); err != nil {
+t.Fatalf("SendStream failed: %v", err)
+}
+if _, err := sender.Send(42, []byte("after")); err != nil {
+t.Fatal(err)
+}
+if got := <-read; len(got) != 10 {
+t.Errorf("Expected 10 bytes, got %d", len(got))
+}
+select {
+case msg := <-msgs:
+if string(msg.Payload) != "after" {
+t.Errorf("Expected message after stream, got %q", msg.Payload)
+}
+case err := <-errs:
+t.Fatalf("Unexpected error: %v", err)
+case <-time.After(5 * time.Second):
+t.Fatal("Connection stalled after the handler returned")
+}
+}
+
+func TestTransferStores(t *testing.T) {
+dirStore, err := NewDirTransferStore(t.TempDir())
+if err != nil {
+t.Fatal(err)
+}
+stores := map[string]TransferStore{"Memory": NewMemoryTransferStore(), "Dir": dirStore}
+for name, store := range stores {
+t.Run(name, func(t *testing.T) {
+info := TransferInfo{Type: 42, TotalSize: 10, TotalChunks: 3, ChunkSize: 4}
+token := "../firmware/v1.2"
+
+if _, err := store.Get(token, 0); err != ErrTransferNotFound {
+t.Errorf("Expected ErrTransferNotFound, got: %v", err)
+}
+if held, err := store.Open(token, info); err != nil || len(held) != 0 {
+t.Fatalf("Expected new transfer, got %v, %v", held, err)
+}
+store.Put(token, 2, []byte("ij"))
+store.Put(token, 0, []byte("abcd"))
+
+held, err := store.Open(token, info)
+if err != nil || !slices.Equal(held, []uint32{0, 2}) {
+t.Fatalf("Expected chunks [0 2], got %v, %v", held, err)
+}
+if data, err := store.Get(token, 2); err != nil || string(data) != "ij" {
+t.Errorf("Expected chunk 2, got %q, %v", data, err)
+}
+
+// Different info under the same token starts over
+info.TotalSize = 11
+if held, err := store.Open(token, info); err != nil || len(held) != 0 {
+t.Fatalf("Expected reset transfer, got %v, %v", held, err)
+}
+
+store.Remove(token)
+if err := store.Put(token, 0, []byte("abcd")); err != ErrTransferNotFound {
+t.Errorf("Expected ErrTransferNotFound after Remove, got: %v", err)
+}
+})
+}
+}
+
+// failingReaderAt fails every read after the first limit reads, or with truncate
+// returns only half the bytes asked for, as if the data had shrunk
+type failingReaderAt struct {
+r        io.ReaderAt
+limit    int
+truncate bool
+mu       sync.Mutex
+reads    int
+}
+
+func (f *failingReaderAt) ReadAt(b []byte, off int64) (int, error) {
+f.mu.Lock()
+defer f.mu.Unlock()
+f.reads++
+if f.limit > 0 && f.reads > f.limit {
+if f.truncate {
+n, _ := f.r.ReadAt(b[:len(b)/2], off)
+return n, io.EOF
+}
+return 0, io.ErrUnexpectedEOF
+}
+return f.r.ReadAt(b, off)
+}
+
+func TestSendResumable(t *testing.T) {
+store, err := NewDirTransferStore(t.TempDir())
+if err != nil {
+t.Fatal(err)
+}
+opts := SecureMessageOptions([]byte("resume-secret"))
+opts.StreamConfig = &StreamConfig{Threshold: StreamingThreshold, ChunkSize: 1000, Enabled: true, TransferStore: store}
+
+data := make([]byte, 10500) // 11 chunks
+for i := range data {
+data[i] = byte(i * 13)
+}
+
+// The first connection drops after 4 chunks
+sender, receiver := loopbackProtocols(t, "tcp", opts)
+receiveLoop(sender)
+receiveLoop(receiver)
+first := &failingReaderAt{r: bytes.NewReader(data), limit: 6} // one read signs the message, one hashes it
+if _, err := sender.SendResumable(context.Background(), 42, "upload-1", first, int64(len(data))); err != io.ErrUnexpectedEOF {
+t.Fatalf("Expected the read to fail, got: %v", err)
+}
+info := TransferInfo{Type: 42, TotalSize: 10500, TotalChunks: 11, ChunkSize: 1000}
+copy(info.Digest[:], payloadDigest(data))
+deadline := time.Now().Add(5 * time.Second)
+for held, _ := store.Open("upload-1", info); len(held) < 4; held, _ = store.Open("upload-1", info) {
+if time.Now().After(deadline) {
+t.Fatalf("Receiver stored %v, expected 4 chunks", held)
+}
+time.Sleep(time.Millisecond)
+}
+sender.Close()
+receiver.Close()
+
+// A new connection sends only the missing chunks
+sender, receiver = loopbackProtocols(t, "tcp", opts)
+receiveLoop(sender)
+msgs, errs := receiveLoop(receiver)
+second := &failingReaderAt{r: bytes.NewReader(data)}
+ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+defer cancel()
+id, err := sender.SendResumable(ctx, 42, "upload-1", second, int64(len(data)))
+if err != nil {
+t.Fatalf("SendResumable failed: %v", err)
+}
+
+select {
+case msg := <-msgs:
+if msg.ID != id || !bytes.Equal(msg.Payload, data) {
+t.Fatalf("Unexpected resumed message %d with %d bytes", msg.ID, len(msg.Payload))
+}
+case err := <-errs:
+t.Fatalf("ReceiveMessage failed: %v", err)
+case <-time.After(5 * time.Second):
+t.Fatal("Resumed transfer was not delivered")
+}
+if second.reads != 2+7 {
+t.Errorf("Expected a signing read, a hashing read and 7 chunk reads, got %d reads", second.reads)
+}
+
+// The completed transfer is removed from the store
+if held, _ := store.Open("upload-1", info); len(held) != 0 {
+t.Errorf("Expected completed transfer to be removed, still holds %v", held)
+}
+
+// A receiver without a store takes the whole transfer in memory
+sender, receiver = loopbackProtocols(t, "tcp", &MessageOptions{StreamConfig: &StreamConfig{Threshold: StreamingThreshold, ChunkSize: 1000, Enabled: true}})
+receiveLoop(sender)
+msgs, _ = receiveLoop(receiver)
+if _, err := sender.SendResumable(ctx, 42, "upload-2", bytes.NewReader(data), int64(len(data))); err != nil {
+t.Fatalf("SendResumable without store failed: %v", err)
+}
+if msg := <-msgs; !bytes.Equal(msg.Payload, data) {
+t.Errorf("Unexpected message with %d bytes", len(msg.Payload))
+}
+
+// New content under the same token starts over instead of reusing stored chunks
+sender, receiver = loopbackProtocols(t, "tcp", opts)
+receiveLoop(sender)
+msgs, errs = receiveLoop(receiver)
+if _, err := sender.SendResumable(ctx, 42, "upload-4", &failingReaderAt{r: bytes.NewReader(data), limit: 6}, int64(len(data))); err != io.ErrUnexpectedEOF {
+t.Fatalf("Expected the read to fail, got: %v", err)
+}
+if err := <-errs; !errors.Is(err, ErrStreamCanceled) {
+t.Fatalf("Expected the failed attempt to be canceled, got: %v", err)
+}
+changed := bytes.Clone(data)
+changed[0] ^= 0xff
+if _, err := sender.SendResumable(ctx, 42, "upload-4", bytes.NewReader(changed), int64(len(changed))); err != nil {
+t.Fatalf("SendResumable of new content failed: %v", err)
+}
+select {
+case msg := <-msgs:
+if !bytes.Equal(msg.Payload, changed) {
+t.Fatal("Stored chunks of the old content were mixed into the new one")
+}
+case err := <-errs:
+t.Fatalf("ReceiveMessage failed: %v", err)
+case <-time.After(5 * time.Second):
+t.Fatal("New content was not delivered")
+}
+
+// Data shorter than announced is never sent, whether it is short from the start
+// or shrinks while chunks are read
+if _, err := sender.SendResumable(ctx, 42, "upload-5", bytes.NewReader(data[:5000]), int64(len(data))); err != io.ErrUnexpectedEOF {
+t.Errorf("Expected io.ErrUnexpectedEOF for short data, got: %v", err)
+}
+shrinking := &failingReaderAt{r: bytes.NewReader(data), limit: 3, truncate: true}
+if _, err := sender.SendResumable(ctx, 42, "upload-6", shrinking, int64(len(data))); err != io.ErrUnexpectedEOF {
+t.Errorf("Expected io.ErrUnexpectedEOF for shrinking data, got: %v", err)
+}
+
+// Stored chunks count against MaxStreamBytes: 8 bytes of bitmap and 4 chunks fit
+limited := *opts
+limited.StreamConfig = &StreamConfig{Threshold: StreamingThreshold, ChunkSize: 1000, Enabled: true, TransferStore: store, MaxStreamBytes: 4096}
+sender, receiver = loopbackProtocols(t, "tcp", &limited)
+receiveLoop(sender)
+_, errs = receiveLoop(receiver)
+go sender.SendResumable(ctx, 42, "upload-3", bytes.NewReader(data), int64(len(data)))
+select {
+case err := <-errs:
+if !errors.Is(err, ErrStreamLimit) {
+t.Fatalf("Expected ErrStreamLimit, got: %v", err)
+}
+case <-time.After(5 * time.Second):
+t.Fatal("Stored transfer was not limited")
+}
+if held, _ := store.Open("upload-3", info); len(held) != 4 {
+t.Errorf("Expected 4 stored chunks, got %v", held)
 }
 }
 
@@ -851,6 +4038,96 @@ b.Fatal(err)
 }
 }
 
+func BenchmarkStructCodecMarshal(b *testing.B) {
+payload := &codecInner{Label: "testuser", Score: 42}
+
+b.ReportAllocs()
+b.ResetTimer()
+for i := 0; i < b.N; i++ {
+if _, err := MarshalStruct(payload); err != nil {
+b.Fatal(err)
+}
+}
+}
+
+func BenchmarkDecoderBlob(b *testing.B) {
+buf := new(bytes.Buffer)
+WriteString(buf, "blob-name")
+WriteBytes(buf, make([]byte, 64*1024))
+data := buf.Bytes()
+
+for _, zeroCopy := range []bool{false, true} {
+name := "Copy"
+if zeroCopy {
+name = "ZeroCopy"
+}
+b.Run(name, func(b *testing.B) {
+b.ReportAllocs()
+b.SetBytes(int64(len(data)))
+for i := 0; i < b.N; i++ {
+d := NewDecoder(data)
+if zeroCopy {
+d = NewZeroCopyDecoder(data)
+}
+d.ReadString()
+d.ReadBytes()
+if err := d.Err(); err != nil {
+b.Fatal(err)
+}
+}
+})
+}
+}
+
+func BenchmarkSendSmallMessagesTCP(b *testing.B) {
+payload := &LoginPayload{
+Username: "testuser",
+Password: "testpassword123",
+ClientID: "client-abc-123",
+}
+
+for _, async := range []bool{false, true} {
+name := "Sync"
+var opts *MessageOptions
+if async {
+name = "Async"
+opts = &MessageOptions{AsyncWrite: DefaultAsyncWriteConfig()}
+}
+b.Run(name, func(b *testing.B) {
+listener, err := net.Listen("tcp", "127.0.0.1:0")
+if err != nil {
+b.Fatal(err)
+}
+defer listener.Close()
+go func() {
+conn, err := listener.Accept()
+if err != nil {
+return
+}
+io.Copy(io.Discard, conn)
+conn.Close()
+}()
+conn, err := net.Dial("tcp", listener.Addr().String())
+if err != nil {
+b.Fatal(err)
+}
+proto := NewProtocol(conn, opts)
+defer proto.Close()
+
+b.ReportAllocs()
+b.ResetTimer()
+for i := 0; i < b.N; i++ {
+if err := proto.SendMessage(MsgTypeLogin, uint32(i), payload); err != nil {
+b.Fatal(err)
+}
+}
+if err := proto.Flush(); err != nil {
+b.Fatal(err)
+}
+})
+}
+}
+
 func BenchmarkParallel(b *testing.B) {
 payload := &LoginPayload{
 Username: "testuser",
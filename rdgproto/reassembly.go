@@ -0,0 +1,576 @@
+package rdgproto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+)
+
+var (
+	ErrStreamLimit = errors.New("stream limit exceeded")
+)
+
+// errWake interrupts a receive loop waiting for the next frame (see wakeReceiver)
+var errWake = errors.New("receive interrupted")
+
+// readDeadliner is implemented by connections whose blocked reads can be interrupted
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// StreamError reports an incoming streamed message that was discarded during
+// reassembly. Framing is unaffected, so the connection remains usable and the
+// next ReceiveMessage call continues with the following message.
+//
+// Err is ErrStreamMismatch for chunks or headers that contradict each other,
+// ErrStreamLimit when MaxStreams or MaxStreamBytes would be exceeded,
+// ErrStreamIntegrity for streams whose data doesn't match their digest and
+// ErrStreamInterrupted for streams that ended incomplete or went idle.
+type StreamError struct {
+	ID  uint32
+	Err error
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("stream %d: %v", e.ID, e.Err)
+}
+
+func (e *StreamError) Unwrap() error {
+	return e.Err
+}
+
+// streamAssembler collects chunks for a streamed message
+type streamAssembler struct {
+	header   *StreamHeader
+	chunks   map[uint32][]byte
+	seen     []uint64 // bitmap of received chunk indexes
+	received uint32
+	size     uint64     // payload bytes received so far
+	cost     int64      // bytes charged against MaxStreamBytes
+	frames   []*Message // pooled chunk frames backing chunks
+	timer    *time.Timer
+	active   time.Time     // when the stream started or last received a chunk
+	reader   *streamReader // set for open-ended streams, which are not buffered here
+	store    TransferStore // set for resumable streams, whose chunks are kept in the store
+	digest   hash.Hash     // set for streams with a digest, fed with the chunks in order
+	hashed   uint32        // chunks fed to digest so far
+}
+
+// has reports whether chunk index i has been received
+func (a *streamAssembler) has(i uint32) bool {
+	return a.seen[i/64]&(1<<(i%64)) != 0
+}
+
+// mark records chunk index i as received
+func (a *streamAssembler) mark(i uint32) {
+	a.seen[i/64] |= 1 << (i % 64)
+}
+
+// progress describes the chunks received so far
+func (a *streamAssembler) progress(msgID uint32) *StreamProgress {
+	progress := newStreamProgress(msgID, a.header, a.size, a.received)
+	return &progress
+}
+
+// hashChunks feeds the digest with the chunks received in order so far, so only
+// chunks that arrived out of order or went to a transfer store are left for the end
+func (a *streamAssembler) hashChunks() {
+	for a.hashed < a.header.TotalChunks && a.has(a.hashed) {
+		data, ok := a.chunks[a.hashed]
+		if !ok {
+			return
+		}
+		a.digest.Write(data)
+		a.hashed++
+	}
+}
+
+// streamLimit returns a configured stream limit, applying the default for zero
+// and reporting false for a negative (disabled) limit
+func streamLimit[T int | int64 | time.Duration](v, def T) (T, bool) {
+	if v == 0 {
+		return def, true
+	}
+	return v, v > 0
+}
+
+// validateStreamHeader checks a stream header for values no sender produces
+func validateStreamHeader(header *StreamHeader) error {
+	if len(header.Digest) != 0 && (len(header.Digest) != sha256.Size || header.TotalChunks == UnknownStreamChunks) {
+		// Open-ended streams carry their digest in the end marker
+		return ErrStreamMismatch
+	}
+	switch {
+	case header.TotalChunks == UnknownStreamChunks:
+		// Open-ended streams announce no size
+		if header.TotalSize != 0 || IsReservedType(header.OriginalType) {
+			return ErrStreamMismatch
+		}
+	case IsReservedType(header.OriginalType):
+		return ErrStreamMismatch
+	case header.TotalSize > MaxPayloadSize:
+		return ErrPayloadTooLarge
+	case uint64(header.TotalChunks) > header.TotalSize:
+		// Every chunk carries at least one byte
+		return ErrStreamMismatch
+	case header.TotalSize > 0 && header.TotalChunks == 0:
+		return ErrStreamMismatch
+	case header.Token != "":
+		// Resumable streams announce their chunk size, which must match the chunk count
+		if header.ChunkSize == 0 || header.TotalChunks != uint32((header.TotalSize+uint64(header.ChunkSize)-1)/uint64(header.ChunkSize)) {
+			return ErrStreamMismatch
+		}
+	}
+	return nil
+}
+
+// startStream initializes a new stream assembler. A stream that is already
+// active under the same ID is discarded first. For a resumable stream, held is
+// the bitmap of chunks the receiver already has, to be sent back to the sender.
+func (p *Protocol) startStream(msgID uint32, header *StreamHeader) (held []byte, err error) {
+	if err := validateStreamHeader(header); err != nil {
+		return nil, &StreamError{ID: msgID, Err: err}
+	}
+	if p.streamConfig.Integrity && len(header.Digest) == 0 && header.TotalChunks != UnknownStreamChunks {
+		// Without a digest the stream can't be checked
+		return nil, &StreamError{ID: msgID, Err: ErrStreamIntegrity}
+	}
+
+	// Look up what an earlier connection left of a resumable stream
+	var store TransferStore
+	var heldChunks []uint32
+	if header.Token != "" {
+		if store = p.streamConfig.TransferStore; store != nil {
+			info := TransferInfo{
+				Type:        header.OriginalType,
+				TotalSize:   header.TotalSize,
+				TotalChunks: header.TotalChunks,
+				ChunkSize:   header.ChunkSize,
+			}
+			copy(info.Digest[:], header.Digest)
+			heldChunks, err = store.Open(header.Token, info)
+			if err != nil {
+				// Receive it in memory instead
+				store, heldChunks = nil, nil
+			}
+		}
+		held = resumeBitmap(header.TotalChunks, heldChunks)
+	}
+
+	p.streamMu.Lock()
+	defer p.streamMu.Unlock()
+
+	if old, exists := p.activeStreams[msgID]; exists {
+		p.discardStream(msgID, old)
+	}
+
+	cfg := p.streamConfig
+	if limit, ok := streamLimit(cfg.MaxStreams, DefaultMaxStreams); ok && len(p.activeStreams) >= limit {
+		return nil, &StreamError{ID: msgID, Err: ErrStreamLimit}
+	}
+	if header.TotalChunks == UnknownStreamChunks {
+		return nil, p.startReaderStream(msgID, header)
+	}
+
+	// The bitmap is sized by the peer, so it counts against the byte limit
+	bitmapWords := (int64(header.TotalChunks) + 63) / 64
+	assembler := &streamAssembler{
+		header: header,
+		chunks: make(map[uint32][]byte),
+		cost:   bitmapWords * 8,
+		active: time.Now(),
+		store:  store,
+	}
+	if len(header.Digest) != 0 {
+		assembler.digest = sha256.New()
+	}
+	if !p.reserveStreamBytes(assembler.cost) {
+		return nil, &StreamError{ID: msgID, Err: ErrStreamLimit}
+	}
+	assembler.seen = make([]uint64, bitmapWords)
+	for _, index := range heldChunks {
+		if index < header.TotalChunks && !assembler.has(index) {
+			assembler.mark(index)
+			assembler.received++
+			assembler.size += chunkLength(header, index)
+		}
+	}
+	// Stored chunks are read back into memory at the end, so they count too
+	if !p.reserveStreamBytes(int64(assembler.size)) {
+		p.streamBytes -= assembler.cost
+		return nil, &StreamError{ID: msgID, Err: ErrStreamLimit}
+	}
+	assembler.cost += int64(assembler.size)
+
+	p.addStream(msgID, assembler)
+	return held, nil
+}
+
+// startReaderStream hands an open-ended stream to the stream handler.
+// The caller holds streamMu.
+func (p *Protocol) startReaderStream(msgID uint32, header *StreamHeader) error {
+	handler := p.streamHandler
+	if handler == nil {
+		return &StreamError{ID: msgID, Err: ErrNoStreamHandler}
+	}
+
+	assembler := &streamAssembler{
+		header: header,
+		active: time.Now(),
+		reader: newStreamReader(),
+		digest: openStreamDigest(header.OriginalType, msgID),
+	}
+	p.addStream(msgID, assembler)
+
+	msg := &Message{Type: header.OriginalType, ID: msgID}
+	go func() {
+		defer assembler.reader.close()
+		handler(msg, assembler.reader)
+	}()
+	return nil
+}
+
+// addStream registers a stream and starts its idle timer. The caller holds streamMu.
+func (p *Protocol) addStream(msgID uint32, assembler *streamAssembler) {
+	if idle, ok := streamLimit(p.streamConfig.IdleTimeout, DefaultStreamIdleTimeout); ok {
+		assembler.timer = time.AfterFunc(idle, func() {
+			p.expireStream(msgID, assembler)
+		})
+	}
+	p.activeStreams[msgID] = assembler
+}
+
+// addChunk adds a chunk to a stream. It returns the assembled message once the
+// last chunk arrives, or nil while chunks are missing.
+// chunk.Data aliases frame's payload, so a pooled frame is held until the
+// stream is assembled.
+func (p *Protocol) addChunk(frame *Message, chunk *StreamChunk) (*Message, error) {
+	// Progress is reported once streamMu is released, so the callback may use p
+	var progress *StreamProgress
+	if onProgress := p.streamConfig.OnReceiveProgress; onProgress != nil {
+		defer func() {
+			if progress != nil {
+				onProgress(*progress)
+			}
+		}()
+	}
+
+	p.streamMu.Lock()
+	defer p.streamMu.Unlock()
+
+	assembler, exists := p.activeStreams[frame.ID]
+	if !exists {
+		// Chunks of unknown or discarded streams are dropped
+		frame.Release()
+		return nil, nil
+	}
+	if assembler.reader != nil {
+		if err := p.feedReader(frame, assembler, chunk); err != nil {
+			return nil, err
+		}
+		progress = assembler.progress(frame.ID)
+		return nil, nil
+	}
+
+	index := chunk.ChunkIndex
+	size := uint64(len(chunk.Data))
+	if index >= assembler.header.TotalChunks || size == 0 ||
+		assembler.size+size > assembler.header.TotalSize ||
+		(assembler.header.Token != "" && size != chunkLength(assembler.header, index)) {
+		frame.Release()
+		p.discardStream(frame.ID, assembler)
+		return nil, &StreamError{ID: frame.ID, Err: ErrStreamMismatch}
+	}
+	if assembler.has(index) {
+		// Duplicate chunk, keep the first copy
+		frame.Release()
+		return nil, nil
+	}
+	// Stored chunks are charged like buffered ones, so a peer can't fill the store
+	if !p.reserveStreamBytes(int64(size)) {
+		frame.Release()
+		p.discardStream(frame.ID, assembler)
+		return nil, &StreamError{ID: frame.ID, Err: ErrStreamLimit}
+	}
+	assembler.cost += int64(size)
+	if assembler.store != nil {
+		// Resumable stream: the chunk goes to the store, not into memory
+		err := assembler.store.Put(assembler.header.Token, index, chunk.Data)
+		frame.Release()
+		if err != nil {
+			p.discardStream(frame.ID, assembler)
+			return nil, &StreamError{ID: frame.ID, Err: err}
+		}
+	} else {
+		assembler.chunks[index] = chunk.Data
+		if frame.pooled != nil {
+			assembler.frames = append(assembler.frames, frame)
+		}
+	}
+	assembler.mark(index)
+	assembler.received++
+	assembler.size += size
+	if assembler.digest != nil {
+		assembler.hashChunks()
+	}
+	progress = assembler.progress(frame.ID)
+	if assembler.timer != nil {
+		idle, _ := streamLimit(p.streamConfig.IdleTimeout, DefaultStreamIdleTimeout)
+		assembler.active = time.Now()
+		assembler.timer.Reset(idle)
+	}
+
+	// Signed streams complete at the end marker, which carries the signature
+	if assembler.received < assembler.header.TotalChunks || p.verifiesStreams() {
+		return nil, nil
+	}
+	return p.completeStream(frame.ID, assembler, nil)
+}
+
+// feedReader passes the next chunk of an open-ended stream to its reader. Chunks must
+// arrive in order. The caller holds streamMu, which is released while the reader
+// is full so the handler is never blocked by it.
+func (p *Protocol) feedReader(frame *Message, assembler *streamAssembler, chunk *StreamChunk) error {
+	if chunk.ChunkIndex != assembler.received || len(chunk.Data) == 0 {
+		frame.Release()
+		err := &StreamError{ID: frame.ID, Err: ErrStreamMismatch}
+		assembler.reader.finish(err)
+		p.discardStream(frame.ID, assembler)
+		return err
+	}
+	assembler.digest.Write(chunk.Data)
+	if len(chunk.Digest) != 0 || p.streamConfig.Integrity {
+		// Check the running digest before the handler sees the data
+		if subtle.ConstantTimeCompare(chunk.Digest, assembler.digest.Sum(nil)) != 1 {
+			frame.Release()
+			err := &StreamError{ID: frame.ID, Err: ErrStreamIntegrity}
+			assembler.reader.finish(err)
+			p.discardStream(frame.ID, assembler)
+			return err
+		}
+	}
+	assembler.received++
+	assembler.size += uint64(len(chunk.Data))
+	assembler.active = time.Now()
+	if assembler.timer != nil {
+		idle, _ := streamLimit(p.streamConfig.IdleTimeout, DefaultStreamIdleTimeout)
+		assembler.timer.Reset(idle)
+	}
+
+	p.streamMu.Unlock()
+	assembler.reader.push(frame, chunk.Data)
+	p.streamMu.Lock()
+	return nil
+}
+
+// endStream handles a stream end marker carrying the stream's signature, if any,
+// or for an open-ended stream its digest and signature.
+// Unsigned streams normally complete with their last chunk, so such a stream that is
+// still active at its end marker is incomplete, except for an empty stream.
+func (p *Protocol) endStream(msgID uint32, signature []byte) (*Message, error) {
+	p.streamMu.Lock()
+	defer p.streamMu.Unlock()
+
+	assembler, exists := p.activeStreams[msgID]
+	if !exists {
+		return nil, nil
+	}
+	if assembler.reader != nil {
+		err := p.checkOpenStreamTrailer(assembler.header.OriginalType, msgID, assembler.digest.Sum(nil), signature)
+		if err != nil {
+			err = &StreamError{ID: msgID, Err: err}
+			assembler.reader.finish(err)
+			p.discardStream(msgID, assembler)
+			return nil, err
+		}
+		assembler.reader.finish(io.EOF)
+		p.discardStream(msgID, assembler)
+		return nil, nil
+	}
+	if assembler.received == assembler.header.TotalChunks {
+		return p.completeStream(msgID, assembler, signature)
+	}
+	p.discardStream(msgID, assembler)
+	return nil, &StreamError{ID: msgID, Err: ErrStreamInterrupted}
+}
+
+// completeStream assembles a stream whose chunks have all arrived and removes it.
+// With a Verifier, signature must be valid for the whole message (header + payload),
+// so chunks can't be reordered, replaced or spliced in from another stream. A digest
+// in the stream header catches the same without a Verifier, but not a sender that
+// replaces the header as well.
+func (p *Protocol) completeStream(msgID uint32, assembler *streamAssembler, signature []byte) (*Message, error) {
+	defer p.discardStream(msgID, assembler)
+
+	header := assembler.header
+	if assembler.size != header.TotalSize {
+		return nil, &StreamError{ID: msgID, Err: ErrStreamMismatch}
+	}
+
+	// All chunks are present and their sizes add up to the validated total.
+	// The message header goes in front so the result can be verified in place.
+	result := make([]byte, 0, HeaderSize+int(assembler.size))
+	result = append(result, header.OriginalType)
+	result = binary.BigEndian.AppendUint32(result, msgID)
+	result = binary.BigEndian.AppendUint32(result, uint32(assembler.size))
+	for i := uint32(0); i < header.TotalChunks; i++ {
+		data := assembler.chunks[i]
+		if assembler.store != nil {
+			var err error
+			if data, err = assembler.store.Get(header.Token, i); err != nil {
+				return nil, &StreamError{ID: msgID, Err: err}
+			}
+		}
+		if assembler.digest != nil && i >= assembler.hashed {
+			assembler.digest.Write(data)
+		}
+		result = append(result, data...)
+	}
+	if uint64(len(result)-HeaderSize) != assembler.size {
+		return nil, &StreamError{ID: msgID, Err: ErrStreamMismatch}
+	}
+	if assembler.store != nil {
+		// Complete or corrupt, a stored transfer is not resumed again
+		defer assembler.store.Remove(header.Token)
+	}
+	if assembler.digest != nil && subtle.ConstantTimeCompare(assembler.digest.Sum(nil), header.Digest) != 1 {
+		return nil, &StreamError{ID: msgID, Err: ErrStreamIntegrity}
+	}
+
+	msg := &Message{
+		Type:    header.OriginalType,
+		ID:      msgID,
+		Payload: result[HeaderSize:],
+	}
+	if p.verifiesStreams() {
+		if len(signature) == 0 {
+			return nil, &StreamError{ID: msgID, Err: ErrSignatureRequired}
+		}
+		if err := p.opts.Verifier.Verify(result, signature); err != nil {
+			return nil, &StreamError{ID: msgID, Err: ErrInvalidSignature}
+		}
+		msg.Signature = bytes.Clone(signature)
+	}
+	return msg, nil
+}
+
+// verifiesStreams reports whether incoming streams must carry a valid signature
+func (p *Protocol) verifiesStreams() bool {
+	return p.opts != nil && p.opts.Verifier != nil
+}
+
+// discardStream removes a stream and releases everything it holds.
+// The caller holds streamMu.
+func (p *Protocol) discardStream(msgID uint32, assembler *streamAssembler) {
+	if assembler.timer != nil {
+		assembler.timer.Stop()
+	}
+	if assembler.reader != nil {
+		// No effect if the stream already ended normally
+		assembler.reader.finish(&StreamError{ID: msgID, Err: ErrStreamInterrupted})
+	}
+	delete(p.activeStreams, msgID)
+	p.streamBytes -= assembler.cost
+
+	// Recycle the pooled frames backing the chunks
+	for _, frame := range assembler.frames {
+		frame.Release()
+	}
+	assembler.frames = nil
+	assembler.chunks = nil
+}
+
+// reserveStreamBytes charges n bytes against MaxStreamBytes, reporting false if the
+// limit would be exceeded. The caller holds streamMu.
+func (p *Protocol) reserveStreamBytes(n int64) bool {
+	if limit, ok := streamLimit(p.streamConfig.MaxStreamBytes, DefaultMaxStreamBytes); ok && p.streamBytes+n > limit {
+		return false
+	}
+	p.streamBytes += n
+	return true
+}
+
+// expireStream discards a stream that went idle. The error is returned by the
+// next ReceiveMessage call.
+func (p *Protocol) expireStream(msgID uint32, assembler *streamAssembler) {
+	p.streamMu.Lock()
+	defer p.streamMu.Unlock()
+
+	// The stream may have completed, been replaced or received a chunk meanwhile
+	if p.activeStreams[msgID] != assembler {
+		return
+	}
+	idle, _ := streamLimit(p.streamConfig.IdleTimeout, DefaultStreamIdleTimeout)
+	if time.Since(assembler.active) < idle {
+		return
+	}
+	if assembler.reader != nil && assembler.reader.full() {
+		// The handler is behind, not the peer
+		assembler.timer.Reset(idle)
+		return
+	}
+	p.discardStream(msgID, assembler)
+	p.streamErrs = append(p.streamErrs, &StreamError{ID: msgID, Err: ErrStreamInterrupted})
+	p.wakeReceiver()
+}
+
+// wakeReceiver interrupts a ReceiveMessage blocked waiting for the next frame, so an
+// expired stream is reported even when the peer has gone quiet. It sets a read
+// deadline in the past, which woken clears again. Connections without read deadlines
+// report the stream once the next frame arrives.
+func (p *Protocol) wakeReceiver() {
+	conn, ok := p.conn.(readDeadliner)
+	if !ok {
+		return
+	}
+	p.wakeMu.Lock()
+	defer p.wakeMu.Unlock()
+	p.waking = true
+	_ = conn.SetReadDeadline(time.Now())
+}
+
+// woken reports whether a read failed only because wakeReceiver interrupted it,
+// clearing the deadline so that reading can go on
+func (p *Protocol) woken(err error) bool {
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	p.wakeMu.Lock()
+	defer p.wakeMu.Unlock()
+	if !p.waking {
+		return false
+	}
+	p.waking = false
+	_ = p.conn.(readDeadliner).SetReadDeadline(time.Time{})
+	return true
+}
+
+// takeStreamError returns the oldest error of an expired stream, if any
+func (p *Protocol) takeStreamError() error {
+	p.streamMu.Lock()
+	defer p.streamMu.Unlock()
+
+	if len(p.streamErrs) == 0 {
+		return nil
+	}
+	err := p.streamErrs[0]
+	p.streamErrs = p.streamErrs[1:]
+	return err
+}
+
+// discardStreams drops all streams being reassembled
+func (p *Protocol) discardStreams() {
+	p.streamMu.Lock()
+	defer p.streamMu.Unlock()
+
+	for msgID, assembler := range p.activeStreams {
+		p.discardStream(msgID, assembler)
+	}
+}
@@ -0,0 +1,69 @@
+package rdgproto
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Receive buffers are pooled in power-of-two size classes from 512 bytes to 4MB.
+// Larger frames are allocated directly and never pooled.
+const (
+	minRecvClassShift = 9
+	maxRecvClassShift = 22
+)
+
+var recvPools [maxRecvClassShift - minRecvClassShift + 1]sync.Pool
+
+// recvClass returns the pool index for a buffer of n bytes, or -1 if n is too large to pool
+func recvClass(n int) int {
+	if n <= 1<<minRecvClassShift {
+		return 0
+	}
+	shift := bits.Len(uint(n - 1))
+	if shift > maxRecvClassShift {
+		return -1
+	}
+	return shift - minRecvClassShift
+}
+
+// getRecvBuffer returns a buffer of length n from the size-classed pools.
+// The returned pointer is nil when n is too large to pool.
+func getRecvBuffer(n int) ([]byte, *[]byte) {
+	class := recvClass(n)
+	if class < 0 {
+		return make([]byte, n), nil
+	}
+	if bufp, ok := recvPools[class].Get().(*[]byte); ok {
+		return (*bufp)[:n], bufp
+	}
+	b := make([]byte, n, 1<<(class+minRecvClassShift))
+	return b, &b
+}
+
+// putRecvBuffer returns a buffer obtained from getRecvBuffer to its pool
+func putRecvBuffer(bufp *[]byte) {
+	class := recvClass(cap(*bufp))
+	if class < 0 || cap(*bufp) != 1<<(class+minRecvClassShift) {
+		return
+	}
+	recvPools[class].Put(bufp)
+}
+
+// Release returns the message's receive buffer to the pool when the message was
+// received with MessageOptions.PooledBuffers enabled, and clears Payload and Signature.
+//
+// After Release, msg.Payload, msg.Signature and anything that aliases them (such as
+// values from a zero-copy Decoder, or payload fields decoded without copying) must not
+// be used. Payloads decoded with the copying Read* helpers remain valid.
+//
+// Release is optional: a message that is never released is garbage collected as usual.
+// Calling Release more than once, or on a message without a pooled buffer, only clears
+// Payload and Signature.
+func (m *Message) Release() {
+	m.Payload = nil
+	m.Signature = nil
+	if m.pooled != nil {
+		putRecvBuffer(m.pooled)
+		m.pooled = nil
+	}
+}
@@ -0,0 +1,405 @@
+package rdgproto
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+var (
+	ErrTransferNotFound = errors.New("transfer not found")
+	ErrTransferToken    = errors.New("resumable transfer requires a token")
+)
+
+// TransferInfo describes a resumable transfer. A stored transfer is only resumed
+// when the new stream has the same info, so new content sent under an old token
+// starts over instead of being mixed with stored chunks.
+type TransferInfo struct {
+	Type        byte
+	TotalSize   uint64
+	TotalChunks uint32
+	ChunkSize   uint32
+	Digest      [sha256.Size]byte // SHA-256 of the payload, zero if the sender gave none
+}
+
+// TransferStore persists the chunks of incoming resumable transfers so they survive
+// a dropped connection (and, for a store on disk, a restart). Transfers are keyed by
+// the token chosen by the sender. Implementations must be safe for concurrent use.
+// A transfer the sender never completes stays in the store until it is removed;
+// StreamConfig.MaxStreamBytes bounds what each connection can store.
+type TransferStore interface {
+	// Open returns the indexes of the chunks held for token. A transfer stored with
+	// different info is discarded first, and a new transfer holds no chunks.
+	Open(token string, info TransferInfo) ([]uint32, error)
+
+	// Put stores a chunk. data is only valid during the call.
+	Put(token string, index uint32, data []byte) error
+
+	// Get returns a stored chunk
+	Get(token string, index uint32) ([]byte, error)
+
+	// Remove deletes a transfer and its chunks
+	Remove(token string) error
+}
+
+// SendResumable sends size bytes read from r as a resumable stream identified by token.
+// The receiver answers the stream start with the chunks it already holds for token
+// (see StreamConfig.TransferStore) and only the missing chunks are sent. After a dropped
+// connection, calling SendResumable again with the same token, type and data on a new
+// connection completes the transfer.
+//
+// The receiver delivers the message like any other streamed message once all chunks
+// have arrived. Its answer arrives through ReceiveMessage, so the connection must be
+// read concurrently, for example by a started Client. A receiver without a transfer
+// store answers that it holds nothing. Peers that predate resumable streams never
+// answer; ctx bounds the wait.
+//
+// If ctx is done or reading r fails or returns fewer bytes than size, the stream is
+// canceled. The receiver keeps the chunks already stored for the next attempt.
+//
+// The data is read in full once to compute its digest, which identifies the content
+// of the transfer and is checked by the receiver, and with a Signer once more to sign
+// the whole message.
+func (p *Protocol) SendResumable(ctx context.Context, messageType byte, token string, r io.ReaderAt, size int64) (uint32, error) {
+	if token == "" {
+		return 0, ErrTransferToken
+	}
+	if size < 0 || size > MaxPayloadSize {
+		return 0, ErrPayloadTooLarge
+	}
+	chunkSize := p.streamConfig.ChunkSize
+	header := &StreamHeader{
+		OriginalType: messageType,
+		TotalSize:    uint64(size),
+		TotalChunks:  uint32((size + int64(chunkSize) - 1) / int64(chunkSize)),
+		ChunkSize:    uint32(chunkSize),
+		Token:        token,
+	}
+	id := p.NextMessageID()
+
+	end, err := p.signResumable(messageType, id, r, size)
+	if err != nil {
+		return id, err
+	}
+	// The digest tells the receiver whether stored chunks belong to this content
+	if header.Digest, err = readerDigest(r, size); err != nil {
+		return id, err
+	}
+
+	// Wait for the receiver to report the chunks it holds
+	reply := make(chan []byte, 1)
+	p.resumeMu.Lock()
+	p.resumeWaiters[id] = reply
+	p.resumeMu.Unlock()
+	defer func() {
+		p.resumeMu.Lock()
+		delete(p.resumeWaiters, id)
+		p.resumeMu.Unlock()
+	}()
+
+	canceler := p.trackSending(id)
+	defer p.untrackSending(id, canceler)
+	if err := p.sendDirect(MessageTypeStreamStart, id, header); err != nil {
+		return id, err
+	}
+	var held []byte
+	select {
+	case held = <-reply:
+	case <-canceler.done:
+		return id, p.stopSending(id, canceler)
+	case <-ctx.Done():
+		return id, p.abortSending(id, canceler, ctx.Err())
+	}
+
+	// Progress counts the chunks the receiver already holds
+	var sentBytes uint64
+	var sentChunks uint32
+	for index := uint32(0); index < header.TotalChunks; index++ {
+		if resumeHeld(held, index) {
+			sentBytes += chunkLength(header, index)
+			sentChunks++
+		}
+	}
+
+	buf := make([]byte, chunkSize)
+	for index := uint32(0); index < header.TotalChunks; index++ {
+		if resumeHeld(held, index) {
+			continue
+		}
+		if canceler.canceled() != nil {
+			return id, p.stopSending(id, canceler)
+		}
+		if err := ctx.Err(); err != nil {
+			return id, p.abortSending(id, canceler, err)
+		}
+
+		off := int64(index) * int64(chunkSize)
+		n := int(min(int64(chunkSize), size-off))
+		if read, err := r.ReadAt(buf[:n], off); read < n {
+			// The data shrank since it was signed and hashed
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return id, p.abortSending(id, canceler, err)
+		}
+
+		if err := p.limiter.Load().wait(ctx, n); err != nil {
+			return id, p.abortSending(id, canceler, err)
+		}
+		p.yieldToDirect()
+		chunk := &StreamChunk{ChunkIndex: index, Data: buf[:n]}
+		if err := p.sendDirect(MessageTypeStreamChunk, id, chunk); err != nil {
+			return id, err
+		}
+		if err := p.Flush(); err != nil {
+			return id, err
+		}
+		sentBytes += uint64(n)
+		sentChunks++
+		p.reportSent(id, header, sentBytes, sentChunks)
+	}
+
+	return id, p.sendDirect(MessageTypeStreamEnd, id, end)
+}
+
+// signResumable returns the payload of a resumable stream's end marker: the signature
+// of the whole message with a Signer, empty otherwise
+func (p *Protocol) signResumable(messageType byte, messageID uint32, r io.ReaderAt, size int64) ([]byte, error) {
+	if p.opts == nil || p.opts.Signer == nil {
+		return []byte{}, nil
+	}
+
+	headed := make([]byte, HeaderSize+int(size))
+	headed[0] = messageType
+	binary.BigEndian.PutUint32(headed[MessageTypeSize:], messageID)
+	binary.BigEndian.PutUint32(headed[MessageTypeSize+MessageIDSize:], uint32(size))
+	if n, err := r.ReadAt(headed[HeaderSize:], 0); n < int(size) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return p.opts.Signer.Sign(headed)
+}
+
+// deliverResume passes a resume answer to the SendResumable call waiting for it
+func (p *Protocol) deliverResume(msgID uint32, held []byte) {
+	p.resumeMu.Lock()
+	reply, ok := p.resumeWaiters[msgID]
+	p.resumeMu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case reply <- bytes.Clone(held):
+	default:
+	}
+}
+
+// resumeHeld reports whether a resume answer lists chunk index as held
+func resumeHeld(held []byte, index uint32) bool {
+	return int(index/8) < len(held) && held[index/8]&(1<<(index%8)) != 0
+}
+
+// resumeBitmap encodes held chunk indexes as a bitmap of TotalChunks bits
+func resumeBitmap(totalChunks uint32, held []uint32) []byte {
+	bitmap := make([]byte, (int(totalChunks)+7)/8)
+	for _, index := range held {
+		if index < totalChunks {
+			bitmap[index/8] |= 1 << (index % 8)
+		}
+	}
+	return bitmap
+}
+
+// chunkLength returns the size of chunk index of a resumable stream
+func chunkLength(header *StreamHeader, index uint32) uint64 {
+	if index == header.TotalChunks-1 {
+		return header.TotalSize - uint64(index)*uint64(header.ChunkSize)
+	}
+	return uint64(header.ChunkSize)
+}
+
+// MemoryTransferStore keeps resumable transfers in memory. Transfers survive a dropped
+// connection but not a restart of the process.
+type MemoryTransferStore struct {
+	mu        sync.Mutex
+	transfers map[string]*memoryTransfer
+}
+
+type memoryTransfer struct {
+	info   TransferInfo
+	chunks map[uint32][]byte
+}
+
+// NewMemoryTransferStore creates an empty in-memory transfer store
+func NewMemoryTransferStore() *MemoryTransferStore {
+	return &MemoryTransferStore{transfers: make(map[string]*memoryTransfer)}
+}
+
+// Open implements TransferStore
+func (s *MemoryTransferStore) Open(token string, info TransferInfo) ([]uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.transfers[token]
+	if !ok || t.info != info {
+		s.transfers[token] = &memoryTransfer{info: info, chunks: make(map[uint32][]byte)}
+		return nil, nil
+	}
+	held := make([]uint32, 0, len(t.chunks))
+	for index := range t.chunks {
+		held = append(held, index)
+	}
+	slices.Sort(held)
+	return held, nil
+}
+
+// Put implements TransferStore
+func (s *MemoryTransferStore) Put(token string, index uint32, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.transfers[token]
+	if !ok {
+		return ErrTransferNotFound
+	}
+	t.chunks[index] = bytes.Clone(data)
+	return nil
+}
+
+// Get implements TransferStore
+func (s *MemoryTransferStore) Get(token string, index uint32) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.transfers[token]
+	if !ok {
+		return nil, ErrTransferNotFound
+	}
+	data, ok := t.chunks[index]
+	if !ok {
+		return nil, ErrTransferNotFound
+	}
+	return data, nil
+}
+
+// Remove implements TransferStore
+func (s *MemoryTransferStore) Remove(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.transfers, token)
+	return nil
+}
+
+// DirTransferStore keeps resumable transfers in a directory, one subdirectory per
+// transfer holding a file per chunk, so transfers also survive a restart.
+type DirTransferStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// transferInfoFile holds the TransferInfo of a stored transfer
+const transferInfoFile = "info"
+
+// NewDirTransferStore creates a transfer store in dir, creating the directory if needed
+func NewDirTransferStore(dir string) (*DirTransferStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &DirTransferStore{dir: dir}, nil
+}
+
+// path returns the directory of a transfer. Tokens are hashed so any token
+// is a safe file name.
+func (s *DirTransferStore) path(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:16]))
+}
+
+// Open implements TransferStore
+func (s *DirTransferStore) Open(token string, info TransferInfo) ([]uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := s.path(token)
+	encoded := binary.BigEndian.AppendUint64([]byte{info.Type}, info.TotalSize)
+	encoded = binary.BigEndian.AppendUint32(encoded, info.TotalChunks)
+	encoded = binary.BigEndian.AppendUint32(encoded, info.ChunkSize)
+	encoded = append(encoded, info.Digest[:]...)
+
+	// #nosec G304 -- dir is inside the store directory, named by a hash
+	stored, err := os.ReadFile(filepath.Join(dir, transferInfoFile))
+	if err != nil || !bytes.Equal(stored, encoded) {
+		// New transfer, or a different one under the same token
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+		return nil, os.WriteFile(filepath.Join(dir, transferInfoFile), encoded, 0o600)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var held []uint32
+	for _, entry := range entries {
+		// Chunk files are named by index; skip the info file and partial writes
+		index, err := strconv.ParseUint(entry.Name(), 10, 32)
+		if err == nil && index < uint64(info.TotalChunks) {
+			held = append(held, uint32(index))
+		}
+	}
+	slices.Sort(held)
+	return held, nil
+}
+
+// Put implements TransferStore. Chunks are written to a temporary file and renamed,
+// so a chunk interrupted by a crash is never reported as held.
+func (s *DirTransferStore) Put(token string, index uint32, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := s.path(token)
+	name := filepath.Join(dir, strconv.FormatUint(uint64(index), 10))
+	if err := os.WriteFile(name+".tmp", data, 0o600); err != nil {
+		if os.IsNotExist(err) {
+			return ErrTransferNotFound
+		}
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// Get implements TransferStore
+func (s *DirTransferStore) Get(token string, index uint32) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := filepath.Join(s.path(token), strconv.FormatUint(uint64(index), 10))
+	// #nosec G304 -- name is inside the store directory, named by a hash and an index
+	data, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, ErrTransferNotFound
+	}
+	return data, err
+}
+
+// Remove implements TransferStore
+func (s *DirTransferStore) Remove(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return os.RemoveAll(s.path(token))
+}
@@ -0,0 +1,151 @@
+package rdgproto
+
+import (
+	"context"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// maxChunkYields bounds how many times the scheduler steps aside for direct messages
+// before sending its next chunk, so a flood of small messages cannot stall streams
+const maxChunkYields = 64
+
+// outStream is a streamed message whose chunks are being sent by the scheduler
+type outStream struct {
+	id        uint32
+	header    *StreamHeader
+	payload   []byte
+	chunkSize int
+	next      uint32
+	total     uint32
+	weight    int
+	end       []byte // stream end marker payload
+	canceler  *streamCanceler
+	done      chan error
+}
+
+// streamScheduler sends the chunks of all outgoing streams of a Protocol from one
+// goroutine, taking turns between streams (weighted round-robin). Direct messages
+// never wait behind a whole stream: they are written between chunks, ahead of the
+// next chunk. The goroutine runs only while streams are active.
+//
+// Chunks of different streams are distinguished by message ID, so the receiver
+// reassembles interleaved streams without changes.
+type streamScheduler struct {
+	p *Protocol
+
+	mu      sync.Mutex
+	streams []*outStream
+	cursor  int // used only by the scheduler goroutine
+	running bool
+}
+
+// newStreamScheduler creates an idle scheduler for p
+func newStreamScheduler(p *Protocol) *streamScheduler {
+	return &streamScheduler{p: p}
+}
+
+// send queues the chunks of payload and blocks until they and the stream end marker
+// have been sent. The stream start header must already have been sent.
+func (s *streamScheduler) send(messageID uint32, header *StreamHeader, payload []byte, chunkSize int, weight int, end []byte, canceler *streamCanceler) error {
+	st := &outStream{
+		id:        messageID,
+		header:    header,
+		payload:   payload,
+		chunkSize: chunkSize,
+		total:     header.TotalChunks,
+		weight:    max(weight, 1),
+		end:       end,
+		canceler:  canceler,
+		done:      make(chan error, 1),
+	}
+
+	s.mu.Lock()
+	s.streams = append(s.streams, st)
+	if !s.running {
+		s.running = true
+		go s.run()
+	}
+	s.mu.Unlock()
+
+	return <-st.done
+}
+
+// run sends chunks until no stream is left
+func (s *streamScheduler) run() {
+	for {
+		s.mu.Lock()
+		if len(s.streams) == 0 {
+			s.running = false
+			s.mu.Unlock()
+			return
+		}
+		if s.cursor >= len(s.streams) {
+			s.cursor = 0
+		}
+		st := s.streams[s.cursor]
+		s.mu.Unlock()
+
+		err := s.sendTurn(st)
+		finished := err != nil || st.next == st.total
+
+		// Only this goroutine removes streams, so st is still at the cursor
+		s.mu.Lock()
+		if finished {
+			s.streams = slices.Delete(s.streams, s.cursor, s.cursor+1)
+		} else {
+			s.cursor++
+		}
+		s.mu.Unlock()
+
+		if finished {
+			st.payload = nil
+			st.done <- err
+		}
+	}
+}
+
+// sendTurn sends up to st.weight chunks, followed by the stream end marker
+// once the last chunk is out
+func (s *streamScheduler) sendTurn(st *outStream) error {
+	p := s.p
+	for n := 0; n < st.weight && st.next < st.total; n++ {
+		if st.canceler.canceled() != nil {
+			return p.stopSending(st.id, st.canceler)
+		}
+		start := int(st.next) * st.chunkSize
+		end := min(start+st.chunkSize, len(st.payload))
+
+		// The rate limit is shared by all streams, so waiting here holds them all back
+		if err := p.limiter.Load().wait(context.Background(), end-start); err != nil {
+			return err
+		}
+		p.yieldToDirect()
+		chunk := &StreamChunk{
+			ChunkIndex: st.next,
+			Data:       st.payload[start:end],
+		}
+		if err := p.sendDirect(MessageTypeStreamChunk, st.id, chunk); err != nil {
+			return err
+		}
+		// Keep at most one chunk queued ahead of direct messages
+		if err := p.Flush(); err != nil {
+			return err
+		}
+		st.next++
+		p.reportSent(st.id, st.header, uint64(end), st.next)
+	}
+
+	if st.next == st.total {
+		return p.sendDirect(MessageTypeStreamEnd, st.id, st.end)
+	}
+	return nil
+}
+
+// yieldToDirect lets goroutines waiting to write a message go first
+func (p *Protocol) yieldToDirect() {
+	for i := 0; i < maxChunkYields && p.directWriters.Load() > 0; i++ {
+		runtime.Gosched()
+	}
+}
@@ -5,7 +5,10 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"math"
 	"sync"
+	"time"
+	"unsafe"
 )
 
 var (
@@ -15,6 +18,7 @@ var (
 	ErrInvalidStringLen     = errors.New("invalid string length")
 	ErrInvalidBytesLen      = errors.New("invalid bytes length")
 	ErrVarintOverflow       = errors.New("varint overflow")
+	ErrInvalidTime          = errors.New("invalid time encoding")
 )
 
 // Buffer pool for reducing allocations
@@ -123,6 +127,9 @@ func ReadString(r io.Reader) (string, error) {
 	if length == 0 {
 		return "", nil
 	}
+	if rem := remaining(r); rem >= 0 && length > uint64(rem) {
+		return "", io.ErrUnexpectedEOF
+	}
 	b := make([]byte, length)
 	if _, err := io.ReadFull(r, b); err != nil {
 		return "", err
@@ -149,6 +156,10 @@ func ReadBytes(r io.Reader) ([]byte, error) {
 	if length > 1<<30 { // 1GB max bytes length
 		return nil, ErrInvalidBytesLen
 	}
+	// Don't allocate more than the input can hold when the reader knows its size
+	if rem := remaining(r); rem >= 0 && length > uint64(rem) {
+		return nil, io.ErrUnexpectedEOF
+	}
 	b := make([]byte, length)
 	if _, err := io.ReadFull(r, b); err != nil {
 		return nil, err
@@ -186,26 +197,239 @@ func ReadUint64(r io.Reader) (uint64, error) {
 // WriteUint32Fixed writes a uint32 in big-endian format (always 4 bytes)
 // Use this when you know values will be large and varint would be less efficient
 func WriteUint32Fixed(buf *bytes.Buffer, v uint32) error {
-	return binary.Write(buf, binary.BigEndian, v)
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	_, err := buf.Write(b[:])
+	return err
 }
 
 // ReadUint32Fixed reads a fixed-size uint32 in big-endian format
 func ReadUint32Fixed(r io.Reader) (uint32, error) {
-	var v uint32
-	err := binary.Read(r, binary.BigEndian, &v)
-	return v, err
+	var b [4]byte
+	if err := readFixed(r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
 }
 
 // WriteUint64Fixed writes a uint64 in big-endian format (always 8 bytes)
 func WriteUint64Fixed(buf *bytes.Buffer, v uint64) error {
-	return binary.Write(buf, binary.BigEndian, v)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	_, err := buf.Write(b[:])
+	return err
 }
 
 // ReadUint64Fixed reads a fixed-size uint64 in big-endian format
 func ReadUint64Fixed(r io.Reader) (uint64, error) {
-	var v uint64
-	err := binary.Read(r, binary.BigEndian, &v)
-	return v, err
+	var b [8]byte
+	if err := readFixed(r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
+
+// readFixed fills b from r, using the ByteReader interface when available
+func readFixed(r io.Reader, b []byte) error {
+	if br, ok := r.(io.ByteReader); ok {
+		for i := range b {
+			c, err := br.ReadByte()
+			if err != nil {
+				if err == io.EOF && i > 0 {
+					return io.ErrUnexpectedEOF
+				}
+				return err
+			}
+			b[i] = c
+		}
+		return nil
+	}
+	_, err := io.ReadFull(r, b)
+	return err
+}
+
+// zigzag maps signed integers to unsigned so small magnitudes stay small
+// (0 => 0, -1 => 1, 1 => 2, -2 => 3, ...)
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+// unzigzag reverses zigzag
+func unzigzag(u uint64) int64 {
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+// WriteInt64 writes a signed integer using zigzag varint encoding
+// Small negative numbers use as few bytes as small positive ones
+func WriteInt64(buf *bytes.Buffer, v int64) error {
+	return WriteVarint(buf, zigzag(v))
+}
+
+// ReadInt64 reads a zigzag varint-encoded signed integer
+func ReadInt64(r io.Reader) (int64, error) {
+	u, err := ReadVarint(r)
+	if err != nil {
+		return 0, err
+	}
+	return unzigzag(u), nil
+}
+
+// WriteInt32 writes a signed 32-bit integer using zigzag varint encoding
+func WriteInt32(buf *bytes.Buffer, v int32) error {
+	return WriteVarint(buf, zigzag(int64(v)))
+}
+
+// ReadInt32 reads a zigzag varint-encoded signed 32-bit integer
+func ReadInt32(r io.Reader) (int32, error) {
+	v, err := ReadInt64(r)
+	if err != nil {
+		return 0, err
+	}
+	if v < math.MinInt32 || v > math.MaxInt32 {
+		return 0, ErrVarintOverflow
+	}
+	return int32(v), nil
+}
+
+// WriteInt32Fixed writes an int32 in big-endian two's complement format (always 4 bytes)
+func WriteInt32Fixed(buf *bytes.Buffer, v int32) error {
+	return WriteUint32Fixed(buf, uint32(v))
+}
+
+// ReadInt32Fixed reads a fixed-size int32 in big-endian format
+func ReadInt32Fixed(r io.Reader) (int32, error) {
+	v, err := ReadUint32Fixed(r)
+	return int32(v), err
+}
+
+// WriteInt64Fixed writes an int64 in big-endian two's complement format (always 8 bytes)
+func WriteInt64Fixed(buf *bytes.Buffer, v int64) error {
+	return WriteUint64Fixed(buf, uint64(v))
+}
+
+// ReadInt64Fixed reads a fixed-size int64 in big-endian format
+func ReadInt64Fixed(r io.Reader) (int64, error) {
+	v, err := ReadUint64Fixed(r)
+	return int64(v), err
+}
+
+// WriteFloat32 writes a float32 as its IEEE 754 bits in big-endian format (always 4 bytes)
+func WriteFloat32(buf *bytes.Buffer, v float32) error {
+	return WriteUint32Fixed(buf, math.Float32bits(v))
+}
+
+// ReadFloat32 reads a fixed-size IEEE 754 float32
+func ReadFloat32(r io.Reader) (float32, error) {
+	v, err := ReadUint32Fixed(r)
+	return math.Float32frombits(v), err
+}
+
+// WriteFloat64 writes a float64 as its IEEE 754 bits in big-endian format (always 8 bytes)
+func WriteFloat64(buf *bytes.Buffer, v float64) error {
+	return WriteUint64Fixed(buf, math.Float64bits(v))
+}
+
+// ReadFloat64 reads a fixed-size IEEE 754 float64
+func ReadFloat64(r io.Reader) (float64, error) {
+	v, err := ReadUint64Fixed(r)
+	return math.Float64frombits(v), err
+}
+
+// WriteDuration writes a time.Duration as zigzag varint nanoseconds
+func WriteDuration(buf *bytes.Buffer, d time.Duration) error {
+	return WriteInt64(buf, int64(d))
+}
+
+// ReadDuration reads a zigzag varint-encoded time.Duration
+func ReadDuration(r io.Reader) (time.Duration, error) {
+	v, err := ReadInt64(r)
+	return time.Duration(v), err
+}
+
+// WriteTime writes a time.Time with nanosecond precision and its location
+// Format: [UnixSeconds(zigzag varint)][Nanos(varint)][Location(string)][Offset(zigzag varint)]
+// The location is written by name ("UTC", "Europe/Paris", ...) together with the zone offset
+// in effect at t, so the reader can fall back to a fixed zone if it lacks the tz database.
+// The monotonic clock reading is not preserved.
+func WriteTime(buf *bytes.Buffer, t time.Time) error {
+	if err := WriteInt64(buf, t.Unix()); err != nil {
+		return err
+	}
+	if err := WriteVarint(buf, uint64(t.Nanosecond())); err != nil {
+		return err
+	}
+	zoneName, offset := t.Zone()
+	name := t.Location().String()
+	if t.Location() == time.Local {
+		// "Local" means something different on the reader, send the zone itself
+		name = ""
+	}
+	if name == "" {
+		name = zoneName
+	}
+	if err := WriteString(buf, name); err != nil {
+		return err
+	}
+	return WriteInt64(buf, int64(offset))
+}
+
+// ReadTime reads a time.Time written by WriteTime
+func ReadTime(r io.Reader) (time.Time, error) {
+	sec, err := ReadInt64(r)
+	if err != nil {
+		return time.Time{}, err
+	}
+	nsec, err := ReadVarint(r)
+	if err != nil {
+		return time.Time{}, err
+	}
+	name, err := ReadString(r)
+	if err != nil {
+		return time.Time{}, err
+	}
+	offset, err := ReadInt64(r)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return makeTime(sec, nsec, name, offset)
+}
+
+// makeTime rebuilds a time.Time from the fields written by WriteTime
+func makeTime(sec int64, nsec uint64, name string, offset int64) (time.Time, error) {
+	if nsec >= uint64(time.Second) || offset < -24*60*60 || offset > 24*60*60 {
+		return time.Time{}, ErrInvalidTime
+	}
+
+	t := time.Unix(sec, int64(nsec))
+	if name == "UTC" || (name == "" && offset == 0) {
+		return t.UTC(), nil
+	}
+	if name != "" && name != "Local" {
+		// Abbreviations like "CST" may load a zone other than the writer's, so the
+		// location is only used when it agrees with the transmitted offset
+		if loc, err := time.LoadLocation(name); err == nil {
+			if _, locOffset := t.In(loc).Zone(); int64(locOffset) == offset {
+				return t.In(loc), nil
+			}
+		}
+	}
+	return t.In(time.FixedZone(name, int(offset))), nil
+}
+
+// UUIDSize is the size of a UUID in bytes
+const UUIDSize = 16
+
+// WriteUUID writes a 16-byte UUID as raw bytes with no length prefix
+func WriteUUID(buf *bytes.Buffer, id [UUIDSize]byte) error {
+	_, err := buf.Write(id[:])
+	return err
+}
+
+// ReadUUID reads a 16-byte UUID
+func ReadUUID(r io.Reader) ([UUIDSize]byte, error) {
+	var id [UUIDSize]byte
+	err := readFixed(r, id[:])
+	return id, err
 }
 
 // WriteBool writes a boolean as a single byte (0 or 1)
@@ -244,28 +468,40 @@ func unsafeBytesToString(b []byte) string {
 	// 1. We just allocated the byte slice in ReadString
 	// 2. We never modify it after this point
 	// 3. Go strings are immutable
-	return string(b)
+	// #nosec G103 -- b is owned by the caller and never modified afterwards
+	return unsafe.String(&b[0], len(b))
 }
 
 // StreamHeader Marshal/Unmarshal (internal use)
 func (p *StreamHeader) Marshal() ([]byte, error) {
-	buf := GetBuffer()
-	defer PutBuffer(buf)
-	
-	if err := buf.WriteByte(p.OriginalType); err != nil {
-		return nil, err
+	return p.AppendMarshal(make([]byte, 0, p.Size()))
+}
+
+func (p *StreamHeader) AppendMarshal(dst []byte) ([]byte, error) {
+	dst = append(dst, p.OriginalType)
+	dst = AppendUint64(dst, p.TotalSize)
+	dst = AppendUint32(dst, p.TotalChunks)
+	if p.Token == "" && len(p.Digest) == 0 {
+		return dst, nil
 	}
-	if err := WriteUint64(buf, p.TotalSize); err != nil {
-		return nil, err
+	// Trailing fields of resumable and integrity-checked streams, ignored by older receivers
+	dst = AppendUint32(dst, p.ChunkSize)
+	dst = AppendString(dst, p.Token)
+	if len(p.Digest) == 0 {
+		return dst, nil
 	}
-	if err := WriteUint32(buf, p.TotalChunks); err != nil {
-		return nil, err
+	return AppendBytes(dst, p.Digest), nil
+}
+
+func (p *StreamHeader) Size() int {
+	n := 1 + SizeVarint(p.TotalSize) + SizeVarint(uint64(p.TotalChunks))
+	if p.Token != "" || len(p.Digest) > 0 {
+		n += SizeVarint(uint64(p.ChunkSize)) + SizeString(p.Token)
 	}
-	
-	// Copy buffer contents before returning it to pool
-	result := make([]byte, buf.Len())
-	copy(result, buf.Bytes())
-	return result, nil
+	if len(p.Digest) > 0 {
+		n += SizeBytes(p.Digest)
+	}
+	return n
 }
 
 func (p *StreamHeader) Unmarshal(data []byte) error {
@@ -280,37 +516,78 @@ func (p *StreamHeader) Unmarshal(data []byte) error {
 	if p.TotalChunks, err = ReadUint32(r); err != nil {
 		return err
 	}
+	if r.Len() == 0 {
+		return nil
+	}
+	if p.ChunkSize, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if p.Token, err = ReadString(r); err != nil {
+		return err
+	}
+	if r.Len() == 0 {
+		return nil
+	}
+	if p.Digest, err = ReadBytes(r); err != nil {
+		return err
+	}
 	return nil
 }
 
 // StreamChunk Marshal/Unmarshal (internal use)
 func (p *StreamChunk) Marshal() ([]byte, error) {
-	buf := GetBuffer()
-	defer PutBuffer(buf)
-	
-	if err := WriteUint32(buf, p.ChunkIndex); err != nil {
-		return nil, err
+	return p.AppendMarshal(make([]byte, 0, p.Size()))
+}
+
+// AppendMarshal lets the send path copy chunk data straight into the outgoing frame
+func (p *StreamChunk) AppendMarshal(dst []byte) ([]byte, error) {
+	dst = AppendUint32(dst, p.ChunkIndex)
+	dst = AppendBytes(dst, p.Data)
+	if len(p.Digest) == 0 {
+		return dst, nil
 	}
-	if err := WriteBytes(buf, p.Data); err != nil {
-		return nil, err
+	return AppendBytes(dst, p.Digest), nil
+}
+
+func (p *StreamChunk) Size() int {
+	n := SizeVarint(uint64(p.ChunkIndex)) + SizeBytes(p.Data)
+	if len(p.Digest) > 0 {
+		n += SizeBytes(p.Digest)
 	}
-	
-	// Copy buffer contents before returning it to pool
-	result := make([]byte, buf.Len())
-	copy(result, buf.Bytes())
-	return result, nil
+	return n
 }
 
+// Unmarshal decodes a chunk without copying: Data aliases data, which is
+// the chunk message's own payload and is copied once during reassembly
 func (p *StreamChunk) Unmarshal(data []byte) error {
-	r := bytes.NewReader(data)
-	var err error
-	if p.ChunkIndex, err = ReadUint32(r); err != nil {
-		return err
+	d := NewZeroCopyDecoder(data)
+	p.ChunkIndex = d.ReadUint32()
+	p.Data = d.ReadBytes()
+	if d.Remaining() > 0 {
+		p.Digest = d.ReadBytes()
 	}
-	if p.Data, err = ReadBytes(r); err != nil {
-		return err
-	}
-	return nil
+	return d.Err()
+}
+
+// StreamCancel Marshal/Unmarshal (internal use)
+func (p *StreamCancel) Marshal() ([]byte, error) {
+	return p.AppendMarshal(make([]byte, 0, p.Size()))
+}
+
+func (p *StreamCancel) AppendMarshal(dst []byte) ([]byte, error) {
+	dst = AppendUint32(dst, uint32(p.Reason))
+	return AppendBool(dst, p.Reject), nil
+}
+
+func (p *StreamCancel) Size() int {
+	return SizeVarint(uint64(p.Reason)) + 1
+}
+
+func (p *StreamCancel) Unmarshal(data []byte) error {
+	d := NewZeroCopyDecoder(data)
+	p.Reason = StreamCancelReason(d.ReadUint32())
+	p.Reject = d.ReadBool()
+	return d.Err()
 }
 
 // MarshalPayload serializes any supported payload type to binary
@@ -330,9 +607,49 @@ func MarshalPayload(payload interface{}) ([]byte, error) {
 		return m.Marshal()
 	}
 
+	// Payloads that only implement AppendMarshal
+	if a, ok := payload.(PayloadAppender); ok {
+		return a.AppendMarshal(make([]byte, 0, payloadSizeHint(payload)))
+	}
+
 	return nil, ErrInvalidPayloadType
 }
 
+// AppendPayload appends the serialized payload to dst and returns the extended slice.
+// PayloadAppender implementations encode in place; other payloads are marshaled with
+// MarshalPayload and copied.
+func AppendPayload(dst []byte, payload interface{}) ([]byte, error) {
+	switch p := payload.(type) {
+	case nil:
+		return dst, nil
+	case []byte:
+		return append(dst, p...), nil
+	case PayloadAppender:
+		return p.AppendMarshal(dst)
+	}
+
+	b, err := MarshalPayload(payload)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, b...), nil
+}
+
+// payloadSizeHint returns the expected encoded size of a payload, or 0 if unknown.
+// Hints from PayloadSizer are clamped so a bad value can't force a huge allocation.
+func payloadSizeHint(payload interface{}) int {
+	switch p := payload.(type) {
+	case []byte:
+		return len(p)
+	case PayloadSizer:
+		return min(max(p.Size(), 0), maxSizeHint)
+	}
+	return 0
+}
+
+// maxSizeHint caps the buffer space reserved up front from a PayloadSizer hint
+const maxSizeHint = 1 << 20
+
 // UnmarshalPayload deserializes binary data into the appropriate payload type
 // Uses the global registry to look up payload types
 // Returns raw bytes for unknown message types (non-strict mode)
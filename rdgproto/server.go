@@ -36,6 +36,7 @@ type Server struct {
 listener Listener
 opts     *MessageOptions
 handler  ConnectionHandler
+calls    CallHandler
 
 mu       sync.RWMutex
 clients  map[*Client]struct{}
@@ -71,6 +72,14 @@ defer s.mu.Unlock()
 s.handler = handler
 }
 
+// SetCallHandler sets the handler for streaming calls opened by clients. It applies
+// to connections accepted afterwards; a ConnectionHandler can still replace it per client.
+func (s *Server) SetCallHandler(handler CallHandler) {
+s.mu.Lock()
+defer s.mu.Unlock()
+s.calls = handler
+}
+
 // Start begins accepting connections (blocking)
 func (s *Server) Start() error {
 s.mu.Lock()
@@ -98,7 +107,11 @@ s.addClient(client)
 
 s.mu.RLock()
 handler := s.handler
+calls := s.calls
 s.mu.RUnlock()
+if calls != nil {
+client.SetCallHandler(calls)
+}
 
 go func(c *Client) {
 defer func() {
@@ -0,0 +1,215 @@
+package rdgproto
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// maxStatusDetails bounds the details of a status, sent or decoded
+const maxStatusDetails = 64
+
+// StatusCode says how a request or call ended. The codes and their numbers follow gRPC.
+type StatusCode uint32
+
+const (
+	StatusOK                 StatusCode = iota
+	StatusCanceled                      // the caller canceled the call
+	StatusUnknown                       // an error without a more specific code
+	StatusInvalidArgument               // the request is invalid regardless of state
+	StatusDeadlineExceeded              // the call's deadline expired
+	StatusNotFound                      // a requested entity doesn't exist
+	StatusAlreadyExists                 // an entity to create already exists
+	StatusPermissionDenied              // the caller may not do this
+	StatusResourceExhausted             // a limit or quota was reached
+	StatusFailedPrecondition            // the system is not in a state to do this
+	StatusAborted                       // the operation was aborted, e.g. by a conflict
+	StatusOutOfRange                    // a value is outside the valid range
+	StatusUnimplemented                 // the operation is not supported
+	StatusInternal                      // an internal invariant is broken
+	StatusUnavailable                   // the service or connection is unavailable
+	StatusDataLoss                      // data was lost or corrupted
+	StatusUnauthenticated               // the caller is not authenticated
+)
+
+var statusCodeNames = map[StatusCode]string{
+	StatusOK:                 "ok",
+	StatusCanceled:           "canceled",
+	StatusUnknown:            "unknown",
+	StatusInvalidArgument:    "invalid argument",
+	StatusDeadlineExceeded:   "deadline exceeded",
+	StatusNotFound:           "not found",
+	StatusAlreadyExists:      "already exists",
+	StatusPermissionDenied:   "permission denied",
+	StatusResourceExhausted:  "resource exhausted",
+	StatusFailedPrecondition: "failed precondition",
+	StatusAborted:            "aborted",
+	StatusOutOfRange:         "out of range",
+	StatusUnimplemented:      "unimplemented",
+	StatusInternal:           "internal",
+	StatusUnavailable:        "unavailable",
+	StatusDataLoss:           "data loss",
+	StatusUnauthenticated:    "unauthenticated",
+}
+
+func (c StatusCode) String() string {
+	if name, ok := statusCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("code %d", uint32(c))
+}
+
+// StatusError is an error with a status code, such as the error that ended a call or
+// the error a peer's MessageHandler returned for a message. Return one from a handler
+// to choose the status the peer sees.
+type StatusError struct {
+	Code    StatusCode
+	Message string
+	Details []StatusDetail
+}
+
+// StatusDetail is structured information attached to a StatusError. Payload is
+// encoded like the payload of a message of type Type, and the receiving side decodes
+// it with its registry. Payloads of unregistered types, or that fail to decode, are
+// received as []byte. At most 64 details are sent; any beyond that are dropped.
+type StatusDetail struct {
+	Type    byte
+	Payload interface{}
+}
+
+// Errorf returns a *StatusError with code and a formatted message
+//
+// Example:
+//
+//	return rdgproto.Errorf(rdgproto.StatusNotFound, "no user %q", name)
+func Errorf(code StatusCode, format string, args ...interface{}) *StatusError {
+	return &StatusError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return "status: " + e.Code.String()
+	}
+	return "status: " + e.Code.String() + ": " + e.Message
+}
+
+// RemoteError reports an error frame from the peer: handling message ID failed
+// with Err. Client.Call returns Err directly.
+type RemoteError struct {
+	ID  uint32
+	Err *StatusError
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("message %d: %v", e.ID, e.Err)
+}
+
+func (e *RemoteError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorCode returns the status code of err (see StatusFromError)
+func ErrorCode(err error) StatusCode {
+	return StatusFromError(err).Code
+}
+
+// StatusFromError returns the status describing err: StatusOK for nil, the
+// *StatusError in err's chain if there is one, StatusCanceled and
+// StatusDeadlineExceeded for context errors and StatusUnknown otherwise.
+func StatusFromError(err error) *StatusError {
+	var statusErr *StatusError
+	switch {
+	case err == nil:
+		return &StatusError{Code: StatusOK}
+	case errors.As(err, &statusErr):
+		return statusErr
+	case errors.Is(err, context.Canceled):
+		return &StatusError{Code: StatusCanceled, Message: err.Error()}
+	case errors.Is(err, context.DeadlineExceeded):
+		return &StatusError{Code: StatusDeadlineExceeded, Message: err.Error()}
+	default:
+		return &StatusError{Code: StatusUnknown, Message: err.Error()}
+	}
+}
+
+// errorFrame is the payload of an error frame
+type errorFrame struct {
+	status *StatusError
+}
+
+func (f *errorFrame) AppendMarshal(dst []byte) ([]byte, error) {
+	return appendStatus(append(dst, extensionError), f.status)
+}
+
+// appendStatus appends a status: [code][message][count]([type][payload])...
+func appendStatus(dst []byte, s *StatusError) ([]byte, error) {
+	dst = AppendUint32(dst, uint32(s.Code))
+	dst = AppendString(dst, s.Message)
+	details := s.Details[:min(len(s.Details), maxStatusDetails)]
+	dst = AppendVarint(dst, uint64(len(details)))
+	for _, detail := range details {
+		b, err := AppendPayload(nil, detail.Payload)
+		if err != nil {
+			return dst, err
+		}
+		dst = append(dst, detail.Type)
+		dst = AppendBytes(dst, b)
+	}
+	return dst, nil
+}
+
+// readStatus reads a status written by appendStatus. Nothing it returns aliases
+// the decoder's input, so the input can be released.
+func readStatus(d *Decoder, opts *MessageOptions) (*StatusError, error) {
+	s := &StatusError{
+		Code:    StatusCode(d.ReadUint32()),
+		Message: strings.Clone(d.ReadString()),
+	}
+	n := d.ReadCount(maxStatusDetails, 2)
+	for i := 0; i < n; i++ {
+		detail := StatusDetail{Type: d.ReadUint8()}
+		data := bytes.Clone(d.ReadBytes())
+		if d.Err() != nil {
+			break
+		}
+		detail.Payload = data
+		if factory := detailFactory(detail.Type, opts); factory != nil {
+			// A detail that doesn't decode stays raw rather than losing the status
+			if p := factory(); p.Unmarshal(data) == nil {
+				detail.Payload = p
+			}
+		}
+		s.Details = append(s.Details, detail)
+	}
+	if err := d.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// detailFactory returns the factory for a detail type from the registry in opts,
+// or from the global registry. Strict mode doesn't apply to details.
+func detailFactory(detailType byte, opts *MessageOptions) PayloadFactory {
+	if IsReservedType(detailType) {
+		return nil
+	}
+	if opts != nil && opts.Registry != nil {
+		return opts.Registry.Get(detailType)
+	}
+	return globalRegistry.Get(detailType)
+}
+
+// MarshalError serializes an error frame reporting that handling message messageID
+// failed with err, for transports that don't use Protocol. The receiving side's
+// UnmarshalMessage returns the status as a *StatusError payload.
+func MarshalError(messageID uint32, err error, opts *MessageOptions) ([]byte, error) {
+	return MarshalMessage(MessageTypeExtension, messageID, &errorFrame{status: StatusFromError(err)}, opts)
+}
+
+// SendError tells the peer that handling message messageID failed with err.
+// The peer's ReceiveMessage reports it as a *RemoteError.
+func (p *Protocol) SendError(messageID uint32, err error) error {
+	return p.sendDirect(MessageTypeExtension, messageID, &errorFrame{status: StatusFromError(err)})
+}
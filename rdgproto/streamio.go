@@ -0,0 +1,240 @@
+package rdgproto
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	ErrNoStreamHandler = errors.New("no stream handler for open-ended stream")
+)
+
+// maxStreamReaderBuffer is how many bytes of an incoming open-ended stream are
+// buffered before the receive loop waits for the handler to read them
+const maxStreamReaderBuffer = 1024 * 1024
+
+// StreamHandler is called in its own goroutine when an open-ended stream starts.
+// msg carries the stream's message type and ID and has no payload. r returns the
+// stream's bytes as they arrive and io.EOF once the sender has finished; a stream
+// that is discarded (see StreamError) makes Read return the error instead.
+//
+// With StreamConfig.Integrity, each chunk's running digest is checked before Read
+// returns its bytes, so corrupted data never reaches the handler. Without it, and
+// for the whole-stream signature, the bytes are only verified at the end: the
+// handler must not act on them until Read has returned io.EOF, and on any other
+// error it should throw away what it read.
+//
+// Data that the handler leaves unread when it returns is discarded.
+type StreamHandler func(msg *Message, r io.Reader)
+
+// SetStreamHandler sets the handler for open-ended streams sent with SendStream.
+// Without a handler such streams are discarded with ErrNoStreamHandler.
+//
+// The handler should read promptly: once maxStreamReaderBuffer bytes are waiting,
+// ReceiveMessage stops reading the connection until the handler catches up, which
+// in turn slows down the sender.
+func (p *Protocol) SetStreamHandler(handler StreamHandler) {
+	p.streamMu.Lock()
+	defer p.streamMu.Unlock()
+	p.streamHandler = handler
+}
+
+// SendStream sends everything read from r as an open-ended stream of the given message
+// type, chunk by chunk as it is read, without knowing the total size in advance.
+// The receiver's StreamHandler reads the bytes from an io.Reader, so neither side holds
+// the whole payload in memory and MaxPayloadSize does not apply.
+//
+// Chunks hold at most StreamConfig.ChunkSize bytes and are sent as soon as they are
+// read. Direct messages are written between chunks. SendStream returns the stream's
+// message ID once r returns io.EOF and the end marker has been sent.
+//
+// With StreamConfig.Integrity, every chunk carries the SHA-256 digest of the stream
+// so far, which the receiver checks before its handler reads the chunk. With Integrity
+// or a Signer, the end marker carries the digest of all the data sent, signed with the
+// Signer, and the receiver's Read reports a mismatch instead of io.EOF.
+//
+// If ctx is done or r fails, SendStream cancels the stream and the receiver discards
+// it. A Read that blocks is not interrupted by ctx. A stream rejected by the receiver
+// stops with a *CancelError.
+//
+// The message ID is passed to OnSendProgress, so the stream can also be canceled with
+// CancelStream from there.
+func (p *Protocol) SendStream(ctx context.Context, messageType byte, r io.Reader) (uint32, error) {
+	id := p.NextMessageID()
+	header := &StreamHeader{
+		OriginalType: messageType,
+		TotalChunks:  UnknownStreamChunks,
+	}
+	canceler := p.trackSending(id)
+	defer p.untrackSending(id, canceler)
+	if err := p.sendDirect(MessageTypeStreamStart, id, header); err != nil {
+		return id, err
+	}
+
+	digest := openStreamDigest(messageType, id)
+	var link []byte
+	buf := make([]byte, p.streamConfig.ChunkSize)
+	var sent uint64
+	for index := uint32(0); ; {
+		if canceler.canceled() != nil {
+			return id, p.stopSending(id, canceler)
+		}
+		if err := ctx.Err(); err != nil {
+			return id, p.abortSending(id, canceler, err)
+		}
+
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			digest.Write(buf[:n])
+			if err := p.limiter.Load().wait(ctx, n); err != nil {
+				return id, p.abortSending(id, canceler, err)
+			}
+			p.yieldToDirect()
+			chunk := &StreamChunk{ChunkIndex: index, Data: buf[:n]}
+			if p.streamConfig.Integrity {
+				link = digest.Sum(link[:0])
+				chunk.Digest = link
+			}
+			if err := p.sendDirect(MessageTypeStreamChunk, id, chunk); err != nil {
+				return id, err
+			}
+			// Keep at most one chunk queued ahead of direct messages
+			if err := p.Flush(); err != nil {
+				return id, err
+			}
+			index++
+			sent += uint64(n)
+			p.reportSent(id, header, sent, index)
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return id, p.abortSending(id, canceler, readErr)
+		}
+	}
+
+	end, err := p.openStreamTrailer(messageType, id, digest.Sum(nil))
+	if err != nil {
+		return id, err
+	}
+	return id, p.sendDirect(MessageTypeStreamEnd, id, end)
+}
+
+// streamReader is the io.Reader given to a StreamHandler. The receive loop pushes
+// chunks and the handler reads them.
+type streamReader struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	frames   []*Message // pooled frames backing queued chunks
+	chunks   [][]byte
+	buffered int
+	err      error // io.EOF or the reason the stream was discarded
+	closed   bool  // the handler returned
+}
+
+// newStreamReader creates an empty stream reader
+func newStreamReader() *streamReader {
+	r := &streamReader{}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+// Read implements io.Reader
+func (r *streamReader) Read(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for len(r.chunks) == 0 && r.err == nil {
+		r.cond.Wait()
+	}
+	if len(r.chunks) == 0 {
+		return 0, r.err
+	}
+
+	n := copy(b, r.chunks[0])
+	r.chunks[0] = r.chunks[0][n:]
+	r.buffered -= n
+	if len(r.chunks[0]) == 0 {
+		r.chunks[0] = nil
+		r.chunks = r.chunks[1:]
+		if r.frames[0] != nil {
+			r.frames[0].Release()
+		}
+		r.frames[0] = nil
+		r.frames = r.frames[1:]
+	}
+	r.cond.Broadcast()
+	return n, nil
+}
+
+// push queues a chunk whose data aliases frame, waiting while too much is buffered.
+// The chunk is dropped if the handler has returned or the stream has ended.
+func (r *streamReader) push(frame *Message, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for r.buffered >= maxStreamReaderBuffer && !r.closed && r.err == nil {
+		r.cond.Wait()
+	}
+	if r.closed || r.err != nil {
+		frame.Release()
+		return
+	}
+
+	if frame.pooled == nil {
+		frame = nil
+	}
+	r.frames = append(r.frames, frame)
+	r.chunks = append(r.chunks, data)
+	r.buffered += len(data)
+	r.cond.Broadcast()
+}
+
+// full reports whether push is waiting for the handler to read
+func (r *streamReader) full() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buffered >= maxStreamReaderBuffer && !r.closed && r.err == nil
+}
+
+// finish ends the stream with io.EOF or an error. Chunks already queued can still be
+// read after io.EOF; a failed stream drops them.
+func (r *streamReader) finish(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return
+	}
+	r.err = err
+	if err != io.EOF {
+		r.drop()
+	}
+	r.cond.Broadcast()
+}
+
+// close is called when the handler returns and drops unread data
+func (r *streamReader) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+	r.drop()
+	r.cond.Broadcast()
+}
+
+// drop discards queued chunks. The caller holds mu.
+func (r *streamReader) drop() {
+	for _, frame := range r.frames {
+		if frame != nil {
+			frame.Release()
+		}
+	}
+	r.frames = nil
+	r.chunks = nil
+	r.buffered = 0
+}
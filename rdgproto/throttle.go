@@ -0,0 +1,81 @@
+package rdgproto
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter paces outgoing stream chunks to StreamConfig.RateLimit. It is a token
+// bucket holding at most one chunk, so chunks are spread out instead of sent in bursts.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64 // negative while chunks already sent are being paid off
+	last   time.Time
+}
+
+// newRateLimiter creates a limiter for bytesPerSecond, or returns nil for no limit
+func newRateLimiter(bytesPerSecond int64, chunkSize int) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	burst := float64(max(chunkSize, 1))
+	return &rateLimiter{
+		rate:   float64(bytesPerSecond),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n more bytes may be sent. A nil limiter never waits.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// The bytes won't be sent after all
+		l.mu.Lock()
+		l.tokens += float64(n)
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// reportSent calls StreamConfig.OnSendProgress after a chunk has been sent
+func (p *Protocol) reportSent(msgID uint32, header *StreamHeader, bytes uint64, chunks uint32) {
+	if p.streamConfig.OnSendProgress != nil {
+		p.streamConfig.OnSendProgress(newStreamProgress(msgID, header, bytes, chunks))
+	}
+}
+
+// newStreamProgress describes a stream that has transferred bytes in chunks so far
+func newStreamProgress(msgID uint32, header *StreamHeader, bytes uint64, chunks uint32) StreamProgress {
+	return StreamProgress{
+		ID:          msgID,
+		Type:        header.OriginalType,
+		Bytes:       bytes,
+		Chunks:      chunks,
+		TotalSize:   header.TotalSize,
+		TotalChunks: header.TotalChunks,
+	}
+}
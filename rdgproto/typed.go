@@ -0,0 +1,73 @@
+package rdgproto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrPayloadTypeMismatch = errors.New("payload type mismatch")
+)
+
+// PayloadPointer constrains PT to be a pointer to T that implements Payload.
+// It lets the generic helpers allocate a T and still call its pointer-receiver methods.
+type PayloadPointer[T any] interface {
+	*T
+	Payload
+}
+
+// UnmarshalerPointer constrains PT to be a pointer to T that implements PayloadUnmarshaler
+type UnmarshalerPointer[T any] interface {
+	*T
+	PayloadUnmarshaler
+}
+
+// Register registers payload type T with the global registry.
+// Unlike RegisterPayloadType, a type that does not implement Payload is a compile error.
+//
+// Example:
+//
+//	rdgproto.Register[LoginPayload](MsgTypeLogin)
+func Register[T any, PT PayloadPointer[T]](messageType byte) {
+	RegisterWith[T, PT](globalRegistry, messageType)
+}
+
+// RegisterWith registers payload type T with a specific registry
+func RegisterWith[T any, PT PayloadPointer[T]](registry *PayloadRegistry, messageType byte) {
+	registry.Register(messageType, func() PayloadUnmarshaler {
+		return PT(new(T))
+	})
+}
+
+// TypedHandler adapts a handler taking *T into a HandlerFunc.
+// Registered payloads of type *T are passed through; raw bytes (from a type missing
+// in the registry) are decoded into a new T. Any other payload returns ErrPayloadTypeMismatch.
+func TypedHandler[T any, PT UnmarshalerPointer[T]](fn func(ctx context.Context, msg *Message, payload *T) error) HandlerFunc {
+	return func(ctx context.Context, msg *Message, payload interface{}) error {
+		switch p := payload.(type) {
+		case *T:
+			return fn(ctx, msg, p)
+		case []byte:
+			v := new(T)
+			if err := PT(v).Unmarshal(p); err != nil {
+				return err
+			}
+			return fn(ctx, msg, v)
+		default:
+			return fmt.Errorf("%w: message type %d: got %T, want %T", ErrPayloadTypeMismatch, msg.Type, payload, (*T)(nil))
+		}
+	}
+}
+
+// HandleTyped registers a handler on the mux that receives the payload as *T
+//
+// Example:
+//
+//	rdgproto.HandleTyped(mux, MsgTypeLogin, func(ctx context.Context, msg *rdgproto.Message, login *LoginPayload) error {
+//	    log.Printf("Login from: %s", login.Username)
+//	    return nil
+//	})
+func HandleTyped[T any, PT UnmarshalerPointer[T]](mux *ServeMux, messageType byte, fn func(ctx context.Context, msg *Message, payload *T) error) {
+	mux.Handle(messageType, TypedHandler[T, PT](fn))
+}
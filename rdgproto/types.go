@@ -8,6 +8,7 @@ package rdgproto
 import (
 "io"
 "sync"
+"time"
 )
 
 // Reserved message types for internal streaming protocol
@@ -16,6 +17,19 @@ const (
 MessageTypeStreamStart byte = 250
 MessageTypeStreamChunk byte = 251
 MessageTypeStreamEnd   byte = 252
+
+// MessageTypeStreamResume answers a resumable stream start with the chunks
+// the receiver already holds
+MessageTypeStreamResume byte = 253
+
+// MessageTypeStreamCancel aborts a stream, sent by its sender or by a receiver
+// rejecting it. The message ID is the stream's.
+MessageTypeStreamCancel byte = 254
+
+// MessageTypeExtension carries internal frames whose kind is the first payload
+// byte, such as logical channel frames, so they don't each need a message type.
+// Receivers ignore kinds they don't know.
+MessageTypeExtension byte = 255
 )
 
 // IsReservedType returns true if the message type is reserved for internal use
@@ -39,6 +53,22 @@ StreamingThreshold = 1024 * 1024 // 1MB
 
 // DefaultChunkSize is the default size for stream chunks
 DefaultChunkSize = 64 * 1024 // 64KB
+
+// DefaultMaxStreams is the default limit on streams being reassembled per connection
+DefaultMaxStreams = 16
+
+// DefaultMaxStreamBytes is the default limit on bytes buffered for reassembly per connection
+DefaultMaxStreamBytes = 256 * 1024 * 1024 // 256MB
+
+// DefaultStreamIdleTimeout is how long a partially received stream is kept without new chunks
+DefaultStreamIdleTimeout = 30 * time.Second
+
+// DefaultChannelWindow is the default receive window of a logical channel
+DefaultChannelWindow = 256 * 1024 // 256KB
+
+// UnknownStreamChunks in StreamHeader.TotalChunks marks a stream of unknown length
+// sent with Protocol.SendStream. Its chunks arrive in order until MessageTypeStreamEnd.
+UnknownStreamChunks uint32 = 1<<32 - 1
 )
 
 // Message represents a protocol message with header and payload
@@ -47,6 +77,9 @@ Type      byte
 ID        uint32
 Payload   []byte
 Signature []byte
+
+// pooled is the receive buffer backing Payload when MessageOptions.PooledBuffers is set
+pooled *[]byte
 }
 
 // StreamHeader represents metadata for a streamed message (internal use)
@@ -54,12 +87,30 @@ type StreamHeader struct {
 OriginalType byte
 TotalSize    uint64
 TotalChunks  uint32
+
+// Set only for resumable streams (see Protocol.SendResumable)
+ChunkSize uint32
+Token     string
+
+// SHA-256 of the whole payload, set when StreamConfig.Integrity is enabled
+Digest []byte
 }
 
 // StreamChunk represents a chunk in a streamed message (internal use)
 type StreamChunk struct {
 ChunkIndex uint32
 Data       []byte
+
+// Running digest of an open-ended stream through this chunk, set when
+// StreamConfig.Integrity is enabled
+Digest []byte
+}
+
+// StreamCancel aborts a stream (internal use). Reject is set when the receiver
+// rejects the stream rather than the sender canceling it.
+type StreamCancel struct {
+Reason StreamCancelReason
+Reject bool
 }
 
 // Connection interface for transport-agnostic communication
@@ -92,6 +143,23 @@ type PayloadUnmarshaler interface {
 Unmarshal(data []byte) error
 }
 
+// PayloadAppender is an optional interface for payloads that can encode themselves
+// onto the end of an existing buffer. When a payload implements it, the send path
+// encodes the payload directly into the outgoing frame instead of copying the slice
+// returned by Marshal.
+//
+// AppendMarshal must append the same bytes Marshal would return and must not keep
+// or modify dst[:len(dst)].
+type PayloadAppender interface {
+AppendMarshal(dst []byte) ([]byte, error)
+}
+
+// PayloadSizer is an optional interface reporting the encoded payload size in bytes.
+// The value is only a hint used to size buffers up front; it does not need to be exact.
+type PayloadSizer interface {
+Size() int
+}
+
 // Payload combines both marshal and unmarshal capabilities
 type Payload interface {
 PayloadMarshaler
@@ -200,13 +268,70 @@ ChunkSize int
 
 // Enabled controls whether streaming is active
 Enabled bool
+
+// Sequential sends all chunks of a stream back to back instead of interleaving
+// them with other streams and direct messages
+Sequential bool
+
+// Limits for reassembling incoming streams. Zero uses the default and a
+// negative value removes the limit.
+
+// MaxStreams limits how many incoming streams are reassembled at once (default: 16)
+MaxStreams int
+
+// MaxStreamBytes limits the bytes buffered for all incoming streams (default: 256MB)
+MaxStreamBytes int64
+
+// IdleTimeout discards an incoming stream that receives no chunk for this long
+// (default: 30s). On connections with read deadlines, such as net.Conn, a blocked
+// ReceiveMessage returns the error right away; the Protocol then owns the read
+// deadline. Otherwise the error is returned once the next frame arrives.
+IdleTimeout time.Duration
+
+// Integrity adds a SHA-256 digest of the whole payload to outgoing streams, which
+// the receiver checks before delivering the message. Streams with a known size
+// carry it in the stream header. Open-ended streams carry a running digest in every
+// chunk, checked before the chunk reaches the StreamHandler, and the final digest in
+// the end marker. A receiver with Integrity discards incoming streams without a
+// digest with ErrStreamIntegrity.
+Integrity bool
+
+// TransferStore persists incoming resumable streams (see Protocol.SendResumable).
+// Without a store they are received like other streams and can't be resumed.
+// Stored chunks count against MaxStreamBytes like buffered ones.
+TransferStore TransferStore
+
+// RateLimit caps the bytes per second of stream chunk data sent by a Protocol,
+// shared by all its outgoing streams. Direct messages are not limited. Zero means
+// unlimited.
+RateLimit int64
+
+// OnSendProgress and OnReceiveProgress are called after each chunk of an outgoing
+// or incoming stream. They are called from the goroutine sending or receiving the
+// chunk and should return quickly.
+OnSendProgress    func(StreamProgress)
+OnReceiveProgress func(StreamProgress)
+}
+
+// StreamProgress reports how much of a stream has been sent or received.
+// Open-ended streams have a TotalSize of 0 and TotalChunks of UnknownStreamChunks.
+type StreamProgress struct {
+ID          uint32
+Type        byte
+Bytes       uint64
+Chunks      uint32
+TotalSize   uint64
+TotalChunks uint32
 }
 
 // DefaultStreamConfig returns the default streaming configuration
 func DefaultStreamConfig() *StreamConfig {
 return &StreamConfig{
-Threshold: StreamingThreshold,
-ChunkSize: DefaultChunkSize,
-Enabled:   true,
+Threshold:      StreamingThreshold,
+ChunkSize:      DefaultChunkSize,
+Enabled:        true,
+MaxStreams:     DefaultMaxStreams,
+MaxStreamBytes: DefaultMaxStreamBytes,
+IdleTimeout:    DefaultStreamIdleTimeout,
 }
 }
@@ -0,0 +1,98 @@
+package rdgproto
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+)
+
+// vectoredMinSize is the smallest payload body sent as its own buffer in a vectored
+// write. Smaller bodies are cheaper to copy into the frame.
+const vectoredMinSize = 4 * 1024
+
+// zeroSignatureLength ends every unsigned message
+var zeroSignatureLength = [SignatureLengthSize]byte{}
+
+// vectoredFrame holds the buffers of one vectored write. Frames are pooled so that
+// building the net.Buffers value does not allocate.
+type vectoredFrame struct {
+	arr  [3][]byte
+	bufs net.Buffers
+}
+
+var vectoredPool = sync.Pool{
+	New: func() interface{} {
+		return new(vectoredFrame)
+	},
+}
+
+// supportsVectoredWrite reports whether conn turns a net.Buffers write into a single
+// writev system call. Other connections would receive one Write per buffer.
+func supportsVectoredWrite(conn Connection) bool {
+	switch conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+// splitPayload appends the encoding of payload to prefix, except for its bulk byte
+// slice, which is returned separately as body. ok is false for payload types that
+// must be encoded contiguously.
+func splitPayload(prefix []byte, payload interface{}) (head []byte, body []byte, ok bool) {
+	switch p := payload.(type) {
+	case []byte:
+		return prefix, p, true
+	case *StreamChunk:
+		if len(p.Digest) != 0 {
+			return prefix, nil, false
+		}
+		// Same bytes as StreamChunk.AppendMarshal, without copying Data
+		prefix = AppendUint32(prefix, p.ChunkIndex)
+		prefix = AppendVarint(prefix, uint64(len(p.Data)))
+		return prefix, p.Data, true
+	}
+	return prefix, nil, false
+}
+
+// sendVectored writes a message as [length prefix + header][payload body][signature length]
+// in one vectored write, so large byte payloads and stream chunks are never copied into
+// the frame. It reports false without writing anything when the message should be sent
+// contiguously instead: the connection lacks writev, the payload has no large byte body,
+// a Signer needs header and payload in a single slice, or the async writer needs a frame
+// that doesn't alias the caller's payload.
+func (p *Protocol) sendVectored(bufp *[]byte, messageType byte, messageID uint32, payload interface{}) (bool, error) {
+	if !p.vectored || p.async != nil || (p.opts != nil && p.opts.Signer != nil) {
+		return false, nil
+	}
+
+	head := append(*bufp, 0, 0, 0, 0) // length prefix, filled in below
+	head = append(head, messageType)
+	head = binary.BigEndian.AppendUint32(head, messageID)
+	head = append(head, 0, 0, 0, 0) // payload length, filled in below
+	head, body, ok := splitPayload(head, payload)
+	if !ok || len(body) < vectoredMinSize {
+		return false, nil
+	}
+	*bufp = head[:0]
+
+	payloadLen := len(head) - frameLengthSize - HeaderSize + len(body)
+	if payloadLen > MaxPayloadSize {
+		return true, ErrPayloadTooLarge
+	}
+	binary.BigEndian.PutUint32(head[frameLengthSize+MessageTypeSize+MessageIDSize:], uint32(payloadLen))
+	binary.BigEndian.PutUint32(head, uint32(HeaderSize+payloadLen+SignatureLengthSize))
+
+	vf := vectoredPool.Get().(*vectoredFrame)
+	vf.bufs = append(vf.arr[:0], head, body, zeroSignatureLength[:])
+
+	p.lockWrite()
+	_, err := vf.bufs.WriteTo(p.conn)
+	p.unlockWrite()
+
+	// Don't keep the payload alive from the pool
+	vf.arr = [3][]byte{}
+	vf.bufs = nil
+	vectoredPool.Put(vf)
+	return true, err
+}